@@ -0,0 +1,431 @@
+package net
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrInvalidAddress is returned when an address can't be parsed or is
+	// not valid for its scheme
+	ErrInvalidAddress = errors.New("Invalid address")
+	// ErrNoMultiaddr is returned when an address has no multiaddr equivalent
+	ErrNoMultiaddr = errors.New("Address has no multiaddr equivalent")
+)
+
+// Address is a parsed transport address.
+//
+// Addresses are written as `<scheme>:<value>`, optionally followed by the
+// stream protocol, ie. `tcp4:1.2.3.4:21600/proto`. What the value holds
+// depends on the scheme:
+//
+//   - `tcp`, `tcp4`, `tcp6`, `ws`, `wss` and `quic` hold a host and a port,
+//     IPv6 hosts are written in brackets, ie. `tcp6:[::1]:21600`, link-local
+//     ones along with their zone, ie. `tcp6:[fe80::1%eth0]:21600`
+//   - `dns`, `dns4` and `dns6` hold a host name and a port, they are resolved
+//     to `tcp4` and `tcp6` addresses before dialing
+//   - `mem` and `sim` hold a name, ie. `mem:n1`
+//   - `unix` holds an escaped socket path, see UnixAddress
+//   - `relay` holds the relays to go through, separated by commas, followed
+//     by the id of the peer to reach, ie. `relay:r1,r2/target/proto`
+//
+// Values of other schemes are kept as they are in Host, so transports added
+// with AddTransport can use their own formats.
+type Address struct {
+	Scheme string
+	// Host is the host of host and port addresses, the name of mem and sim
+	// addresses, and the unescaped path of unix addresses
+	Host string
+	// Zone is the scope zone of link-local IPv6 hosts, usually the name of
+	// the interface the address belongs to
+	Zone string
+	Port int
+	// Route holds the relays of relay addresses, in the order the circuit
+	// goes through them
+	Route []string
+	// Peer is the id of the peer relay addresses reach
+	Peer string
+	// Protocol is the stream protocol that follows the address, if any
+	Protocol string
+}
+
+// ParseAddress parses and validates an address
+func ParseAddress(addr string) (*Address, error) {
+	ps := strings.SplitN(addr, ":", 2)
+	if len(ps) < 2 || ps[0] == "" {
+		return nil, ErrInvalidAddress
+	}
+
+	a := &Address{
+		Scheme: ps[0],
+	}
+
+	value := ps[1]
+	switch addressKind(a.Scheme) {
+	case addressKindRelay:
+		// the relayed peer is part of the address
+		rp := strings.SplitN(value, "/", 3)
+		if len(rp) < 2 {
+			return nil, ErrInvalidAddress
+		}
+		a.Route = strings.Split(rp[0], ",")
+		a.Peer = rp[1]
+		if len(rp) == 3 {
+			a.Protocol = rp[2]
+		}
+	default:
+		vp := strings.SplitN(value, "/", 2)
+		value = vp[0]
+		if len(vp) == 2 {
+			a.Protocol = vp[1]
+		}
+		if err := a.parseValue(value); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := a.Validate(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// NewRelayAddress returns the address of a peer reached through the given
+// relays, in order
+func NewRelayAddress(pid string, route ...string) *Address {
+	return &Address{
+		Scheme: "relay",
+		Route:  route,
+		Peer:   pid,
+	}
+}
+
+func (a *Address) parseValue(value string) error {
+	switch addressKind(a.Scheme) {
+	case addressKindHostPort:
+		host, port, err := splitHostPort(value)
+		if err != nil {
+			return err
+		}
+		if i := strings.LastIndex(host, "%"); i >= 0 {
+			host, a.Zone = host[:i], host[i+1:]
+		}
+		a.Host = host
+		a.Port = port
+	case addressKindPath:
+		path, err := url.PathUnescape(value)
+		if err != nil {
+			return ErrInvalidAddress
+		}
+		a.Host = path
+	default:
+		a.Host = value
+	}
+	return nil
+}
+
+// Validate checks that the address is valid for its scheme
+func (a *Address) Validate() error {
+	if a.Scheme == "" || strings.ContainsAny(a.Scheme, ":/") {
+		return ErrInvalidAddress
+	}
+
+	switch addressKind(a.Scheme) {
+	case addressKindHostPort:
+		if a.Port < 0 || a.Port > 65535 {
+			return ErrInvalidAddress
+		}
+		if strings.ContainsAny(a.Host, "/[]%") {
+			return ErrInvalidAddress
+		}
+		ip := a.IP()
+		// only IPv6 addresses have zones
+		if a.Zone != "" && (ip == nil || ip.To4() != nil || strings.ContainsAny(a.Zone, "/[]%")) {
+			return ErrInvalidAddress
+		}
+		if a.Scheme == "tcp4" && ip != nil && ip.To4() == nil {
+			return ErrInvalidAddress
+		}
+		if a.Scheme == "tcp6" && ip != nil && ip.To4() != nil {
+			return ErrInvalidAddress
+		}
+	case addressKindName:
+		if a.Host == "" || strings.Contains(a.Host, "/") {
+			return ErrInvalidAddress
+		}
+	case addressKindPath:
+		if a.Host == "" {
+			return ErrInvalidAddress
+		}
+	case addressKindRelay:
+		if len(a.Route) == 0 || !isValidPeerID(a.Peer) {
+			return ErrInvalidAddress
+		}
+		for _, rpid := range a.Route {
+			if !isValidPeerID(rpid) || strings.Contains(rpid, ",") {
+				return ErrInvalidAddress
+			}
+		}
+		if len(a.Route) > maxRelayHops {
+			return ErrRelayHopLimit
+		}
+	default:
+		if strings.Contains(a.Host, "/") {
+			return ErrInvalidAddress
+		}
+	}
+
+	return nil
+}
+
+// String encodes the address, parsing it again results in the same address
+func (a *Address) String() string {
+	s := a.Scheme + ":"
+	switch addressKind(a.Scheme) {
+	case addressKindHostPort:
+		s += a.HostPort()
+	case addressKindPath:
+		s += url.PathEscape(a.Host)
+	case addressKindRelay:
+		s += strings.Join(a.Route, ",") + "/" + a.Peer
+	default:
+		s += a.Host
+	}
+	if a.Protocol != "" {
+		s += "/" + a.Protocol
+	}
+	return s
+}
+
+// HostPort returns the host and port of the address joined for use with the
+// net package, ie. `[::1]:21600`
+func (a *Address) HostPort() string {
+	host := a.Host
+	if a.Zone != "" {
+		host += "%" + a.Zone
+	}
+	return net.JoinHostPort(host, strconv.Itoa(a.Port))
+}
+
+// IP returns the address' host as an IP, or nil if the host is not an IP
+func (a *Address) IP() net.IP {
+	if addressKind(a.Scheme) != addressKindHostPort {
+		return nil
+	}
+	return net.ParseIP(a.Host)
+}
+
+// IsRelay checks if the address goes through relays
+func (a *Address) IsRelay() bool {
+	return addressKind(a.Scheme) == addressKindRelay
+}
+
+// WithProtocol returns a copy of the address with the given stream protocol
+func (a *Address) WithProtocol(protocolID string) *Address {
+	c := a.copy()
+	c.Protocol = protocolID
+	return c
+}
+
+// Encapsulate returns a copy of a relay address that first goes through the
+// given relay, which will forward the circuit to the rest of the route
+func (a *Address) Encapsulate(rpid string) (*Address, error) {
+	if !a.IsRelay() {
+		return nil, ErrInvalidAddress
+	}
+	c := a.copy()
+	c.Route = append([]string{rpid}, a.Route...)
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (a *Address) copy() *Address {
+	c := *a
+	if a.Route != nil {
+		c.Route = make([]string, len(a.Route))
+		copy(c.Route, a.Route)
+	}
+	return &c
+}
+
+// Multiaddr returns the multiaddr equivalent of the address, ie.
+// `/ip4/1.2.3.4/tcp/21600` for `tcp4:1.2.3.4:21600`.
+// Stream protocols have no multiaddr equivalent and are left out.
+// Multiaddrs with host names are parsed as dns addresses, so tcp addresses
+// can only be converted if their host is an IP, and `tcp` ones are parsed
+// back as `tcp4` or `tcp6` depending on it.
+func (a *Address) Multiaddr() (string, error) {
+	switch a.Scheme {
+	case "tcp", "tcp4", "tcp6":
+		if a.IP() == nil {
+			return "", ErrNoMultiaddr
+		}
+		return a.multiaddrHost() + "/tcp/" + strconv.Itoa(a.Port), nil
+	case "dns", "dns4", "dns6":
+		return "/" + a.Scheme + "/" + a.Host + "/tcp/" + strconv.Itoa(a.Port), nil
+	case "ws", "wss":
+		return a.multiaddrHost() + "/tcp/" + strconv.Itoa(a.Port) + "/" + a.Scheme, nil
+	case "quic":
+		return a.multiaddrHost() + "/udp/" + strconv.Itoa(a.Port) + "/quic-v1", nil
+	case "unix":
+		// multiaddrs can only hold absolute paths
+		if !strings.HasPrefix(a.Host, "/") {
+			return "", ErrNoMultiaddr
+		}
+		return "/unix" + a.Host, nil
+	case "relay":
+		s := ""
+		for _, rpid := range a.Route {
+			s += "/p2p/" + rpid + "/p2p-circuit"
+		}
+		return s + "/p2p/" + a.Peer, nil
+	}
+	return "", ErrNoMultiaddr
+}
+
+func (a *Address) multiaddrHost() string {
+	ip := a.IP()
+	switch {
+	case ip == nil:
+		return "/dns/" + a.Host
+	case ip.To4() != nil:
+		return "/ip4/" + ip.String()
+	case a.Zone != "":
+		return "/ip6zone/" + a.Zone + "/ip6/" + a.Host
+	}
+	return "/ip6/" + a.Host
+}
+
+// ParseMultiaddr parses the multiaddrs Multiaddr returns
+func ParseMultiaddr(maddr string) (*Address, error) {
+	ps := strings.Split(maddr, "/")
+	if len(ps) < 3 || ps[0] != "" {
+		return nil, ErrInvalidAddress
+	}
+	ps = ps[1:]
+
+	a := &Address{}
+	if ps[0] == "ip6zone" {
+		if len(ps) < 3 || ps[2] != "ip6" {
+			return nil, ErrInvalidAddress
+		}
+		a.Zone = ps[1]
+		ps = ps[2:]
+	}
+
+	switch ps[0] {
+	case "unix":
+		a.Scheme = "unix"
+		a.Host = "/" + strings.Join(ps[1:], "/")
+	case "p2p":
+		a.Scheme = "relay"
+		for len(ps) >= 3 && ps[0] == "p2p" && ps[2] == "p2p-circuit" {
+			a.Route = append(a.Route, ps[1])
+			ps = ps[3:]
+		}
+		if len(ps) != 2 || ps[0] != "p2p" {
+			return nil, ErrInvalidAddress
+		}
+		a.Peer = ps[1]
+	case "ip4", "ip6", "dns", "dns4", "dns6":
+		if len(ps) < 4 {
+			return nil, ErrInvalidAddress
+		}
+		port, err := strconv.Atoi(ps[3])
+		if err != nil {
+			return nil, ErrInvalidAddress
+		}
+		a.Host = ps[1]
+		a.Port = port
+		switch strings.Join(append([]string{ps[2]}, ps[4:]...), "/") {
+		case "tcp":
+			a.Scheme = map[string]string{
+				"ip4":  "tcp4",
+				"ip6":  "tcp6",
+				"dns":  "dns",
+				"dns4": "dns4",
+				"dns6": "dns6",
+			}[ps[0]]
+		case "tcp/ws":
+			a.Scheme = "ws"
+		case "tcp/wss", "tcp/tls/ws":
+			a.Scheme = "wss"
+		case "udp/quic-v1":
+			a.Scheme = "quic"
+		default:
+			return nil, ErrInvalidAddress
+		}
+	default:
+		return nil, ErrInvalidAddress
+	}
+
+	if err := a.Validate(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+const (
+	addressKindOpaque = iota
+	addressKindHostPort
+	addressKindName
+	addressKindPath
+	addressKindRelay
+)
+
+// addressKind returns what the value of a scheme's addresses holds
+func addressKind(scheme string) int {
+	switch scheme {
+	case "tcp", "tcp4", "tcp6", "ws", "wss", "quic", "dns", "dns4", "dns6":
+		return addressKindHostPort
+	case "mem", "sim":
+		return addressKindName
+	case "unix":
+		return addressKindPath
+	case "relay":
+		return addressKindRelay
+	}
+	return addressKindOpaque
+}
+
+// splitHostPort splits `host:port` values, IPv6 hosts can be in brackets
+func splitHostPort(value string) (string, int, error) {
+	host, sport, err := net.SplitHostPort(value)
+	if err != nil {
+		// older addresses did not put IPv6 hosts in brackets
+		i := strings.LastIndex(value, ":")
+		if i < 0 || net.ParseIP(value[:i]) == nil {
+			return "", 0, ErrInvalidAddress
+		}
+		host, sport = value[:i], value[i+1:]
+	}
+	port, err := strconv.Atoi(sport)
+	if err != nil {
+		return "", 0, ErrInvalidAddress
+	}
+	return host, port, nil
+}
+
+// parsePeerAddress splits the addresses peers are dialed with, ie.
+// `<peer-id>/<protocol>`
+func parsePeerAddress(addr string) (string, string, error) {
+	ps := strings.SplitN(addr, "/", 2)
+	if len(ps) < 2 || ps[1] == "" {
+		return "", "", errors.New("Missing protocol")
+	}
+	if !isValidPeerID(ps[0]) {
+		return "", "", ErrInvalidAddress
+	}
+	return ps[0], ps[1], nil
+}
+
+func isValidPeerID(pid string) bool {
+	return pid != "" && !strings.Contains(pid, "/")
+}
@@ -0,0 +1,154 @@
+package net
+
+import (
+	"net"
+)
+
+// AddressClass describes from how far away an address can be reached.
+// Classes are bit flags so they can be combined in AddressPolicy.
+type AddressClass uint
+
+const (
+	// AddressClassUnspecified are addresses that can't be dialed, ie.
+	// `0.0.0.0`, `::` and multicast addresses
+	AddressClassUnspecified AddressClass = 1 << iota
+	// AddressClassLoopback are only reachable from the same host
+	AddressClassLoopback
+	// AddressClassLinkLocal are only reachable from the same link, ie.
+	// `169.254.0.0/16` and `fe80::/10`
+	AddressClassLinkLocal
+	// AddressClassPrivate are only reachable from the same private network,
+	// ie. `10.0.0.0/8`, `172.16.0.0/12`, `192.168.0.0/16` and `fc00::/7`
+	AddressClassPrivate
+	// AddressClassCGNAT are shared by the customers of an ISP behind a
+	// carrier-grade NAT, `100.64.0.0/10`
+	AddressClassCGNAT
+	// AddressClassPublic are reachable from the internet
+	AddressClassPublic
+	// AddressClassRelay go through relays
+	AddressClassRelay
+	// AddressClassOther are addresses without an IP, ie. host names and the
+	// addresses of memory, simulated and unix socket transports
+	AddressClassOther
+
+	// AddressClassAll matches every class
+	AddressClassAll AddressClass = 1<<iota - 1
+)
+
+var (
+	// cgnatNetwork is the shared address space of RFC 6598
+	cgnatNetwork = &net.IPNet{
+		IP:   net.IPv4(100, 64, 0, 0),
+		Mask: net.CIDRMask(10, 32),
+	}
+
+	// DefaultAddressPolicy advertises and dials all addresses that can be
+	// dialed, but only accepts addresses from other peers that can be
+	// reached from outside their network, as the rest would point at hosts
+	// on our own network, or at our own host
+	DefaultAddressPolicy = AddressPolicy{
+		Advertise: AddressClassAll &^ AddressClassUnspecified,
+		Accept: AddressClassAll &^ (AddressClassUnspecified |
+			AddressClassLoopback |
+			AddressClassLinkLocal |
+			AddressClassPrivate |
+			AddressClassCGNAT),
+		Dial: AddressClassAll &^ AddressClassUnspecified,
+	}
+
+	// PrivateNetworkAddressPolicy is used by networks whose peers share a
+	// private network, see WithPrivateNetwork. It also accepts link-local,
+	// private and CGNAT addresses from other peers, but still not loopback
+	// ones.
+	PrivateNetworkAddressPolicy = AddressPolicy{
+		Advertise: AddressClassAll &^ AddressClassUnspecified,
+		Accept:    AddressClassAll &^ (AddressClassUnspecified | AddressClassLoopback),
+		Dial:      AddressClassAll &^ AddressClassUnspecified,
+	}
+)
+
+// String -
+func (c AddressClass) String() string {
+	switch c {
+	case AddressClassUnspecified:
+		return "unspecified"
+	case AddressClassLoopback:
+		return "loopback"
+	case AddressClassLinkLocal:
+		return "link-local"
+	case AddressClassPrivate:
+		return "private"
+	case AddressClassCGNAT:
+		return "cgnat"
+	case AddressClassPublic:
+		return "public"
+	case AddressClassRelay:
+		return "relay"
+	case AddressClassOther:
+		return "other"
+	}
+	return "unknown"
+}
+
+// Has checks if the class is one of the given classes
+func (c AddressClass) Has(classes AddressClass) bool {
+	return c&classes != 0
+}
+
+// ClassifyAddress returns the class of an address
+func ClassifyAddress(addr string) AddressClass {
+	a, err := ParseAddress(addr)
+	if err != nil {
+		return AddressClassUnspecified
+	}
+
+	if a.IsRelay() {
+		return AddressClassRelay
+	}
+
+	ip := a.IP()
+	if ip == nil {
+		return AddressClassOther
+	}
+
+	return classifyIP(ip)
+}
+
+func classifyIP(ip net.IP) AddressClass {
+	switch {
+	case ip.IsUnspecified() || ip.IsMulticast():
+		return AddressClassUnspecified
+	case ip.IsLoopback():
+		return AddressClassLoopback
+	case ip.IsLinkLocalUnicast():
+		return AddressClassLinkLocal
+	case ip.IsPrivate():
+		return AddressClassPrivate
+	case cgnatNetwork.Contains(ip):
+		return AddressClassCGNAT
+	}
+	return AddressClassPublic
+}
+
+// AddressPolicy decides which classes of addresses are used for what
+type AddressPolicy struct {
+	// Advertise are the classes of local addresses other peers are told
+	// about, we still listen on the rest
+	Advertise AddressClass
+	// Accept are the classes of addresses that are stored when other peers
+	// tell us about their addresses
+	Accept AddressClass
+	// Dial are the classes of addresses we will dial
+	Dial AddressClass
+}
+
+// filterAddresses returns the addresses that belong to the given classes
+func filterAddresses(addrs []string, classes AddressClass) []string {
+	faddrs := []string{}
+	for _, addr := range addrs {
+		if ClassifyAddress(addr).Has(classes) {
+			faddrs = append(faddrs, addr)
+		}
+	}
+	return faddrs
+}
@@ -0,0 +1,124 @@
+package net
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClassifyAddress(t *testing.T) {
+	for addr, expected := range map[string]AddressClass{
+		"tcp4:0.0.0.0:21600":           AddressClassUnspecified,
+		"tcp6:[::]:21600":              AddressClassUnspecified,
+		"tcp4:224.0.0.1:21600":         AddressClassUnspecified,
+		"tcp4:127.0.0.1:21600":         AddressClassLoopback,
+		"tcp6:[::1]:21600":             AddressClassLoopback,
+		"tcp4:169.254.1.1:21600":       AddressClassLinkLocal,
+		"tcp6:[fe80::1%eth0]:21600":    AddressClassLinkLocal,
+		"tcp4:10.0.0.1:21600":          AddressClassPrivate,
+		"tcp4:172.16.0.1:21600":        AddressClassPrivate,
+		"tcp4:172.31.255.255:21600":    AddressClassPrivate,
+		"tcp4:192.168.1.1:21600":       AddressClassPrivate,
+		"tcp6:[fd00::1]:21600":         AddressClassPrivate,
+		"tcp4:100.64.0.1:21600":        AddressClassCGNAT,
+		"tcp4:100.127.255.255:21600":   AddressClassCGNAT,
+		"tcp4:100.128.0.1:21600":       AddressClassPublic,
+		"tcp4:172.32.0.1:21600":        AddressClassPublic,
+		"tcp4:1.2.3.4:21600":           AddressClassPublic,
+		"tcp6:[2001:db8::1]:21600":     AddressClassPublic,
+		"quic:1.2.3.4:21600":           AddressClassPublic,
+		"ws:10.0.0.1:80":               AddressClassPrivate,
+		"relay:r1/target":              AddressClassRelay,
+		"dns4:example.com:21600":       AddressClassOther,
+		"mem:n1":                       AddressClassOther,
+		"unix:%2Ftmp%2Fpeer.sock":      AddressClassOther,
+		"not an address":               AddressClassUnspecified,
+		"tcp4:1.2.3.4:not-a-port":      AddressClassUnspecified,
+		"tcp6:[::ffff:10.0.0.1]:21600": AddressClassUnspecified,
+	} {
+		if class := ClassifyAddress(addr); class != expected {
+			t.Fatalf("Expected %s to be %s, got %s", addr, expected, class)
+		}
+	}
+}
+
+func TestAddressPolicyAccept(t *testing.T) {
+	addrs := []string{
+		"tcp4:127.0.0.1:21600",
+		"tcp4:169.254.1.1:21600",
+		"tcp4:10.0.0.1:21600",
+		"tcp4:100.64.0.1:21600",
+		"tcp4:1.2.3.4:21600",
+		"relay:r1/target",
+		"mem:n1",
+	}
+
+	for name, c := range map[string]struct {
+		opts     []Option
+		expected []string
+	}{
+		"default": {
+			expected: []string{
+				"tcp4:1.2.3.4:21600",
+				"relay:r1/target",
+				"mem:n1",
+			},
+		},
+		"private network": {
+			opts: []Option{WithPrivateNetwork(true)},
+			expected: []string{
+				"tcp4:169.254.1.1:21600",
+				"tcp4:10.0.0.1:21600",
+				"tcp4:100.64.0.1:21600",
+				"tcp4:1.2.3.4:21600",
+				"relay:r1/target",
+				"mem:n1",
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			opts := append([]Option{WithPortMapperDiscovery(false)}, c.opts...)
+			n, err := NewNetwork(&Peer{
+				ID:        "policy-accept",
+				Addresses: []string{"mem:policy-accept"},
+			}, 0, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer n.Close()
+
+			if err := n.PutPeer(Peer{ID: "other", Addresses: addrs}); err != nil {
+				t.Fatal(err)
+			}
+			peer, err := n.GetPeer("other")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(peer.Addresses, c.expected) {
+				t.Fatalf("Expected %v to be accepted, got %v", c.expected, peer.Addresses)
+			}
+		})
+	}
+}
+
+func TestAddressPolicyAdvertise(t *testing.T) {
+	n := newTestNetwork(t, &Peer{
+		ID:        "policy-advertise",
+		Addresses: []string{"mem:policy-advertise"},
+	})
+
+	n.SetAddressPolicy(AddressPolicy{
+		Advertise: AddressClassPublic | AddressClassRelay,
+		Accept:    AddressClassAll,
+		Dial:      AddressClassAll,
+	})
+	n.setLocalAddresses([]string{
+		"tcp4:10.0.0.1:21600",
+		"tcp4:1.2.3.4:21600",
+		"mem:policy-advertise",
+	})
+
+	// we still listen on the rest, but don't tell others about them
+	if addrs := n.GetLocalPeer().Addresses; !reflect.DeepEqual(addrs, []string{"tcp4:1.2.3.4:21600"}) {
+		t.Fatalf("Expected only the public address to be advertised, got %v", addrs)
+	}
+}
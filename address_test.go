@@ -0,0 +1,248 @@
+package net
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAddress(t *testing.T) {
+	for addr, expected := range map[string]*Address{
+		"tcp4:1.2.3.4:21600": {
+			Scheme: "tcp4",
+			Host:   "1.2.3.4",
+			Port:   21600,
+		},
+		"tcp6:[::1]:21600/proto": {
+			Scheme:   "tcp6",
+			Host:     "::1",
+			Port:     21600,
+			Protocol: "proto",
+		},
+		"tcp6:[fe80::1%eth0]:21600": {
+			Scheme: "tcp6",
+			Host:   "fe80::1",
+			Zone:   "eth0",
+			Port:   21600,
+		},
+		"dns4:example.com:443/proto/v1": {
+			Scheme:   "dns4",
+			Host:     "example.com",
+			Port:     443,
+			Protocol: "proto/v1",
+		},
+		"mem:n1/proto": {
+			Scheme:   "mem",
+			Host:     "n1",
+			Protocol: "proto",
+		},
+		"unix:%2Ftmp%2Fpeer.sock/proto": {
+			Scheme:   "unix",
+			Host:     "/tmp/peer.sock",
+			Protocol: "proto",
+		},
+		"relay:r1,r2/target/proto": {
+			Scheme:   "relay",
+			Route:    []string{"r1", "r2"},
+			Peer:     "target",
+			Protocol: "proto",
+		},
+		"custom:anything-goes": {
+			Scheme: "custom",
+			Host:   "anything-goes",
+		},
+	} {
+		a, err := ParseAddress(addr)
+		if err != nil {
+			t.Fatalf("Could not parse %s: %v", addr, err)
+		}
+		if !reflect.DeepEqual(a, expected) {
+			t.Fatalf("Expected %s to parse as %+v, got %+v", addr, expected, a)
+		}
+		if s := a.String(); s != addr {
+			t.Fatalf("Expected %s to encode back, got %s", addr, s)
+		}
+	}
+
+	// older addresses did not put IPv6 hosts in brackets
+	a, err := ParseAddress("tcp6:2001:db8::1:21600")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := a.String(); s != "tcp6:[2001:db8::1]:21600" {
+		t.Fatalf("Expected tcp6:[2001:db8::1]:21600, got %s", s)
+	}
+}
+
+func TestParseAddressInvalid(t *testing.T) {
+	for _, addr := range []string{
+		"",
+		"tcp4",
+		":1.2.3.4:21600",
+		"tcp4:1.2.3.4",
+		"tcp4:1.2.3.4:port",
+		"tcp4:1.2.3.4:70000",
+		"tcp4:[::1]:21600",
+		"tcp6:1.2.3.4:21600",
+		"tcp4:1.2.3.4%eth0:21600",
+		"mem:",
+		"unix:",
+		"relay:target",
+		"relay:/target",
+		"relay:r1/",
+		"relay:r1,,r2/target",
+		"relay:r1,r2,r3,r4,r5/target",
+	} {
+		if _, err := ParseAddress(addr); err == nil {
+			t.Fatalf("Expected %q to be invalid", addr)
+		}
+	}
+}
+
+func TestAddressValidate(t *testing.T) {
+	for _, a := range []*Address{
+		{Scheme: "", Host: "n1"},
+		{Scheme: "me:m", Host: "n1"},
+		{Scheme: "tcp4", Host: "1.2.3.4", Port: -1},
+		{Scheme: "tcp4", Host: "1.2.3.4/x", Port: 1},
+		{Scheme: "tcp6", Host: "::1", Zone: "eth/0", Port: 1},
+		{Scheme: "mem", Host: "n1/n2"},
+		{Scheme: "relay", Route: []string{"r1,r2"}, Peer: "target"},
+		{Scheme: "relay", Route: []string{"r1"}, Peer: "a/b"},
+		{Scheme: "custom", Host: "a/b"},
+	} {
+		if err := a.Validate(); err == nil {
+			t.Fatalf("Expected %+v to be invalid", a)
+		}
+	}
+}
+
+func TestAddressHostPort(t *testing.T) {
+	for addr, expected := range map[string]string{
+		"tcp4:1.2.3.4:21600":        "1.2.3.4:21600",
+		"tcp6:[::1]:21600":          "[::1]:21600",
+		"tcp6:[fe80::1%eth0]:21600": "[fe80::1%eth0]:21600",
+		"tcp6:2001:db8::1:21600":    "[2001:db8::1]:21600",
+		"dns:example.com:80":        "example.com:80",
+	} {
+		a, err := ParseAddress(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hp := a.HostPort(); hp != expected {
+			t.Fatalf("Expected %s for %s, got %s", expected, addr, hp)
+		}
+	}
+}
+
+func TestAddressEncapsulate(t *testing.T) {
+	a := NewRelayAddress("target", "r2").WithProtocol("proto")
+
+	e, err := a.Encapsulate("r1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := e.String(); s != "relay:r1,r2/target/proto" {
+		t.Fatalf("Expected relay:r1,r2/target/proto, got %s", s)
+	}
+	// the original is left as it was
+	if s := a.String(); s != "relay:r2/target/proto" {
+		t.Fatalf("Expected relay:r2/target/proto, got %s", s)
+	}
+
+	for _, rpid := range []string{"r3", "r4", "r5"} {
+		if e, err = e.Encapsulate(rpid); err != nil {
+			break
+		}
+	}
+	if err != ErrRelayHopLimit {
+		t.Fatalf("Expected ErrRelayHopLimit, got %v", err)
+	}
+
+	tcp, _ := ParseAddress("tcp4:1.2.3.4:21600")
+	if _, err := tcp.Encapsulate("r1"); err != ErrInvalidAddress {
+		t.Fatalf("Expected ErrInvalidAddress, got %v", err)
+	}
+}
+
+func TestAddressMultiaddr(t *testing.T) {
+	for addr, expected := range map[string]string{
+		"tcp4:1.2.3.4:21600":        "/ip4/1.2.3.4/tcp/21600",
+		"tcp6:[::1]:21600":          "/ip6/::1/tcp/21600",
+		"tcp6:[fe80::1%eth0]:21600": "/ip6zone/eth0/ip6/fe80::1/tcp/21600",
+		"dns:example.com:80":        "/dns/example.com/tcp/80",
+		"dns4:example.com:80":       "/dns4/example.com/tcp/80",
+		"dns6:example.com:80":       "/dns6/example.com/tcp/80",
+		"ws:1.2.3.4:80":             "/ip4/1.2.3.4/tcp/80/ws",
+		"wss:example.com:443":       "/dns/example.com/tcp/443/wss",
+		"quic:[::1]:21600":          "/ip6/::1/udp/21600/quic-v1",
+		"unix:%2Ftmp%2Fpeer.sock":   "/unix/tmp/peer.sock",
+		"relay:r1/target":           "/p2p/r1/p2p-circuit/p2p/target",
+		"relay:r1,r2/target":        "/p2p/r1/p2p-circuit/p2p/r2/p2p-circuit/p2p/target",
+	} {
+		a, err := ParseAddress(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		maddr, err := a.Multiaddr()
+		if err != nil {
+			t.Fatalf("Could not convert %s: %v", addr, err)
+		}
+		if maddr != expected {
+			t.Fatalf("Expected %s for %s, got %s", expected, addr, maddr)
+		}
+
+		// and back again
+		b, err := ParseMultiaddr(maddr)
+		if err != nil {
+			t.Fatalf("Could not parse %s: %v", maddr, err)
+		}
+		if s := b.String(); s != addr {
+			t.Fatalf("Expected %s to parse back as %s, got %s", maddr, addr, s)
+		}
+	}
+
+	// tcp addresses come back with the family of their host
+	a, _ := ParseAddress("tcp:1.2.3.4:21600")
+	maddr, err := a.Multiaddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ParseMultiaddr(maddr); err != nil || b.String() != "tcp4:1.2.3.4:21600" {
+		t.Fatalf("Expected tcp4:1.2.3.4:21600, got %v %v", b, err)
+	}
+
+	for _, addr := range []string{
+		// multiaddrs with host names are parsed as dns addresses
+		"tcp:example.com:80",
+		"tcp4:example.com:80",
+		"mem:n1",
+		"unix:peer.sock",
+		"custom:anything-goes",
+	} {
+		a, err := ParseAddress(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := a.Multiaddr(); err != ErrNoMultiaddr {
+			t.Fatalf("Expected ErrNoMultiaddr for %s, got %v", addr, err)
+		}
+	}
+}
+
+func TestParseMultiaddrInvalid(t *testing.T) {
+	for _, maddr := range []string{
+		"",
+		"ip4/1.2.3.4/tcp/21600",
+		"/ip4/1.2.3.4",
+		"/ip4/1.2.3.4/tcp/port",
+		"/ip4/1.2.3.4/udp/21600",
+		"/ip4/::1/tcp/21600",
+		"/ip6zone/eth0/ip4/1.2.3.4/tcp/21600",
+		"/p2p/r1/p2p-circuit",
+		"/sctp/1",
+	} {
+		if _, err := ParseMultiaddr(maddr); err == nil {
+			t.Fatalf("Expected %q to be invalid", maddr)
+		}
+	}
+}
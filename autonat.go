@@ -0,0 +1,506 @@
+package net
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"time"
+
+	ms "github.com/multiformats/go-multistream"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// AutoNATProtocolID is the stream protocol peers use to ask others to
+	// dial them back
+	AutoNATProtocolID = "/autonat/v1"
+	// autoNATDialBackProtocolID is selected on the connections that are
+	// dialed back
+	autoNATDialBackProtocolID = "/autonat/dialback/v1"
+
+	// autoNATInterval is how often reachability is checked once known
+	autoNATInterval = 15 * time.Minute
+	// autoNATRetryInterval is how often reachability is checked while it
+	// is still unknown
+	autoNATRetryInterval = time.Minute
+	// autoNATMaxServers is how many peers are asked to dial us back
+	autoNATMaxServers = 3
+	// autoNATMaxAddresses is how many addresses a peer can ask to be dialed on
+	autoNATMaxAddresses = 8
+	// autoNATMaxRequests is how many requests are served at the same time
+	autoNATMaxRequests = 16
+	// autoNATDialTimeout is how long dialing back an address can take
+	autoNATDialTimeout = 10 * time.Second
+)
+
+var (
+	// ErrAutoNATBusy is returned when a peer is serving too many requests
+	ErrAutoNATBusy = errors.New("Too many dial back requests")
+	// ErrAutoNATNoAddresses is returned when a request has no addresses we
+	// are willing to dial
+	ErrAutoNATNoAddresses = errors.New("No addresses to dial back")
+)
+
+// Reachability is whether the local peer can be dialed from the internet
+type Reachability int
+
+const (
+	// ReachabilityUnknown means no peer has been able to tell yet
+	ReachabilityUnknown Reachability = iota
+	// ReachabilityPublic means peers could dial us back
+	ReachabilityPublic
+	// ReachabilityPrivate means peers could not dial us back
+	ReachabilityPrivate
+)
+
+// String -
+func (r Reachability) String() string {
+	switch r {
+	case ReachabilityPublic:
+		return "public"
+	case ReachabilityPrivate:
+		return "private"
+	}
+	return "unknown"
+}
+
+type autoNATRequest struct {
+	Nonce     string   `json:"nonce"`
+	Addresses []string `json:"addresses"`
+}
+
+type autoNATResponse struct {
+	Addresses []string `json:"addresses,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// autoNATDialBack is sent on the connections that are dialed back and echoed
+// by the peer that received them
+type autoNATDialBack struct {
+	Nonce   string `json:"nonce"`
+	Address string `json:"address"`
+}
+
+// autoNAT finds out whether the local peer is reachable.
+//
+// Every so often a few peers that support the protocol are asked to dial us
+// back on our public addresses. Each request carries a random nonce which
+// the peers send back over the connections they dial, so an address is only
+// considered reachable once we have received its nonce ourselves.
+// We are public if more of the peers could reach us than not, and private if
+// more of them could not. Peers that could not be asked don't count.
+type autoNAT struct {
+	mutex     sync.Mutex
+	net       *network
+	status    Reachability
+	reachable []string
+	nonces    map[string]map[string]bool // addresses dialed back, by nonce
+	handlers  []func(Reachability) error
+	requests  int
+	update    chan struct{}
+}
+
+func newAutoNAT(n *network) *autoNAT {
+	return &autoNAT{
+		net:    n,
+		nonces: map[string]map[string]bool{},
+		update: make(chan struct{}, 1),
+	}
+}
+
+// Start checks reachability periodically, and whenever new peers show up
+// while it is still unknown
+func (a *autoNAT) Start() {
+	a.net.RegisterPeerHandler(func(Peer) error {
+		if a.Status() == ReachabilityUnknown {
+			a.trigger()
+		}
+		return nil
+	})
+
+	go func() {
+		for {
+			a.probe()
+			interval := autoNATInterval
+			if a.Status() == ReachabilityUnknown {
+				interval = autoNATRetryInterval
+			}
+			select {
+			case <-time.After(interval):
+			case <-a.update:
+			case <-a.net.done:
+				return
+			}
+		}
+	}()
+}
+
+func (a *autoNAT) trigger() {
+	select {
+	case a.update <- struct{}{}:
+	default:
+	}
+}
+
+// Status returns the local peer's reachability
+func (a *autoNAT) Status() Reachability {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.status
+}
+
+// RegisterHandler adds a handler that is called whenever reachability changes
+func (a *autoNAT) RegisterHandler(handler func(Reachability) error) {
+	a.mutex.Lock()
+	a.handlers = append(a.handlers, handler)
+	a.mutex.Unlock()
+}
+
+func (a *autoNAT) probe() {
+	// only the public addresses we advertise are worth checking
+	policy := a.net.getAddressPolicy()
+	addrs := filterAddresses(a.net.getLocalAddresses(), policy.Advertise&AddressClassPublic)
+	if len(addrs) == 0 {
+		// nobody will dial back addresses that are not public
+		a.setStatus(ReachabilityPrivate, nil)
+		return
+	}
+	if len(addrs) > autoNATMaxAddresses {
+		addrs = addrs[:autoNATMaxAddresses]
+	}
+
+	servers := a.servers(a.net.localPeerID())
+	if len(servers) == 0 {
+		return
+	}
+
+	type result struct {
+		reachable []string
+		err       error
+	}
+
+	results := make(chan result, len(servers))
+	for _, pid := range servers {
+		go func(pid string) {
+			reachable, err := a.ask(pid, addrs)
+			if err != nil {
+				logrus.
+					WithError(err).
+					WithField("pid", pid).
+					Debugf("Could not ask peer to dial us back")
+			}
+			results <- result{reachable, err}
+		}(pid)
+	}
+
+	successes, failures := 0, 0
+	reachable := map[string]bool{}
+	for range servers {
+		r := <-results
+		switch {
+		case r.err != nil:
+		case len(r.reachable) > 0:
+			successes++
+			for _, addr := range r.reachable {
+				reachable[addr] = true
+			}
+		default:
+			failures++
+		}
+	}
+
+	raddrs := []string{}
+	for _, addr := range addrs {
+		if reachable[addr] {
+			raddrs = append(raddrs, addr)
+		}
+	}
+
+	switch {
+	case successes > failures:
+		a.setStatus(ReachabilityPublic, raddrs)
+	case failures > successes:
+		a.setStatus(ReachabilityPrivate, nil)
+	}
+}
+
+// servers returns a few random peers that can dial us back
+func (a *autoNAT) servers(lpid string) []string {
+	pids := []string{}
+	for _, peer := range a.net.peerstore.PeersWithProtocol(AutoNATProtocolID) {
+		if peer.ID == lpid {
+			continue
+		}
+		pids = append(pids, peer.ID)
+	}
+	mrand.Shuffle(len(pids), func(i, j int) {
+		pids[i], pids[j] = pids[j], pids[i]
+	})
+	if len(pids) > autoNATMaxServers {
+		pids = pids[:autoNATMaxServers]
+	}
+	return pids
+}
+
+// ask asks a peer to dial us back and returns the addresses we were reached on
+func (a *autoNAT) ask(pid string, addrs []string) ([]string, error) {
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	a.mutex.Lock()
+	a.nonces[nonce] = map[string]bool{}
+	a.mutex.Unlock()
+
+	defer func() {
+		a.mutex.Lock()
+		delete(a.nonces, nonce)
+		a.mutex.Unlock()
+	}()
+
+	rwc, err := a.net.Dial(pid + "/" + AutoNATProtocolID)
+	if err != nil {
+		return nil, err
+	}
+	defer rwc.Close()
+
+	req := &autoNATRequest{
+		Nonce:     nonce,
+		Addresses: addrs,
+	}
+	if err := writeMessage(rwc, req); err != nil {
+		return nil, err
+	}
+
+	res := &autoNATResponse{}
+	if err := readMessage(rwc, res); err != nil {
+		return nil, err
+	}
+
+	if res.Error != "" {
+		return nil, errors.New(res.Error)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	// only trust the addresses we actually got the nonce on
+	reachable := []string{}
+	for _, addr := range res.Addresses {
+		if a.nonces[nonce][addr] {
+			reachable = append(reachable, addr)
+		}
+	}
+
+	return reachable, nil
+}
+
+func (a *autoNAT) setStatus(status Reachability, reachable []string) {
+	a.mutex.Lock()
+	changed := a.status != status
+	a.status = status
+	a.reachable = reachable
+	handlers := make([]func(Reachability) error, len(a.handlers))
+	copy(handlers, a.handlers)
+	a.mutex.Unlock()
+
+	if !changed {
+		return
+	}
+
+	logrus.
+		WithField("reachability", status.String()).
+		WithField("addrs", reachable).
+		Infof("Reachability changed")
+
+	for _, handler := range handlers {
+		handler(status)
+	}
+}
+
+// handleStream dials back the addresses another peer asked us to
+func (a *autoNAT) handleStream(protocolID string, rwc io.ReadWriteCloser) error {
+	defer rwc.Close()
+
+	req := &autoNATRequest{}
+	if err := readMessage(rwc, req); err != nil {
+		return err
+	}
+
+	if !a.acquire() {
+		return writeMessage(rwc, &autoNATResponse{Error: ErrAutoNATBusy.Error()})
+	}
+	defer a.release()
+
+	// only public addresses of the host the request came from are dialed,
+	// so we can't be used to probe the private networks we are on or to
+	// flood others with connections
+	addrs := filterAddresses(req.Addresses, AddressClassPublic)
+	addrs = filterAddressesByIP(addrs, remoteIP(rwc))
+	if len(addrs) > autoNATMaxAddresses {
+		addrs = addrs[:autoNATMaxAddresses]
+	}
+	if req.Nonce == "" || len(addrs) == 0 {
+		return writeMessage(rwc, &autoNATResponse{Error: ErrAutoNATNoAddresses.Error()})
+	}
+
+	results := make(chan string, len(addrs))
+	for _, addr := range addrs {
+		go func(addr string) {
+			if err := a.dialBack(addr, req.Nonce); err != nil {
+				logrus.
+					WithError(err).
+					WithField("addr", addr).
+					Debugf("Could not dial back address")
+				results <- ""
+				return
+			}
+			results <- addr
+		}(addr)
+	}
+
+	reachable := []string{}
+	for range addrs {
+		if addr := <-results; addr != "" {
+			reachable = append(reachable, addr)
+		}
+	}
+
+	return writeMessage(rwc, &autoNATResponse{Addresses: reachable})
+}
+
+// dialBack opens a new connection to the address and sends the nonce over it
+func (a *autoNAT) dialBack(addr, nonce string) error {
+	tr, err := a.net.getTransport(addr)
+	if err != nil {
+		return err
+	}
+
+	// sessions and relayed streams would not tell us if the address itself
+	// can be dialed
+	switch tr.(type) {
+	case sessionTransport, streamTransport:
+		return ErrTransportNotSupported
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), autoNATDialTimeout)
+	defer cancel()
+
+	c, err := tr.DialContext(ctx, addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(autoNATDialTimeout))
+
+	if err := ms.SelectProtoOrFail(autoNATDialBackProtocolID, c); err != nil {
+		return err
+	}
+
+	msg := &autoNATDialBack{
+		Nonce:   nonce,
+		Address: addr,
+	}
+	if err := writeMessage(c, msg); err != nil {
+		return err
+	}
+
+	ack := &autoNATDialBack{}
+	if err := readMessage(c, ack); err != nil {
+		return err
+	}
+
+	if ack.Nonce != nonce {
+		return errors.New("Dial back was not acknowledged")
+	}
+
+	return nil
+}
+
+// handleDialBack receives the connections peers dial back
+func (a *autoNAT) handleDialBack(protocolID string, rwc io.ReadWriteCloser) error {
+	defer rwc.Close()
+
+	msg := &autoNATDialBack{}
+	if err := readMessage(rwc, msg); err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	addrs, ok := a.nonces[msg.Nonce]
+	if ok {
+		addrs[msg.Address] = true
+	}
+	a.mutex.Unlock()
+
+	if !ok {
+		return errors.New("Unexpected dial back")
+	}
+
+	return writeMessage(rwc, msg)
+}
+
+func (a *autoNAT) acquire() bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.requests >= autoNATMaxRequests {
+		return false
+	}
+	a.requests++
+	return true
+}
+
+func (a *autoNAT) release() {
+	a.mutex.Lock()
+	a.requests--
+	a.mutex.Unlock()
+}
+
+// remoteIP returns the ip of the other end of a stream, relayed streams
+// don't have one
+func remoteIP(rwc io.ReadWriteCloser) net.IP {
+	c, ok := rwc.(net.Conn)
+	if !ok {
+		return nil
+	}
+	switch addr := c.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// filterAddressesByIP returns the addresses whose host is the given ip
+func filterAddressesByIP(addrs []string, ip net.IP) []string {
+	filtered := []string{}
+	if ip == nil {
+		return filtered
+	}
+	for _, addr := range addrs {
+		a, err := ParseAddress(addr)
+		if err != nil {
+			continue
+		}
+		if aip := a.IP(); aip != nil && aip.Equal(ip) {
+			filtered = append(filtered, addr)
+		}
+	}
+	return filtered
+}
+
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,278 @@
+package net
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	ms "github.com/multiformats/go-multistream"
+)
+
+// remoteAddrConn reports a remote address of our choosing
+type remoteAddrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *remoteAddrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// newAutoNATServer returns a peer that answers our dial back requests. If
+// it can reach us, it dials us back on our memory address as if it was the
+// address we asked for. Liars claim to have reached us without trying.
+func newAutoNATServer(t *testing.T, id string, n *network, reachable, liar bool) {
+	s := newTestNetwork(t, &Peer{
+		ID:        id,
+		Addresses: []string{"mem:" + id},
+	})
+	s.RegisterStreamHandler(AutoNATProtocolID, func(protocolID string, rwc io.ReadWriteCloser) error {
+		defer rwc.Close()
+		req := &autoNATRequest{}
+		if err := readMessage(rwc, req); err != nil {
+			return err
+		}
+		res := &autoNATResponse{}
+		if liar {
+			res.Addresses = req.Addresses
+		}
+		if reachable {
+			tr, err := s.getTransport("mem:" + n.GetLocalPeer().ID)
+			if err != nil {
+				return err
+			}
+			c, err := tr.Dial("mem:" + n.GetLocalPeer().ID)
+			if err != nil {
+				return err
+			}
+			defer c.Close()
+			if err := ms.SelectProtoOrFail(autoNATDialBackProtocolID, c); err != nil {
+				return err
+			}
+			msg := &autoNATDialBack{
+				Nonce:   req.Nonce,
+				Address: req.Addresses[0],
+			}
+			if err := writeMessage(c, msg); err != nil {
+				return err
+			}
+			if err := readMessage(c, msg); err != nil {
+				return err
+			}
+			res.Addresses = req.Addresses[:1]
+		}
+		return writeMessage(rwc, res)
+	})
+	err := n.PutPeer(Peer{
+		ID:        id,
+		Addresses: []string{"mem:" + id},
+		Protocols: []string{AutoNATProtocolID},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitReachability(t *testing.T, n *network, expected Reachability) {
+	deadline := time.Now().Add(5 * time.Second)
+	for n.Reachability() != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s, got %s", expected, n.Reachability())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAutoNATStatus(t *testing.T) {
+	for name, c := range map[string]struct {
+		reachable int
+		liars     int
+		expected  Reachability
+	}{
+		"public": {
+			reachable: 2,
+			expected:  ReachabilityPublic,
+		},
+		"private": {
+			reachable: 1,
+			expected:  ReachabilityPrivate,
+		},
+		// peers that claim to have reached us without us getting the
+		// nonce are not trusted
+		"liars": {
+			reachable: 1,
+			liars:     2,
+			expected:  ReachabilityPrivate,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			prefix := "autonat-" + name
+			n := newTestNetwork(t, &Peer{
+				ID:        prefix,
+				Addresses: []string{"mem:" + prefix},
+			})
+			// the first probe finds no public addresses, once it is done
+			// no more probes start on their own for a while
+			waitReachability(t, n, ReachabilityPrivate)
+
+			public := "tcp4:1.2.3.4:21600"
+			n.setLocalAddresses([]string{"mem:" + prefix, public})
+
+			for i := 0; i < autoNATMaxServers; i++ {
+				id := prefix + "-s" + string(rune('0'+i))
+				newAutoNATServer(t, id, n, i < c.reachable, i >= autoNATMaxServers-c.liars)
+			}
+
+			n.autoNAT.probe()
+
+			if status := n.Reachability(); status != c.expected {
+				t.Fatalf("Expected %s, got %s", c.expected, status)
+			}
+			n.autoNAT.mutex.Lock()
+			reachable := n.autoNAT.reachable
+			n.autoNAT.mutex.Unlock()
+			if c.expected == ReachabilityPublic && !reflect.DeepEqual(reachable, []string{public}) {
+				t.Fatalf("Expected %s to be reachable, got %v", public, reachable)
+			}
+		})
+	}
+}
+
+func TestAutoNATNoPublicAddresses(t *testing.T) {
+	n := newTestNetwork(t, &Peer{
+		ID:        "autonat-no-public",
+		Addresses: []string{"mem:autonat-no-public"},
+	})
+
+	// nobody would dial back addresses that are not public
+	waitReachability(t, n, ReachabilityPrivate)
+
+	changes := make(chan Reachability, 10)
+	n.RegisterReachabilityHandler(func(r Reachability) error {
+		changes <- r
+		return nil
+	})
+
+	// handlers are only called when reachability changes
+	n.autoNAT.setStatus(ReachabilityPublic, nil)
+	n.autoNAT.setStatus(ReachabilityPublic, nil)
+	n.autoNAT.probe()
+	n.autoNAT.probe()
+
+	close(changes)
+	received := []Reachability{}
+	for r := range changes {
+		received = append(received, r)
+	}
+	expected := []Reachability{ReachabilityPublic, ReachabilityPrivate}
+	if !reflect.DeepEqual(received, expected) {
+		t.Fatalf("Expected %v, got %v", expected, received)
+	}
+}
+
+func TestAutoNATUnexpectedNonce(t *testing.T) {
+	n := newTestNetwork(t, &Peer{
+		ID:        "autonat-nonce",
+		Addresses: []string{"mem:autonat-nonce"},
+	})
+
+	n.autoNAT.mutex.Lock()
+	n.autoNAT.nonces["expected"] = map[string]bool{}
+	n.autoNAT.mutex.Unlock()
+
+	lc, rc := net.Pipe()
+	defer rc.Close()
+	go writeMessage(rc, &autoNATDialBack{
+		Nonce:   "unexpected",
+		Address: "tcp4:1.2.3.4:21600",
+	})
+
+	if err := n.autoNAT.handleDialBack(autoNATDialBackProtocolID, lc); err == nil {
+		t.Fatal("Expected dial back with an unknown nonce to fail")
+	}
+
+	n.autoNAT.mutex.Lock()
+	defer n.autoNAT.mutex.Unlock()
+	if len(n.autoNAT.nonces["expected"]) != 0 {
+		t.Fatalf("Expected no address to be reachable, got %v", n.autoNAT.nonces["expected"])
+	}
+}
+
+func TestAutoNATOnlyDialsRequester(t *testing.T) {
+	n := newTestNetwork(t, &Peer{
+		ID:        "autonat-requester",
+		Addresses: []string{"mem:autonat-requester"},
+	})
+
+	for name, remote := range map[string]net.Addr{
+		"other host": &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 21600},
+		// relayed and memory streams don't tell us where they come from
+		"no ip": memAddr("autonat-requester-b"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			lc, rc := net.Pipe()
+			defer rc.Close()
+
+			wg := &sync.WaitGroup{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				n.autoNAT.handleStream(AutoNATProtocolID, &remoteAddrConn{lc, remote})
+			}()
+
+			// private addresses and the addresses of other hosts are never
+			// dialed, so there is nothing left to dial back
+			err := writeMessage(rc, &autoNATRequest{
+				Nonce: "nonce",
+				Addresses: []string{
+					"tcp4:10.0.0.1:21600",
+					"tcp4:5.6.7.8:21600",
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := &autoNATResponse{}
+			if err := readMessage(rc, res); err != nil {
+				t.Fatal(err)
+			}
+			if res.Error != ErrAutoNATNoAddresses.Error() {
+				t.Fatalf("Expected ErrAutoNATNoAddresses, got %+v", res)
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestFilterAddressesByIP(t *testing.T) {
+	addrs := []string{
+		"tcp4:1.2.3.4:21600",
+		"quic:1.2.3.4:21601",
+		"tcp4:5.6.7.8:21600",
+		"tcp6:[2001:db8::1]:21600",
+		"dns4:example.com:21600",
+		"mem:n1",
+	}
+
+	for ip, expected := range map[string][]string{
+		"1.2.3.4": {
+			"tcp4:1.2.3.4:21600",
+			"quic:1.2.3.4:21601",
+		},
+		"2001:db8::1": {
+			"tcp6:[2001:db8::1]:21600",
+		},
+		"9.9.9.9": {},
+	} {
+		if filtered := filterAddressesByIP(addrs, net.ParseIP(ip)); !reflect.DeepEqual(filtered, expected) {
+			t.Fatalf("Expected %v for %s, got %v", expected, ip, filtered)
+		}
+	}
+
+	if filtered := filterAddressesByIP(addrs, nil); len(filtered) != 0 {
+		t.Fatalf("Expected nothing without an ip, got %v", filtered)
+	}
+}
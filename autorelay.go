@@ -0,0 +1,232 @@
+package net
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// autoRelayInterval is how often the auto relay checks whether the local
+	// peer needs relays
+	autoRelayInterval = 30 * time.Second
+	// autoRelayMaxRelays is the number of relays the auto relay will keep
+	// reservations with
+	autoRelayMaxRelays = 2
+	// autoRelayReserveTimeout is how long a relay has to accept our
+	// reservation before we move on to the next one
+	autoRelayReserveTimeout = 10 * time.Second
+)
+
+// autoRelay makes sure that peers that are not publicly reachable can still
+// be reached through relays.
+// Relays are picked from the peerstore amongst the peers that advertise the
+// relay protocol and are publicly reachable themselves. Once a reservation
+// has been made the relay's address is added to the local peer's addresses
+// and is removed again once the reservation is dropped.
+type autoRelay struct {
+	mutex     sync.Mutex
+	net       *network
+	relay     *Relay
+	relays    map[string]io.ReadWriteCloser
+	addrs     []string
+	maxRelays int
+	update    chan struct{}
+	closed    bool
+}
+
+func newAutoRelay(n *network, r *Relay) *autoRelay {
+	return &autoRelay{
+		net:       n,
+		relay:     r,
+		relays:    map[string]io.ReadWriteCloser{},
+		maxRelays: autoRelayMaxRelays,
+		update:    make(chan struct{}, 1),
+	}
+}
+
+// Start checks the local peer's reachability periodically, or whenever the
+// peerstore or a reservation changes
+func (a *autoRelay) Start() {
+	a.net.RegisterPeerHandler(func(Peer) error {
+		a.trigger()
+		return nil
+	})
+
+	a.net.RegisterReachabilityHandler(func(Reachability) error {
+		a.trigger()
+		return nil
+	})
+
+	go func() {
+		ticker := time.NewTicker(autoRelayInterval)
+		defer ticker.Stop()
+		for {
+			a.refresh()
+			select {
+			case <-ticker.C:
+			case <-a.update:
+			case <-a.net.done:
+				return
+			}
+		}
+	}()
+}
+
+// Close releases our reservations, no new ones are made afterwards
+func (a *autoRelay) Close() {
+	a.mutex.Lock()
+	a.closed = true
+	relays := a.relays
+	a.relays = map[string]io.ReadWriteCloser{}
+	a.mutex.Unlock()
+
+	for _, rwc := range relays {
+		rwc.Close()
+	}
+}
+
+func (a *autoRelay) trigger() {
+	select {
+	case a.update <- struct{}{}:
+	default:
+	}
+}
+
+func (a *autoRelay) refresh() {
+	lpid := a.net.localPeerID()
+
+	// if we can be dialed directly there is no need for relays, until
+	// autonat has found out we only have our addresses to go by
+	public := false
+	switch a.net.Reachability() {
+	case ReachabilityPublic:
+		public = true
+	case ReachabilityUnknown:
+		public = a.isPublic(a.net.getAdvertisedAddresses())
+	}
+
+	if public {
+		a.mutex.Lock()
+		for rpid, rwc := range a.relays {
+			rwc.Close()
+			delete(a.relays, rpid)
+		}
+		a.mutex.Unlock()
+		a.updateAddresses()
+		return
+	}
+
+	for _, rpid := range a.candidates(lpid) {
+		a.mutex.Lock()
+		full := len(a.relays) >= a.maxRelays
+		a.mutex.Unlock()
+		if full {
+			break
+		}
+		a.reserve(rpid)
+	}
+
+	a.updateAddresses()
+}
+
+// isPublic checks if any of a peer's addresses are direct addresses that can
+// be reached from the internet
+func (a *autoRelay) isPublic(addrs []string) bool {
+	for _, addr := range addrs {
+		if isRelayAddress(addr) {
+			continue
+		}
+		if isPublicAddress(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// candidates returns the ids of peers that could act as relays for us
+func (a *autoRelay) candidates(lpid string) []string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	rpids := []string{}
+	for _, peer := range a.net.peerstore.PeersWithProtocol(RelayProtocolID) {
+		if peer.ID == lpid {
+			continue
+		}
+		if _, ok := a.relays[peer.ID]; ok {
+			continue
+		}
+		if a.isPublic(peer.Addresses) == false {
+			continue
+		}
+		rpids = append(rpids, peer.ID)
+	}
+	return rpids
+}
+
+func (a *autoRelay) reserve(rpid string) {
+	logger := logrus.WithField("rpid", rpid)
+
+	ctx, cancel := context.WithTimeout(context.Background(), autoRelayReserveTimeout)
+	defer cancel()
+
+	rwc, err := a.relay.ReserveContext(ctx, rpid)
+	if err != nil {
+		logger.WithError(err).Warnf("Could not make reservation with relay")
+		return
+	}
+
+	logger.Infof("Made reservation with relay")
+
+	a.mutex.Lock()
+	if a.closed {
+		a.mutex.Unlock()
+		rwc.Close()
+		return
+	}
+	a.relays[rpid] = rwc
+	a.mutex.Unlock()
+
+	// the relay closes the stream once it drops our reservation
+	go func() {
+		io.Copy(ioutil.Discard, rwc)
+		logger.Infof("Reservation with relay dropped")
+		a.mutex.Lock()
+		if a.relays[rpid] == rwc {
+			delete(a.relays, rpid)
+		}
+		a.mutex.Unlock()
+		rwc.Close()
+		a.trigger()
+	}()
+}
+
+// updateAddresses replaces the relay addresses the auto relay has added to
+// the local peer with the ones of the relays we currently hold reservations
+// with, addresses that were configured manually are left untouched.
+// It is only called from the refresh loop, and runs the address handlers
+// without holding the mutex as they might call back into the auto relay.
+func (a *autoRelay) updateAddresses() {
+	lpid := a.net.localPeerID()
+
+	a.mutex.Lock()
+	previous := a.addrs
+	addrs := []string{}
+	for rpid := range a.relays {
+		addrs = append(addrs, NewRelayAddress(lpid, rpid).String())
+	}
+	a.mutex.Unlock()
+	sort.Strings(addrs)
+
+	added := a.net.updateLocalAddresses(previous, addrs)
+
+	a.mutex.Lock()
+	a.addrs = added
+	a.mutex.Unlock()
+}
@@ -0,0 +1,52 @@
+package net
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAutoRelayAddressHandlers(t *testing.T) {
+	r := newTestNetwork(t, &Peer{
+		ID:        "autorelay-r",
+		Addresses: []string{"mem:autorelay-r"},
+	})
+	a := newTestNetwork(t, &Peer{
+		ID:        "autorelay-a",
+		Addresses: []string{"mem:autorelay-a"},
+	})
+	err := a.PutPeer(Peer{
+		ID:        "autorelay-r",
+		Addresses: r.getLocalAddresses(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// address handlers can call back into the auto relay
+	a.RegisterAddressHandler(func([]string) error {
+		a.autoRelay.candidates(a.localPeerID())
+		a.autoRelay.trigger()
+		return nil
+	})
+
+	done := make(chan struct{})
+	go func() {
+		a.autoRelay.reserve("autorelay-r")
+		a.autoRelay.updateAddresses()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Updating addresses did not complete")
+	}
+
+	addr := NewRelayAddress("autorelay-a", "autorelay-r").String()
+	waitMapped(t, a, addr, true)
+
+	// the relay address is removed once the reservation is released
+	a.autoRelay.Close()
+	a.autoRelay.updateAddresses()
+	waitMapped(t, a, addr, false)
+}
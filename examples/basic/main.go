@@ -29,13 +29,14 @@ var (
 func main() {
 	logrus.SetLevel(logrus.DebugLevel)
 
-	n1Port := 21600
+	// pick free ports, so the example can run next to anything else
+	n1Port := net.GetPort()
 	n1PeerID := "n1"
-	n1Addr := "n1/dummy"
+	n1Addr := n1PeerID + "/" + protocolID
 
-	n2Port := 21610
+	n2Port := net.GetPort()
 	n2PeerID := "n2"
-	n2Addr := "n2/dummy"
+	n2Addr := n2PeerID + "/" + protocolID
 
 	// create networks
 	// newNode will return a peer and a network
@@ -98,17 +99,14 @@ func newNode(port int, peerID string) (*net.Peer, net.Network, error) {
 		Addresses: addrs,
 	}
 
-	// initialize network
-	mn, err := net.NewNetwork(pr, port)
+	// initialize network, it will listen on the peer's addresses, which
+	// are on our private network
+	mn, err := net.NewNetwork(pr, port, net.WithPrivateNetwork(true))
 	if err != nil {
 		fmt.Println("Could not initialize network", err)
 		return nil, nil, err
 	}
 
-	for _, addr := range addrs {
-		mn.Listen(addr)
-	}
-
 	// create a stream handler
 	hn := func(protocolID string, rwc io.ReadWriteCloser) error {
 		scanner := bufio.NewScanner(rwc)
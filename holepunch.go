@@ -0,0 +1,536 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// HolePunchProtocolID is the stream protocol used to coordinate hole
+	// punching over relayed connections
+	HolePunchProtocolID = "/holepunch/v1"
+
+	// holePunchTimeout is how long we wait for a direct connection
+	holePunchTimeout = 10 * time.Second
+	// holePunchPollInterval is how often we check if the other peer's
+	// session got through to our listener
+	holePunchPollInterval = 50 * time.Millisecond
+
+	holePunchMessageConnect = "connect"
+	holePunchMessageSync    = "sync"
+)
+
+var (
+	// ErrHolePunchNoAddresses is returned when there are no direct addresses
+	// to try and punch through to
+	ErrHolePunchNoAddresses = errors.New("No direct addresses to punch through to")
+	// ErrHolePunchFailed is returned when none of the simultaneous dials
+	// succeeded
+	ErrHolePunchFailed = errors.New("Hole punching failed")
+	// ErrHolePunchInProgress is returned when we are already punching
+	// through to the peer
+	ErrHolePunchInProgress = errors.New("Hole punching already in progress")
+)
+
+// holePunchMessage is exchanged over the relayed stream, addresses hold the
+// direct addresses the sender can be reached on for this attempt. The nonce
+// of the peer that upgrades the connection is written on the connection it
+// picked, so the other peer knows which one to use.
+type holePunchMessage struct {
+	Type      string   `json:"type"`
+	Peer      string   `json:"peer,omitempty"`
+	Addresses []string `json:"addresses,omitempty"`
+	Nonce     string   `json:"nonce,omitempty"`
+}
+
+// punchSocket is bound for a single hole punching attempt, the other peer
+// is told to dial it and we dial the other peer's sockets from it
+type punchSocket interface {
+	// Address returns the address the other peer should dial, given one of
+	// our advertised addresses
+	Address(addr string) string
+	DialContext(ctx context.Context, addr string) (net.Conn, error)
+	Accept() (net.Conn, error)
+	Close() error
+}
+
+// punchTransport is implemented by transports that can punch through NATs
+// with simultaneous opens, ie. TCP
+type punchTransport interface {
+	listenPunch(scheme string) (punchSocket, error)
+}
+
+// udpPunchTransport is implemented by transports whose sessions share the
+// UDP socket they listen on, ie. QUIC. Sending a few packets to the other
+// peer opens up our NAT, so its dials get through to our listener.
+type udpPunchTransport interface {
+	sessionTransport
+	punch(ctx context.Context, addr string) error
+}
+
+// holePuncher tries to upgrade relayed connections to direct ones.
+//
+// The peer that dialed through the relay (A) opens a relayed stream to the
+// other peer (B) and sends the direct addresses it can be reached on, B
+// responds with its own. A measures the round trip time, sends a sync
+// message and waits for half of it before connecting, while B connects as
+// soon as it gets the sync message, so both ends' NATs see outgoing traffic
+// before the other end's packets arrive.
+//
+// TCP addresses are dialed from both ends at the same time, from sockets
+// bound for the attempt whose ports are the ones sent to the other peer.
+// UDP addresses are punched with a few packets from both ends, and then
+// dialed by the peer with the lower id.
+// Either way only the peer with the lower id upgrades the connection to a
+// session, so both ends agree on a single direct connection even if both of
+// them started punching at the same time. As both TCP dials can succeed, it
+// writes its nonce on the connection it picked, and the other peer only
+// uses the connection the nonce arrives on.
+type holePuncher struct {
+	mutex  sync.Mutex
+	net    *network
+	active map[string]bool
+	// listen binds the sockets for an attempt, it can be replaced to run
+	// hole punching against emulated NATs
+	listen func(scheme string) (punchSocket, error)
+}
+
+func newHolePuncher(n *network) *holePuncher {
+	h := &holePuncher{
+		net:    n,
+		active: map[string]bool{},
+	}
+	h.listen = h.listenPunch
+	return h
+}
+
+// Punch tries to establish a direct connection with a peer we are currently
+// talking to through a relay
+func (h *holePuncher) Punch(pid string) error {
+	if sess, ok := h.net.getSession(pid); ok && !sess.IsClosed() {
+		return nil
+	}
+
+	if !h.start(pid) {
+		return nil
+	}
+	defer h.stop(pid)
+
+	logger := logrus.WithField("pid", pid)
+
+	rwc, err := h.net.Dial(pid + "/" + HolePunchProtocolID)
+	if err != nil {
+		logger.WithError(err).Debugf("Could not open hole punching stream")
+		return err
+	}
+	defer rwc.Close()
+
+	sockets, msg, err := h.prepare()
+	if err != nil {
+		return err
+	}
+	defer closeSockets(sockets)
+
+	start := time.Now()
+	if err := writeMessage(rwc, msg); err != nil {
+		return err
+	}
+
+	res := &holePunchMessage{}
+	if err := readMessage(rwc, res); err != nil {
+		return err
+	}
+	rtt := time.Since(start)
+
+	if res.Type != holePunchMessageConnect {
+		return errors.New("Unexpected hole punching message " + res.Type)
+	}
+
+	if res.Peer != pid {
+		logger.
+			WithField("rpid", res.Peer).
+			Warnf("Peer responded to hole punching as someone else")
+		return ErrIdentityMismatch
+	}
+
+	if len(res.Addresses) == 0 {
+		return ErrHolePunchNoAddresses
+	}
+
+	if err := writeMessage(rwc, &holePunchMessage{Type: holePunchMessageSync}); err != nil {
+		return err
+	}
+
+	// wait for the sync message to reach the other end
+	time.Sleep(rtt / 2)
+
+	if err := h.connect(pid, sockets, res.Addresses, initiatorNonce(h.isInitiator(pid), msg, res)); err != nil {
+		logger.WithError(err).Infof("Could not punch through to peer")
+		return err
+	}
+
+	logger.Infof("Upgraded relayed connection to direct")
+	return nil
+}
+
+// handleStream is the other end of Punch
+func (h *holePuncher) handleStream(protocolID string, rwc io.ReadWriteCloser) error {
+	defer rwc.Close()
+
+	req := &holePunchMessage{}
+	if err := readMessage(rwc, req); err != nil {
+		return err
+	}
+
+	if req.Type != holePunchMessageConnect {
+		return errors.New("Unexpected hole punching message " + req.Type)
+	}
+
+	// the relay told us who the stream comes from
+	pid := streamPeerID(rwc)
+	if pid == "" || req.Peer != pid {
+		logrus.
+			WithField("pid", pid).
+			WithField("rpid", req.Peer).
+			Warnf("Peer asked to punch through as someone else")
+		return ErrIdentityMismatch
+	}
+
+	// if we are punching through to the same peer ourselves, only the
+	// attempt started by the peer with the lower id goes on
+	if h.start(pid) {
+		defer h.stop(pid)
+	} else if h.isInitiator(pid) {
+		return ErrHolePunchInProgress
+	}
+
+	sockets, msg, err := h.prepare()
+	if err != nil {
+		return err
+	}
+	defer closeSockets(sockets)
+
+	if err := writeMessage(rwc, msg); err != nil {
+		return err
+	}
+
+	smsg := &holePunchMessage{}
+	if err := readMessage(rwc, smsg); err != nil {
+		return err
+	}
+
+	if smsg.Type != holePunchMessageSync {
+		return errors.New("Unexpected hole punching message " + smsg.Type)
+	}
+
+	if len(req.Addresses) == 0 {
+		return ErrHolePunchNoAddresses
+	}
+
+	if err := h.connect(pid, sockets, req.Addresses, initiatorNonce(h.isInitiator(pid), msg, req)); err != nil {
+		// the other end might still get through to our listener
+		logrus.WithError(err).Debugf("Could not punch through to peer")
+	}
+
+	return nil
+}
+
+// prepare binds the sockets for an attempt and returns them along with the
+// connect message that tells the other peer how to reach them
+func (h *holePuncher) prepare() (map[string]punchSocket, *holePunchMessage, error) {
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	msg := &holePunchMessage{
+		Type:  holePunchMessageConnect,
+		Peer:  h.net.localPeerID(),
+		Nonce: nonce,
+	}
+
+	sockets := map[string]punchSocket{}
+	unsupported := map[string]bool{}
+	for _, addr := range h.net.getAdvertisedAddresses() {
+		if isRelayAddress(addr) {
+			continue
+		}
+		if h.isUDP(addr) {
+			// packets are punched from the socket we listen on
+			msg.Addresses = append(msg.Addresses, addr)
+			continue
+		}
+		scheme := getScheme(addr)
+		if unsupported[scheme] {
+			continue
+		}
+		ps, ok := sockets[scheme]
+		if !ok {
+			var err error
+			if ps, err = h.listen(scheme); err != nil {
+				unsupported[scheme] = true
+				continue
+			}
+			sockets[scheme] = ps
+		}
+		if paddr := ps.Address(addr); paddr != "" {
+			msg.Addresses = append(msg.Addresses, paddr)
+		}
+	}
+
+	return sockets, msg, nil
+}
+
+// initiatorNonce returns the nonce of the peer that upgrades the connection
+func initiatorNonce(initiator bool, local, remote *holePunchMessage) string {
+	if initiator {
+		return local.Nonce
+	}
+	return remote.Nonce
+}
+
+// connect punches through to the other peer's addresses and upgrades the
+// first connection that succeeds, the rest are closed.
+// The initiator writes the nonce on the connection it upgrades, while the
+// other peer waits for it to arrive on one of its connections.
+func (h *holePuncher) connect(pid string, sockets map[string]punchSocket, addrs []string, nonce string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), holePunchTimeout)
+	defer cancel()
+
+	addrs = resolveAddresses(ctx, h.net.resolver, addrs)
+	addrs = filterAddresses(addrs, h.net.getAddressPolicy().Dial)
+
+	initiator := h.isInitiator(pid)
+
+	type result struct {
+		conn      net.Conn
+		sess      session
+		accepted  bool // the other peer's session got through to our listener
+		confirmed bool // the initiator picked this connection
+	}
+
+	results := make(chan result, len(addrs)+len(sockets))
+	attempts := 0
+	for _, addr := range addrs {
+		if h.isUDP(addr) {
+			attempts++
+			go func(addr string) {
+				sess, err := h.punchUDP(ctx, addr, pid, initiator)
+				switch {
+				case err != nil:
+					results <- result{}
+				case sess == nil:
+					results <- result{accepted: true}
+				default:
+					results <- result{sess: sess}
+				}
+			}(addr)
+			continue
+		}
+		ps, ok := sockets[getScheme(addr)]
+		if !ok {
+			continue
+		}
+		attempts++
+		go func(addr string) {
+			c, err := ps.DialContext(ctx, addr)
+			if err != nil {
+				results <- result{}
+				return
+			}
+			results <- result{conn: c}
+		}(addr)
+	}
+
+	// the other peer's dials might get through to our sockets before ours
+	// get through to theirs
+	for _, ps := range sockets {
+		attempts++
+		go func(ps punchSocket) {
+			c, err := ps.Accept()
+			if err != nil {
+				results <- result{}
+				return
+			}
+			results <- result{conn: c}
+		}(ps)
+	}
+
+	// connections the initiator might still write its nonce on
+	unconfirmed := map[net.Conn]bool{}
+
+	var won *result
+	for ; attempts > 0; attempts-- {
+		r := <-results
+		switch {
+		case r.conn == nil && r.sess == nil && !r.accepted:
+			continue
+		case won != nil:
+			if r.conn != nil {
+				r.conn.Close()
+			}
+			if r.sess != nil {
+				r.sess.Close()
+			}
+			continue
+		case r.conn != nil && !initiator && !r.confirmed:
+			// wait for the initiator to tell us if it picked this one
+			attempts++
+			unconfirmed[r.conn] = true
+			go func(c net.Conn) {
+				if err := readNonce(c, nonce); err != nil {
+					c.Close()
+					results <- result{}
+					return
+				}
+				results <- result{conn: c, confirmed: true}
+			}(r.conn)
+			continue
+		}
+		won = &r
+		cancel()
+		// pending accepts only return once their sockets are closed
+		closeSockets(sockets)
+		for c := range unconfirmed {
+			if c != r.conn {
+				c.Close()
+			}
+		}
+	}
+
+	if won == nil {
+		return ErrHolePunchFailed
+	}
+
+	if won.accepted {
+		return nil
+	}
+
+	if won.sess != nil {
+		h.net.putSession(pid, won.sess)
+		go h.net.acceptStreams(won.sess, pid, "outgoing")
+		return nil
+	}
+
+	if !initiator {
+		// the other peer selects the multiplexer, so we handle our end of
+		// the connection as if we had accepted it
+		go h.net.cmux.Handle(won.conn)
+		return nil
+	}
+
+	// let the other peer know which connection we picked
+	if _, err := won.conn.Write([]byte(nonce + "\n")); err != nil {
+		won.conn.Close()
+		return err
+	}
+
+	if _, err := h.net.upgradeOutgoing(pid, won.conn); err != nil {
+		won.conn.Close()
+		return err
+	}
+
+	return nil
+}
+
+// readNonce waits for the initiator's nonce on a connection, it reads no
+// more than the nonce so the connection can be handled afterwards
+func readNonce(c net.Conn, nonce string) error {
+	c.SetReadDeadline(time.Now().Add(holePunchTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	b := make([]byte, len(nonce)+1)
+	if _, err := io.ReadFull(c, b); err != nil {
+		return err
+	}
+	if string(b) != nonce+"\n" {
+		return ErrHolePunchFailed
+	}
+	return nil
+}
+
+// isInitiator checks if we are the one to upgrade direct connections with
+// a peer, which is the peer with the lower id
+func (h *holePuncher) isInitiator(pid string) bool {
+	return h.net.localPeerID() < pid
+}
+
+// isUDP checks if an address is punched with UDP packets
+func (h *holePuncher) isUDP(addr string) bool {
+	tr, err := h.net.getTransport(addr)
+	if err != nil {
+		return false
+	}
+	_, ok := tr.(udpPunchTransport)
+	return ok
+}
+
+// listenPunch binds a socket for an attempt on transports that support it
+func (h *holePuncher) listenPunch(scheme string) (punchSocket, error) {
+	h.net.Lock()
+	tr := h.net.transports[scheme]
+	h.net.Unlock()
+	pt, ok := tr.(punchTransport)
+	if !ok {
+		return nil, ErrTransportNotSupported
+	}
+	return pt.listenPunch(scheme)
+}
+
+// punchUDP sends packets to a UDP address, the initiator then dials it
+// while the other end waits for the session to show up on its listener, in
+// which case no session is returned
+func (h *holePuncher) punchUDP(ctx context.Context, addr, pid string, initiator bool) (session, error) {
+	tr, err := h.net.getTransport(addr)
+	if err != nil {
+		return nil, err
+	}
+	ut, ok := tr.(udpPunchTransport)
+	if !ok {
+		return nil, ErrTransportNotSupported
+	}
+	if err := ut.punch(ctx, addr); err != nil {
+		return nil, err
+	}
+	if initiator {
+		return ut.DialSession(ctx, addr, pid)
+	}
+	for {
+		if sess, ok := h.net.getSession(pid); ok && !sess.IsClosed() {
+			return nil, nil
+		}
+		select {
+		case <-time.After(holePunchPollInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (h *holePuncher) start(pid string) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.active[pid] {
+		return false
+	}
+	h.active[pid] = true
+	return true
+}
+
+func (h *holePuncher) stop(pid string) {
+	h.mutex.Lock()
+	delete(h.active, pid)
+	h.mutex.Unlock()
+}
+
+func closeSockets(sockets map[string]punchSocket) {
+	for _, ps := range sockets {
+		ps.Close()
+	}
+}
@@ -0,0 +1,398 @@
+package net
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// natWindow is how long an emulated NAT waits for the other end's dial
+const natWindow = 2 * time.Second
+
+// natEmulator stands in for two peers' NATs. Its sockets only connect when
+// both ends dial each other at the same time, and never accept connections
+// on their own, as if every unsolicited packet was dropped.
+// Open emulators let every dial through to the other end's socket instead,
+// so both peers can end up with two connections, as it can happen with a
+// TCP simultaneous open.
+type natEmulator struct {
+	mutex   sync.Mutex
+	lastID  int
+	pending map[string]chan *memConn // by "from->to"
+	sockets map[string]*natSocket
+	open    bool
+	pairs   int
+}
+
+func newNATEmulator() *natEmulator {
+	return &natEmulator{
+		pending: map[string]chan *memConn{},
+		sockets: map[string]*natSocket{},
+	}
+}
+
+// listen can be used as a hole puncher's listen function
+func (e *natEmulator) listen(prefix string) func(scheme string) (punchSocket, error) {
+	return func(scheme string) (punchSocket, error) {
+		if scheme != "mem" {
+			return nil, ErrTransportNotSupported
+		}
+		e.mutex.Lock()
+		defer e.mutex.Unlock()
+		e.lastID++
+		s := &natSocket{
+			nat:      e,
+			name:     fmt.Sprintf("%s-nat-%d", prefix, e.lastID),
+			accepted: make(chan net.Conn, 1),
+			done:     make(chan struct{}),
+		}
+		e.sockets[s.name] = s
+		return s, nil
+	}
+}
+
+// dial pairs the dial with the other end's, if it does not dial back in
+// time the connection is refused
+func (e *natEmulator) dial(ctx context.Context, from, to string) (net.Conn, error) {
+	e.mutex.Lock()
+	if e.open {
+		s, ok := e.sockets[to]
+		if !ok {
+			e.mutex.Unlock()
+			return nil, ErrConnectionRefused
+		}
+		e.pairs++
+		e.mutex.Unlock()
+		lc, rc := newMemConnPair(memAddr(from), memAddr(to))
+		select {
+		case s.accepted <- rc:
+			return lc, nil
+		case <-s.done:
+			return nil, ErrConnectionRefused
+		}
+	}
+	if ch, ok := e.pending[to+"->"+from]; ok {
+		delete(e.pending, to+"->"+from)
+		e.pairs++
+		e.mutex.Unlock()
+		lc, rc := newMemConnPair(memAddr(from), memAddr(to))
+		ch <- rc
+		return lc, nil
+	}
+	ch := make(chan *memConn, 1)
+	e.pending[from+"->"+to] = ch
+	e.mutex.Unlock()
+
+	timer := time.NewTimer(natWindow)
+	defer timer.Stop()
+
+	select {
+	case c := <-ch:
+		return c, nil
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.pending[from+"->"+to] == ch {
+		delete(e.pending, from+"->"+to)
+		return nil, ErrConnectionRefused
+	}
+	// the other end paired with us while we were giving up
+	c := <-ch
+	c.Close()
+	return nil, ErrConnectionRefused
+}
+
+func (e *natEmulator) getPairs() int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.pairs
+}
+
+type natSocket struct {
+	nat       *natEmulator
+	name      string
+	accepted  chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *natSocket) Address(addr string) string {
+	if getScheme(addr) != "mem" {
+		return ""
+	}
+	return "mem:" + s.name
+}
+
+func (s *natSocket) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	a, err := ParseAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	return s.nat.dial(ctx, s.name, a.Host)
+}
+
+func (s *natSocket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accepted:
+		return c, nil
+	case <-s.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (s *natSocket) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	return nil
+}
+
+func newTestNetwork(t *testing.T, peer *Peer) *network {
+	n, err := NewNetwork(peer, 0, WithPortMapperDiscovery(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		n.Close()
+	})
+	return n.(*network)
+}
+
+// newRelayedPeers returns a relay and two peers that only know how to reach
+// each other through it
+func newRelayedPeers(t *testing.T, prefix string) (*network, *network, *network) {
+	r := newTestNetwork(t, &Peer{
+		ID:        prefix + "-r",
+		Addresses: []string{"mem:" + prefix + "-r"},
+	})
+	a := newTestNetwork(t, &Peer{
+		ID:        prefix + "-a",
+		Addresses: []string{"mem:" + prefix + "-a"},
+	})
+	b := newTestNetwork(t, &Peer{
+		ID:        prefix + "-b",
+		Addresses: []string{"mem:" + prefix + "-b"},
+	})
+	connectRelayed(t, r, a, b)
+	return r, a, b
+}
+
+func connectRelayed(t *testing.T, r *network, peers ...*network) {
+	rp := Peer{
+		ID:        r.GetLocalPeer().ID,
+		Addresses: r.getLocalAddresses(),
+	}
+	for _, n := range peers {
+		if err := n.PutPeer(rp); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewRelay(n).Reserve(rp.ID); err != nil {
+			t.Fatal(err)
+		}
+		n.RegisterStreamHandler("echo", func(protocolID string, rwc io.ReadWriteCloser) error {
+			defer rwc.Close()
+			_, err := io.Copy(rwc, rwc)
+			return err
+		})
+	}
+	for _, n := range peers {
+		for _, o := range peers {
+			if n == o {
+				continue
+			}
+			pid := o.GetLocalPeer().ID
+			err := n.PutPeer(Peer{
+				ID:        pid,
+				Addresses: []string{NewRelayAddress(pid, rp.ID).String()},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// connectDirect lets n dial the peers on their own addresses, the peers
+// echo what they receive on the echo protocol
+func connectDirect(t *testing.T, n *network, peers ...*network) {
+	for _, p := range peers {
+		p.RegisterStreamHandler("echo", func(protocolID string, rwc io.ReadWriteCloser) error {
+			defer rwc.Close()
+			_, err := io.Copy(rwc, rwc)
+			return err
+		})
+		err := n.PutPeer(Peer{
+			ID:        p.GetLocalPeer().ID,
+			Addresses: p.getLocalAddresses(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// waitDirect waits until the networks have direct sessions with each other
+func waitDirect(t *testing.T, a, b *network) {
+	deadline := time.Now().Add(holePunchTimeout)
+	for time.Now().Before(deadline) {
+		as, aok := a.getSession(b.GetLocalPeer().ID)
+		bs, bok := b.getSession(a.GetLocalPeer().ID)
+		if aok && bok && !as.IsClosed() && !bs.IsClosed() {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("Peers did not connect directly")
+}
+
+func echo(t *testing.T, n *network, addr string) {
+	c, err := n.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "hello\n" {
+		t.Fatalf("Expected echo, got %q", line)
+	}
+}
+
+func TestHolePunchThroughEmulatedNAT(t *testing.T) {
+	_, a, b := newRelayedPeers(t, "hp-relayed")
+
+	nat := newNATEmulator()
+	a.holePuncher.listen = nat.listen("a")
+	b.holePuncher.listen = nat.listen("b")
+
+	// the first dial is relayed and starts punching in the background
+	echo(t, a, b.GetLocalPeer().ID+"/echo")
+
+	waitDirect(t, a, b)
+
+	if pairs := nat.getPairs(); pairs != 1 {
+		t.Fatalf("Expected a single punched connection, got %d", pairs)
+	}
+
+	// the next dial uses the direct session
+	echo(t, a, b.GetLocalPeer().ID+"/echo")
+}
+
+func TestHolePunchSimultaneous(t *testing.T) {
+	_, a, b := newRelayedPeers(t, "hp-simultaneous")
+
+	nat := newNATEmulator()
+	a.holePuncher.listen = nat.listen("a")
+	b.holePuncher.listen = nat.listen("b")
+
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		a.holePuncher.Punch(b.GetLocalPeer().ID)
+	}()
+	go func() {
+		defer wg.Done()
+		b.holePuncher.Punch(a.GetLocalPeer().ID)
+	}()
+	wg.Wait()
+
+	waitDirect(t, a, b)
+
+	if pairs := nat.getPairs(); pairs != 1 {
+		t.Fatalf("Expected a single punched connection, got %d", pairs)
+	}
+}
+
+func TestHolePunchBothDialsSucceed(t *testing.T) {
+	_, a, b := newRelayedPeers(t, "hp-both")
+
+	nat := newNATEmulator()
+	nat.open = true
+	a.holePuncher.listen = nat.listen("a")
+	b.holePuncher.listen = nat.listen("b")
+
+	if err := a.holePuncher.Punch(b.GetLocalPeer().ID); err != nil {
+		t.Fatal(err)
+	}
+
+	waitDirect(t, a, b)
+
+	if pairs := nat.getPairs(); pairs != 2 {
+		t.Fatalf("Expected both dials to get through, got %d", pairs)
+	}
+
+	// both peers use the same connection
+	echo(t, a, b.GetLocalPeer().ID+"/echo")
+	echo(t, b, a.GetLocalPeer().ID+"/echo")
+}
+
+func TestHolePunchUDP(t *testing.T) {
+	newPeer := func(name string) *Peer {
+		p := newKeyedPeer(t, name)
+		p.Addresses = []string{
+			"mem:hp-udp-" + name,
+			fmt.Sprintf("quic:127.0.0.1:%d", GetPort()),
+		}
+		return p
+	}
+
+	r := newTestNetwork(t, &Peer{
+		ID:        "hp-udp-r",
+		Addresses: []string{"mem:hp-udp-r"},
+	})
+	a := newTestNetwork(t, newPeer("a"))
+	b := newTestNetwork(t, newPeer("b"))
+	connectRelayed(t, r, a, b)
+
+	// only the QUIC addresses can be punched through
+	nolisten := func(scheme string) (punchSocket, error) {
+		return nil, ErrTransportNotSupported
+	}
+	a.holePuncher.listen = nolisten
+	b.holePuncher.listen = nolisten
+
+	if err := a.holePuncher.Punch(b.GetLocalPeer().ID); err != nil {
+		t.Fatal(err)
+	}
+
+	waitDirect(t, a, b)
+
+	sess, _ := a.getSession(b.GetLocalPeer().ID)
+	if _, ok := sess.(*quicSession); !ok {
+		t.Fatalf("Expected a QUIC session, got %T", sess)
+	}
+}
+
+func TestHolePunchIdentityMismatch(t *testing.T) {
+	a := newTestNetwork(t, &Peer{
+		ID:        "hp-mismatch-a",
+		Addresses: []string{"mem:hp-mismatch-a"},
+	})
+
+	lc, rc := net.Pipe()
+	defer rc.Close()
+	go writeMessage(rc, &holePunchMessage{
+		Type: holePunchMessageConnect,
+		Peer: "hp-mismatch-c",
+	})
+
+	err := a.holePuncher.handleStream(HolePunchProtocolID, &peerStream{lc, "hp-mismatch-b"})
+	if err != ErrIdentityMismatch {
+		t.Fatalf("Expected ErrIdentityMismatch, got %v", err)
+	}
+}
@@ -0,0 +1,414 @@
+package net
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ms "github.com/multiformats/go-multistream"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// IdentifyProtocolID is the stream protocol peers use to tell each other
+	// about themselves once a session has been established
+	IdentifyProtocolID = "/identify/v1"
+	// IdentifyPushProtocolID is the stream protocol peers use to tell
+	// connected peers that something about them has changed
+	IdentifyPushProtocolID = "/identify/push/v1"
+	// PingProtocolID is the stream protocol used to sample the round trip
+	// time to connected peers, selecting it is all there is to it
+	PingProtocolID = "/ping/v1"
+
+	// DefaultAgentVersion is sent to other peers unless replaced with
+	// SetAgentVersion
+	DefaultAgentVersion = "go-nimona-net"
+
+	// identifyTimeout is how long the identify exchange can take
+	identifyTimeout = 10 * time.Second
+	// identifyMaxMessageSize is larger than other control messages as it
+	// carries the peer's public key
+	identifyMaxMessageSize = 64 * 1024
+	// latencySampleInterval is how often the latency to connected peers is
+	// sampled after they have been identified
+	latencySampleInterval = time.Minute
+)
+
+var (
+	// ErrInvalidAddressSignature is returned when the signature of a peer's
+	// addresses does not verify
+	ErrInvalidAddressSignature = errors.New("Invalid address signature")
+	// ErrPublicKeyMismatch is returned when a peer identifies with a public
+	// key other than the one we know it by
+	ErrPublicKeyMismatch = errors.New("Public key does not match the known one")
+)
+
+// identifyMessage describes the peer that sends it.
+// The signature covers the peer's id, sequence number and addresses, so that
+// they can be trusted even if they are later gossiped by other peers.
+// The sequence number increases with every message the peer sends, so older
+// messages that arrive late or are replayed can be ignored.
+type identifyMessage struct {
+	ID              string   `json:"id"`
+	PublicKey       []byte   `json:"publicKey,omitempty"`
+	Seq             uint64   `json:"seq"`
+	Addresses       []string `json:"addresses"`
+	Signature       []byte   `json:"signature,omitempty"`
+	Protocols       []string `json:"protocols"`
+	AgentVersion    string   `json:"agentVersion,omitempty"`
+	ObservedAddress string   `json:"observedAddress,omitempty"`
+}
+
+// identify asks the remote end of every new session who it is.
+// Each side opens a stream to the other, which responds with its listen
+// addresses, protocols, agent version and the address it sees us connecting
+// from, and the remote peer is added to the peerstore.
+type identify struct {
+	mutex       sync.Mutex
+	net         *network
+	seq         uint64            // of the last message we sent
+	updateMutex sync.Mutex        // makes checking and updating peers atomic
+	seqs        map[string]uint64 // of the last message of each peer
+}
+
+func newIdentify(n *network) *identify {
+	return &identify{
+		net:  n,
+		seqs: map[string]uint64{},
+	}
+}
+
+// Identify asks the peer on the other end of a session about itself and
+// updates the peerstore
+func (i *identify) Identify(pid string, sess session) error {
+	logger := logrus.WithField("pid", pid)
+
+	st, err := sess.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	st.SetDeadline(time.Now().Add(identifyTimeout))
+
+	// selecting the protocol takes a single round trip, which is our first
+	// latency sample, later ones are taken by sampleLatency
+	start := time.Now()
+	if err := ms.SelectProtoOrFail(IdentifyProtocolID, st); err != nil {
+		return err
+	}
+	rtt := time.Since(start)
+
+	msg := &identifyMessage{}
+	if err := readMessageLimit(st, msg, identifyMaxMessageSize); err != nil {
+		return err
+	}
+
+	if msg.ID != pid {
+		logger.
+			WithField("rpid", msg.ID).
+			Warnf("Peer identified as someone else")
+		return ErrIdentityMismatch
+	}
+
+	peer, err := i.verify(msg)
+	if err != nil {
+		logger.WithError(err).Warnf("Could not verify peer")
+		return err
+	}
+
+	logger.
+		WithField("addrs", peer.Addresses).
+		WithField("protocols", peer.Protocols).
+		WithField("agent", peer.AgentVersion).
+		WithField("observed", msg.ObservedAddress).
+		Debugf("Identified peer")
+
+	// observations are counted by where they come from, not by who sends
+	// them, as peer ids are free to make
+	i.net.observed.Record(remoteIP(st), msg.ObservedAddress)
+
+	if err := i.update(peer, msg.Seq); err != nil {
+		return err
+	}
+
+	return i.net.peerstore.RecordLatency(pid, rtt)
+}
+
+// verify returns the peer the message describes, if the message comes with a
+// public key it must match the peer's id and the addresses must be signed
+// with it. Once we know a peer's key, its messages must be signed with it.
+func (i *identify) verify(msg *identifyMessage) (*Peer, error) {
+	peer := &Peer{
+		ID: msg.ID,
+	}
+
+	var known []byte
+	if kp, err := i.net.peerstore.Get(msg.ID); err == nil {
+		known, _ = kp.PublicKey()
+	}
+
+	if len(msg.PublicKey) == 0 && len(known) > 0 {
+		return nil, ErrUnsignedIdentity
+	}
+
+	// peers without keys can still identify, but can't prove their
+	// addresses are their own
+	if len(msg.PublicKey) > 0 {
+		kp, err := NewPeerFromPublicKey(msg.ID, msg.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		if len(known) > 0 {
+			// compare the keys as we would store them
+			pk, err := kp.PublicKey()
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(pk, known) {
+				return nil, ErrPublicKeyMismatch
+			}
+		}
+		ok, err := kp.Verify(signedAddresses(msg.ID, msg.Seq, msg.Addresses), msg.Signature)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, ErrInvalidAddressSignature
+		}
+		peer = kp
+	}
+
+	peer.Addresses = msg.Addresses
+	peer.Protocols = msg.Protocols
+	peer.AgentVersion = msg.AgentVersion
+	return peer, nil
+}
+
+// Push tells all connected peers about us again
+func (i *identify) Push() {
+	msg, err := i.message()
+	if err != nil {
+		logrus.WithError(err).Warnf("Could not create identify message")
+		return
+	}
+
+	for pid, sess := range i.net.getSessions() {
+		go func(pid string, sess session) {
+			if err := i.push(sess, msg); err != nil {
+				logrus.
+					WithError(err).
+					WithField("pid", pid).
+					Debugf("Could not push identify message")
+			}
+		}(pid, sess)
+	}
+}
+
+func (i *identify) push(sess session, msg *identifyMessage) error {
+	st, err := sess.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	st.SetDeadline(time.Now().Add(identifyTimeout))
+
+	if err := ms.SelectProtoOrFail(IdentifyPushProtocolID, st); err != nil {
+		return err
+	}
+
+	return writeMessage(st, msg)
+}
+
+// handlePush updates the peerstore with what a connected peer pushed
+func (i *identify) handlePush(protocolID string, rwc io.ReadWriteCloser) error {
+	defer rwc.Close()
+
+	msg := &identifyMessage{}
+	if err := readMessageLimit(rwc, msg, identifyMaxMessageSize); err != nil {
+		return err
+	}
+
+	// peers can only push about themselves
+	if pid := streamPeerID(rwc); msg.ID != pid {
+		logrus.
+			WithField("pid", pid).
+			WithField("rpid", msg.ID).
+			Warnf("Peer pushed identify message of someone else")
+		return ErrIdentityMismatch
+	}
+
+	peer, err := i.verify(msg)
+	if err != nil {
+		return err
+	}
+
+	logrus.
+		WithField("pid", peer.ID).
+		WithField("addrs", peer.Addresses).
+		Debugf("Peer pushed identify message")
+
+	return i.update(peer, msg.Seq)
+}
+
+// update adds what a peer told us about itself to the peerstore.
+// The addresses and protocols it sent replace the ones we had, as the peer
+// knows best, apart from the addresses added with Put, and its addresses are
+// kept for as long as we are connected.
+// Messages older than the last one we got from the peer are ignored.
+func (i *identify) update(peer *Peer, seq uint64) error {
+	i.updateMutex.Lock()
+	defer i.updateMutex.Unlock()
+
+	if last, ok := i.seqs[peer.ID]; ok && seq <= last {
+		logrus.
+			WithField("pid", peer.ID).
+			WithField("seq", seq).
+			WithField("last", last).
+			Debugf("Ignoring old identify message")
+		return nil
+	}
+
+	peer.Addresses = filterAddresses(peer.Addresses, i.net.getAddressPolicy().Accept)
+	if err := i.net.peerstore.UpdateIdentified(*peer, AddressTTLConnected); err != nil {
+		return err
+	}
+
+	i.seqs[peer.ID] = seq
+	return nil
+}
+
+// sampleLatency pings the connected peers that support it periodically,
+// until the network is closed
+func (i *identify) sampleLatency() {
+	ticker := time.NewTicker(latencySampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for pid, sess := range i.net.getSessions() {
+				peer, err := i.net.peerstore.Get(pid)
+				if err != nil || !peer.SupportsProtocol(PingProtocolID) {
+					continue
+				}
+				go func(pid string, sess session) {
+					if err := i.ping(pid, sess); err != nil {
+						logrus.
+							WithError(err).
+							WithField("pid", pid).
+							Debugf("Could not ping peer")
+					}
+				}(pid, sess)
+			}
+		case <-i.net.done:
+			return
+		}
+	}
+}
+
+// ping takes a single round trip to a peer and adds it to its latency
+func (i *identify) ping(pid string, sess session) error {
+	st, err := sess.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	st.SetDeadline(time.Now().Add(identifyTimeout))
+
+	start := time.Now()
+	if err := ms.SelectProtoOrFail(PingProtocolID, st); err != nil {
+		return err
+	}
+
+	return i.net.peerstore.RecordLatency(pid, time.Since(start))
+}
+
+// handlePing has nothing to do once the protocol has been selected
+func (i *identify) handlePing(protocolID string, rwc io.ReadWriteCloser) error {
+	return rwc.Close()
+}
+
+// handleStream tells the peer that asked about us
+func (i *identify) handleStream(protocolID string, rwc io.ReadWriteCloser) error {
+	defer rwc.Close()
+
+	msg, err := i.message()
+	if err != nil {
+		return err
+	}
+
+	if c, ok := rwc.(net.Conn); ok {
+		msg.ObservedAddress = observedAddress(c.RemoteAddr())
+	}
+
+	return writeMessage(rwc, msg)
+}
+
+// message describes the local peer
+func (i *identify) message() (*identifyMessage, error) {
+	lp := i.net.GetLocalPeer()
+	msg := &identifyMessage{
+		ID:           lp.ID,
+		Seq:          i.nextSeq(),
+		Addresses:    i.net.getAdvertisedAddresses(),
+		Protocols:    i.net.getLocalProtocols(),
+		AgentVersion: i.net.getAgentVersion(),
+	}
+
+	if pk, err := lp.PublicKey(); err == nil {
+		sig, err := lp.Sign(signedAddresses(msg.ID, msg.Seq, msg.Addresses))
+		if err != nil {
+			return nil, err
+		}
+		msg.PublicKey = pk
+		msg.Signature = sig
+	}
+
+	return msg, nil
+}
+
+// nextSeq returns the sequence number of the next message we send, which is
+// based on the time so that it keeps increasing after restarts
+func (i *identify) nextSeq() uint64 {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	seq := uint64(time.Now().UnixNano())
+	if seq <= i.seq {
+		seq = i.seq + 1
+	}
+	i.seq = seq
+	return seq
+}
+
+// signedAddresses returns what is signed to vouch for a peer's addresses
+func signedAddresses(pid string, seq uint64, addrs []string) []byte {
+	return []byte(pid + "\n" + strconv.FormatUint(seq, 10) + "\n" + strings.Join(addrs, "\n"))
+}
+
+// observedAddress converts the remote address of a connection to an address,
+// it returns an empty string for connections that don't have host addresses
+func observedAddress(addr net.Addr) string {
+	var a *Address
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		a = &Address{Scheme: "tcp6", Host: addr.IP.String(), Zone: addr.Zone, Port: addr.Port}
+		if addr.IP.To4() != nil {
+			a.Scheme = "tcp4"
+		}
+	case *net.UDPAddr:
+		a = &Address{Scheme: "quic", Host: addr.IP.String(), Zone: addr.Zone, Port: addr.Port}
+	default:
+		return ""
+	}
+	if a.Validate() != nil {
+		return ""
+	}
+	return a.String()
+}
@@ -0,0 +1,109 @@
+package net
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestIdentifyUnsignedKnownPeer(t *testing.T) {
+	a := newTestNetwork(t, &Peer{ID: "identify-unsigned-a"})
+	b := newKeyedPeer(t, "identify-unsigned-b")
+	if err := a.peerstore.Put(*b); err != nil {
+		t.Fatal(err)
+	}
+
+	// someone else claims to be b without being able to sign for it
+	_, err := a.identify.verify(&identifyMessage{
+		ID:        b.ID,
+		Addresses: []string{"mem:elsewhere"},
+	})
+	if err != ErrUnsignedIdentity {
+		t.Fatalf("Expected ErrUnsignedIdentity, got %v", err)
+	}
+}
+
+func TestIdentifyPublicKeyMismatch(t *testing.T) {
+	a := newTestNetwork(t, &Peer{ID: "identify-mismatch-a"})
+	b := newTestNetwork(t, newKeyedPeer(t, "identify-mismatch-b"))
+
+	// we know b by another key
+	other := newKeyedPeer(t, "identify-mismatch-c")
+	if err := a.peerstore.Put(Peer{ID: b.peer.ID, entity: other.entity}); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := b.identify.message()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.identify.verify(msg); err != ErrPublicKeyMismatch {
+		t.Fatalf("Expected ErrPublicKeyMismatch, got %v", err)
+	}
+}
+
+func TestIdentifySignedSeq(t *testing.T) {
+	a := newTestNetwork(t, &Peer{ID: "identify-seq-a"})
+	b := newTestNetwork(t, newKeyedPeer(t, "identify-seq-b"))
+
+	msg, err := b.identify.message()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.identify.verify(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	// the sequence number can't be changed without the signature breaking
+	seq := msg.Seq
+	msg.Seq++
+	if _, err := a.identify.verify(msg); err != ErrInvalidAddressSignature {
+		t.Fatalf("Expected ErrInvalidAddressSignature, got %v", err)
+	}
+
+	next, err := b.identify.message()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Seq <= seq {
+		t.Fatalf("Expected seq to increase, got %d after %d", next.Seq, seq)
+	}
+}
+
+func TestIdentifyIgnoresOlderPush(t *testing.T) {
+	a := newTestNetwork(t, &Peer{ID: "identify-push-a"})
+	b := newTestNetwork(t, newKeyedPeer(t, "identify-push-b"))
+	bid := b.peer.ID
+
+	b.setLocalAddresses([]string{"mem:identify-push-b1"})
+	older, err := b.identify.message()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.setLocalAddresses([]string{"mem:identify-push-b2"})
+	newer, err := b.identify.message()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	push := func(msg *identifyMessage) {
+		lc, rc := net.Pipe()
+		defer rc.Close()
+		go writeMessage(rc, msg)
+		if err := a.identify.handlePush(IdentifyPushProtocolID, &peerStream{lc, bid}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the newer message arrives first, and the older one is replayed
+	push(newer)
+	push(older)
+
+	peer, err := a.peerstore.Get(bid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"mem:identify-push-b2"}; !reflect.DeepEqual(peer.Addresses, expected) {
+		t.Fatalf("Expected %v, got %v", expected, peer.Addresses)
+	}
+}
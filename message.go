@@ -0,0 +1,55 @@
+package net
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+const (
+	// maxMessageSize limits the size of a single control message
+	maxMessageSize = 4096
+)
+
+var (
+	// ErrMessageTooLarge is returned when a control message exceeds
+	// maxMessageSize
+	ErrMessageTooLarge = errors.New("Message too large")
+)
+
+// writeMessage writes a single newline terminated json message
+func writeMessage(w io.Writer, msg interface{}) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// readMessage reads a single newline terminated json message.
+// It reads one byte at a time so that nothing after the message is consumed,
+// as the same stream is usually handed over to the caller once the control
+// messages have been exchanged.
+func readMessage(r io.Reader, msg interface{}) error {
+	return readMessageLimit(r, msg, maxMessageSize)
+}
+
+// readMessageLimit reads a single message of up to limit bytes
+func readMessageLimit(r io.Reader, msg interface{}, limit int) error {
+	b := make([]byte, 0, 128)
+	c := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, c); err != nil {
+			return err
+		}
+		if c[0] == '\n' {
+			break
+		}
+		if len(b) >= limit {
+			return ErrMessageTooLarge
+		}
+		b = append(b, c[0])
+	}
+	return json.Unmarshal(b, msg)
+}
@@ -6,7 +6,6 @@ import (
 	"errors"
 	"io"
 	"net"
-	"reflect"
 	"strings"
 	"sync"
 	"time"
@@ -21,6 +20,9 @@ import (
 const (
 	// SmuxProtocolID -
 	SmuxProtocolID = "/smux/v1"
+
+	// addressSweepInterval is how often expired peer addresses are removed
+	addressSweepInterval = time.Minute
 )
 
 var (
@@ -37,14 +39,34 @@ type Network interface {
 
 	// AddTransport -
 	AddTransport(transport Transport) error
+	// SetResolver replaces the resolver used to resolve dns addresses
+	SetResolver(resolver Resolver)
+	// SetAddressPolicy changes which addresses are advertised, accepted from
+	// other peers and dialed
+	SetAddressPolicy(policy AddressPolicy)
+	// SetPortMapper replaces the gateway ports are mapped on, nil disables
+	// port mapping
+	SetPortMapper(mapper PortMapper)
+	// Close stops listening, closes all sessions and removes port mappings
+	Close() error
+	// Reachability returns whether other peers can dial us directly
+	Reachability() Reachability
+	// RegisterReachabilityHandler adds a handler that is called whenever
+	// reachability changes
+	RegisterReachabilityHandler(handler func(Reachability) error) error
+	// SetAgentVersion replaces the agent version sent to other peers
+	SetAgentVersion(version string)
 	// RegisterStreamHandler adds a stream handler for a specific protocol
 	RegisterStreamHandler(protocolID string, handler func(protocolID string, rwc io.ReadWriteCloser) error) error
 
-	// GetLocalPeer retuns local peer
+	// GetLocalPeer returns a copy of the local peer
 	GetLocalPeer() *Peer
 	// PutPeer adds or updates a Peer
 	PutPeer(peer Peer) error
-	// RemovePeer a Peer
+	// PutPeerWithTTL adds or updates a Peer whose addresses expire after
+	// ttl, ie. AddressTTLGossiped for peers we heard about from others
+	PutPeerWithTTL(peer Peer, ttl time.Duration) error
+	// RemovePeer removes a Peer and closes our session with it
 	RemovePeer(id string) error
 	// GetPeer retrieves a Peer by its ID
 	GetPeer(id string) (Peer, error)
@@ -52,53 +74,161 @@ type Network interface {
 	GetPeers() []Peer
 	// RegisterPeerHandler can register multiple handlers that listen for peer updates
 	RegisterPeerHandler(func(Peer) error) error
+	// GetPeerstore returns the peerstore the network uses
+	GetPeerstore() Peerstore
+	// RegisterAddressHandler adds a handler that is called with the local
+	// peer's addresses whenever they change
+	RegisterAddressHandler(handler func(addrs []string) error) error
 }
 
 // NewNetwork -
-func NewNetwork(peer *Peer, port int) (Network, error) {
+func NewNetwork(peer *Peer, port int, opts ...Option) (Network, error) {
 	n := &network{
-		transports: []Transport{
-			NewTCPTransport(),
-		},
-		listeners: []net.Listener{},
-		peer:      peer,
-		peerstore: NewPeerstore(),
-		sessions:  map[string]*smux.Session{},
-		mux:       ms.NewMultistreamMuxer(),
-		cmux:      ms.NewMultistreamMuxer(),
+		transports: map[string]Transport{},
+		listeners:  map[string][]io.Closer{},
+		peer:       copyPeer(peer),
+		peerstore:  NewPeerstore(),
+		resolver:   newCachingResolver(NewSystemResolver(DefaultDNSTTL)),
+		policy:     DefaultAddressPolicy,
+		agent:      DefaultAgentVersion,
+		sessions:   map[string]session{},
+		mux:        ms.NewMultistreamMuxer(),
+		cmux:       ms.NewMultistreamMuxer(),
+		done:       make(chan struct{}),
+
+		discoverPortMapper: true,
+	}
+
+	for _, opt := range opts {
+		opt(n)
 	}
 
 	n.cmux.AddHandler(SmuxProtocolID, n.handleConnection)
 
-	if len(peer.Addresses) == 0 {
+	n.observed = newObservedAddrs(n)
+	n.identify = newIdentify(n)
+	n.mux.AddHandler(IdentifyProtocolID, n.identify.handleStream)
+	n.mux.AddHandler(IdentifyPushProtocolID, n.identify.handlePush)
+	n.mux.AddHandler(PingProtocolID, n.identify.handlePing)
+	n.addLocalProtocol(IdentifyProtocolID)
+	n.addLocalProtocol(IdentifyPushProtocolID)
+	n.addLocalProtocol(PingProtocolID)
+
+	n.AddTransport(NewTCPTransport())
+	n.AddTransport(NewMemoryTransport(DefaultSwitchboard))
+	n.AddTransport(NewUnixTransport(DefaultUnixSocketMode))
+	n.AddTransport(NewWebSocketTransport(WebSocketConfig{}))
+
+	// peers without keys can't prove who they are over QUIC
+	if _, err := peer.PublicKey(); err == nil {
+		qtr, err := NewQUICTransport(peer)
+		if err != nil {
+			return nil, err
+		}
+		n.AddTransport(qtr)
+	}
+
+	// addresses we discover ourselves are kept up to date as interfaces
+	// come and go
+	addrs := n.peer.Addresses
+	discovered := len(addrs) == 0
+	if discovered {
 		if port == 0 {
 			port = GetPort()
 		}
-		addrs, _ := GetAddresses(port)
-		peer.Addresses = addrs
+		addrs, _ = GetAddresses(port)
 	}
 
-	for _, addr := range n.peer.Addresses {
+	for _, addr := range addrs {
 		n.Listen(addr)
 	}
 
-	relay := &Relay{net: n}
-	n.mux.AddHandler("relay", relay.handleNewStream)
+	// we listen on all addresses, but only advertise the ones the policy
+	// allows
+	n.setLocalAddresses(addrs)
+
+	// connected peers are told whenever our addresses change
+	n.RegisterAddressHandler(func([]string) error {
+		go n.identify.Push()
+		return nil
+	})
+
+	n.watcher = newInterfaceWatcher(n, port, addrs)
+	if discovered {
+		n.watcher.Start()
+	}
+
+	relay := NewRelay(n)
+	relay.handle = n.mux.Handle
+	n.mux.AddHandler(RelayProtocolID, relay.handleNewStream)
 	n.AddTransport(relay)
+	n.addLocalProtocol(RelayProtocolID)
+
+	n.autoNAT = newAutoNAT(n)
+	n.cmux.AddHandler(autoNATDialBackProtocolID, n.autoNAT.handleDialBack)
+	n.mux.AddHandler(AutoNATProtocolID, n.autoNAT.handleStream)
+	n.addLocalProtocol(AutoNATProtocolID)
+	n.autoNAT.Start()
+	n.observed.Start()
+
+	n.autoRelay = newAutoRelay(n, relay)
+	n.autoRelay.Start()
+
+	n.portMapper = newPortMapper(n)
+	n.portMapper.Start(n.discoverPortMapper)
+
+	n.holePuncher = newHolePuncher(n)
+	n.mux.AddHandler(HolePunchProtocolID, n.holePuncher.handleStream)
+	n.addLocalProtocol(HolePunchProtocolID)
+
+	go n.sweepAddresses()
+	go n.identify.sampleLatency()
 
 	return n, nil
 }
 
+// sweepAddresses removes expired addresses from the peerstore periodically,
+// until the network is closed
+func (n *network) sweepAddresses() {
+	ticker := time.NewTicker(addressSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := n.peerstore.Sweep(); err != nil {
+				logrus.WithError(err).Warnf("Could not sweep peerstore")
+			}
+		case <-n.done:
+			return
+		}
+	}
+}
+
 // network is the simplest possible network
 type network struct {
-	sync.Mutex // used for both dialing and adding transports
-	transports []Transport
-	listeners  []net.Listener
-	peer       *Peer
-	peerstore  *peerstore
-	sessions   map[string]*smux.Session
-	mux        *ms.MultistreamMuxer
-	cmux       *ms.MultistreamMuxer
+	sync.Mutex                         // guards transports, sessions, policy and the local peer's addresses
+	transports  map[string]Transport   // by address scheme
+	listeners   map[string][]io.Closer // by address
+	peer        *Peer
+	peerstore   Peerstore
+	resolver    *cachingResolver
+	policy      AddressPolicy
+	localAddrs  []string // all local addresses, before the policy is applied
+	agent       string
+	subscribers []func([]string) error // address handlers
+	sessions    map[string]session
+	mux         *ms.MultistreamMuxer
+	cmux        *ms.MultistreamMuxer
+	identify    *identify
+	observed    *observedAddrs
+	autoNAT     *autoNAT
+	autoRelay   *autoRelay
+	holePuncher *holePuncher
+	portMapper  *portMapper
+	watcher     *interfaceWatcher
+	done        chan struct{}
+
+	discoverPortMapper bool // look for a gateway to map ports on
 }
 
 // Dial -
@@ -108,40 +238,35 @@ func (n *network) Dial(addr string) (net.Conn, error) {
 
 // DialWithContext -
 func (n *network) DialWithContext(ctx context.Context, addr string) (net.Conn, error) {
-	n.Lock()
-	defer n.Unlock()
-
 	tfields := map[string]interface{}{
 		"new":   false,
 		"error": true,
 	}
 	defer telemetry.Publish("net:connection:dialed", tfields)
 
-	ap := strings.Split(addr, "/")
-	if len(ap) < 2 {
-		return nil, errors.New("Missing protocol")
+	// target peer id
+	tpid, protocolID, err := parsePeerAddress(addr)
+	if err != nil {
+		return nil, err
 	}
 
-	tpid := ap[0] // target peer id
-	protocolID := strings.Join(ap[1:], "/")
-
 	tfields["protocol"] = protocolID
 
-	if tpid == n.GetLocalPeer().ID {
+	if tpid == n.localPeerID() {
 		return nil, errors.New("I'm not dialing myself")
 	}
 
 	logger := logrus.
-		WithField("lpid", n.GetLocalPeer().ID).
+		WithField("lpid", n.localPeerID()).
 		WithField("tpid", tpid).
 		WithField("procotolID", protocolID)
 
 	logger.Debugf("Dialing peer")
 
-	if mss, ok := n.sessions[tpid]; ok {
+	if mss, ok := n.getSession(tpid); ok {
 		if mss.IsClosed() {
 			logrus.Errorf("Session is closed, dialing again")
-			delete(n.sessions, tpid)
+			n.closeSession(tpid, mss)
 		} else {
 			logger.Infof("Found existing peer ms")
 			st, err := mss.OpenStream()
@@ -172,42 +297,75 @@ func (n *network) DialWithContext(ctx context.Context, addr string) (net.Conn, e
 	}
 
 	var c net.Conn
-	var utr Transport
+	var sess session
 	var daddr string
+	var scheme string
+	var relayed bool
 
 	tfields["new"] = true
 	dialed := false
 
+	// relays that refused to relay to this peer, there is no point in
+	// trying the peer's other addresses through them
+	failedRelays := map[string]bool{}
+
+	// dns addresses are replaced with the ones their hosts resolve to
+	addrs := resolveAddresses(ctx, n.resolver, peer.Addresses)
+	addrs = filterAddresses(addrs, n.getAddressPolicy().Dial)
+
 ConnectionLoop:
 	// try to connect to an address
-	for _, raddr := range peer.Addresses {
+	for _, raddr := range addrs {
+		for _, rpid := range getRelayRoute(raddr) {
+			if failedRelays[rpid] {
+				logger.
+					WithField("raddr", raddr).
+					WithField("rpid", rpid).
+					Debugf("Skipping address, relay already failed")
+				continue ConnectionLoop
+			}
+		}
 		iraddr := raddr + "/" + protocolID
-		// with any available protocol
-		for _, tr := range n.transports {
-			ttype := reflect.TypeOf(tr).String()
+		tr, err := n.getTransport(iraddr)
+		if err != nil {
 			logger.
+				WithError(err).
 				WithField("iraddr", iraddr).
-				WithField("tranport", ttype).
-				Infof("Dialing peer with transport")
-			var err error
+				Debugf("Skipping address")
+			continue
+		}
+		scheme = getScheme(iraddr)
+		logger.
+			WithField("iraddr", iraddr).
+			WithField("scheme", scheme).
+			Infof("Dialing peer with transport")
+		switch tr := tr.(type) {
+		case sessionTransport:
+			sess, err = tr.DialSession(ctx, iraddr, tpid)
+		case streamTransport:
+			c, err = tr.DialStream(ctx, iraddr)
+		default:
 			c, err = tr.DialContext(ctx, iraddr)
-			if err != nil {
-				logger.
-					WithError(err).
-					WithField("tranport", ttype).
-					Warnf("Dialing peer with transport FAILED")
-				continue
-			}
-			utr = tr
-			daddr = iraddr
+		}
+		if err != nil {
 			logger.
-				WithField("transport", reflect.TypeOf(utr)).
-				Infof("Dialed")
-			tfields["transport"] = ttype
-			dialed = true
-			// stop once a connection was establised
-			break ConnectionLoop
+				WithError(err).
+				WithField("scheme", scheme).
+				Warnf("Dialing peer with transport FAILED")
+			if rerr, ok := err.(*RelayError); ok {
+				failedRelays[rerr.Relay] = true
+			}
+			continue
 		}
+		daddr = iraddr
+		_, relayed = tr.(streamTransport)
+		logger.
+			WithField("scheme", scheme).
+			Infof("Dialed")
+		tfields["transport"] = scheme
+		dialed = true
+		// stop once a connection was establised
+		break ConnectionLoop
 	}
 	// else just return
 	if dialed == false {
@@ -216,25 +374,68 @@ ConnectionLoop:
 	}
 
 	logger = logger.
-		WithField("transport", reflect.TypeOf(utr)).
+		WithField("scheme", scheme).
 		WithField("daddr", daddr)
 
-	// if we connected through a relay, we can't have multiplexed streams
-	// on top of the already muliplexed streams
-	// simply return the stream and the two ends will then handle protocol
-	// selection on their own
-	// TODO This is a very ugly hack, fixing this requires refactoring Dial
-	if _, ok := utr.(*Relay); ok {
+	n.peerstore.SetDialed(tpid)
+
+	// relayed connections are already streams to the protocol we asked for,
+	// we can't have multiplexed streams on top of them
+	if relayed {
 		tfields["error"] = false
 		logger.Debugf("Dialing complete, was relayed")
+		// try to establish a direct connection for the next time we dial
+		go n.holePuncher.Punch(tpid)
 		return c, nil
 	}
 
+	// transports that multiplex on their own give us a session directly
+	if sess != nil {
+		n.putSession(tpid, sess)
+		go n.acceptStreams(sess, tpid, "outgoing")
+	} else {
+		sess, err = n.upgradeOutgoing(tpid, c)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	logger.Debugf("Opening stream")
+
+	// open new stream
+	st, err := sess.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debugf("Selecting stream protocol")
+
+	// select protocol
+	err = ms.SelectProtoOrFail(protocolID, st)
+	if err != nil {
+		logger.
+			WithError(err).
+			Infof("Could not stream select protocol")
+		return nil, err
+	}
+
+	logger.Infof("Dialing complete")
+	tfields["error"] = false
+
+	return st, nil
+}
+
+// upgradeOutgoing selects the multiplexer on a connection we dialed and
+// starts a new session with the remote peer
+func (n *network) upgradeOutgoing(tpid string, c net.Conn) (session, error) {
+	logger := logrus.
+		WithField("lpid", n.localPeerID()).
+		WithField("tpid", tpid)
+
 	logger.Debugf("Selecting session protocol")
 
 	// select the multiplexer protocol
-	err = ms.SelectProtoOrFail(SmuxProtocolID, c)
-	if err != nil {
+	if err := ms.SelectProtoOrFail(SmuxProtocolID, c); err != nil {
 		return nil, err
 	}
 
@@ -244,7 +445,7 @@ ConnectionLoop:
 	// this will allow the other party to re-use the already established
 	// connection when it needs one, instead of trying to dial a new one
 	// TODO move this to an indetify protocol or something
-	c.Write([]byte(n.GetLocalPeer().ID + "\n"))
+	c.Write([]byte(n.localPeerID() + "\n"))
 	mss, err := smux.Server(c, nil)
 	if err != nil {
 		logrus.
@@ -253,105 +454,448 @@ ConnectionLoop:
 		return nil, err
 	}
 
-	n.sessions[tpid] = mss
+	sess := &smuxSession{mss}
+	n.putSession(tpid, sess)
 
 	logger.Debugf("Accepting streams")
 
 	// start accepting streams on the muliplexed connection
-	go func(imss *smux.Session) {
-		for {
-			// wait until the other side opens a new stream
-			mssa, err := imss.AcceptStream() // TODO Handle error
-			if err != nil {
-				continue
-			}
-			// once a stream has been accepted, we should handle the selected
-			// protocol
-			telemetry.Publish("net:stream:accepted", map[string]interface{}{
-				"connection": "outgoing",
-			})
-			go n.mux.Handle(mssa)
-		}
-	}(mss)
+	go n.acceptStreams(sess, tpid, "outgoing")
 
 	// TODO Fix sleep hack, this is here to make sure the other side had time
 	// to "handleConnection()" and start "Accepting mux streams".
 	// This doesn't seem to be hapening on the examples. How come?
 	time.Sleep(500 * time.Millisecond)
 
-	logger.Debugf("Opening stream")
+	return sess, nil
+}
 
-	// open new stream
-	st, err := mss.OpenStream()
+// acceptStreams handles the streams the remote peer opens on a session until
+// the session is closed, handlers can tell which peer opened a stream with
+// streamPeerID
+func (n *network) acceptStreams(sess session, pid, connection string) {
+	for {
+		// wait until the other side opens a new stream
+		st, err := sess.AcceptStream()
+		if err != nil {
+			logrus.WithError(err).Debugf("Could not accept stream")
+			sess.Close()
+			n.closeSession(pid, sess)
+			return
+		}
+		// once a stream has been accepted, we should handle the selected
+		// protocol
+		telemetry.Publish("net:stream:accepted", map[string]interface{}{
+			"connection": connection,
+		})
+		go n.mux.Handle(&peerStream{st, pid})
+	}
+}
+
+// Listen -
+func (n *network) Listen(addr string) (net.Listener, error) {
+	tr, err := n.getTransport(addr)
 	if err != nil {
+		logrus.
+			WithField("addr", addr).
+			WithError(err).
+			Warnf("Could not listen")
 		return nil, err
 	}
 
-	logger.Debugf("Selecting stream protocol")
+	scheme := getScheme(addr)
+	if str, ok := tr.(sessionTransport); ok {
+		return nil, n.listenSessions(str, addr, scheme)
+	}
 
-	// select protocol
-	err = ms.SelectProtoOrFail(protocolID, st)
+	lst, err := tr.Listen(addr)
 	if err != nil {
-		logger.
+		logrus.
+			WithField("addr", addr).
+			WithField("scheme", scheme).
 			WithError(err).
-			Infof("Could not stream select protocol")
+			Warnf("Could not listen to transport")
 		return nil, err
 	}
+	logrus.
+		WithField("addr", addr).
+		WithField("scheme", scheme).
+		Infof("Started listening")
 
-	logger.Infof("Dialing complete")
-	tfields["error"] = false
+	n.addListener(addr, lst)
 
-	return st, nil
+	// start accepting connections
+	go func() {
+		for {
+			ss, err := lst.Accept()
+			if err != nil {
+				logrus.
+					WithField("addr", lst.Addr()).
+					WithError(err).
+					Warnf("Stopped accepting connections")
+				return
+			}
+			telemetry.Publish("net:connection:accepted", map[string]interface{}{
+				"transport": scheme,
+			})
+			go n.cmux.Handle(ss)
+		}
+	}()
+
+	return lst, nil
 }
 
-// Listen -
-func (n *network) Listen(addr string) (net.Listener, error) {
-	for _, tr := range n.transports {
-		lst, err := tr.Listen(addr)
-		ttype := reflect.TypeOf(tr).String()
-		if err != nil {
-			logrus.
-				WithField("addr", addr).
-				WithField("transport", ttype).
-				WithError(err).
-				Warnf("Could not listen to transport")
-			continue
-		}
+// listenSessions listens on transports that provide their own sessions
+func (n *network) listenSessions(str sessionTransport, addr, scheme string) error {
+	lst, err := str.ListenSessions(addr)
+	if err != nil {
 		logrus.
 			WithField("addr", addr).
-			WithField("tr", reflect.TypeOf(tr)).
-			Infof("Started listening")
-
-		// start accepting connections
-		go func(lst net.Listener, ttype string) {
-			for {
-				ss, err := lst.Accept()
-				if err != nil {
-					// TODO Log/Handle error
-					continue
-				}
-				telemetry.Publish("net:connection:accepted", map[string]interface{}{
-					"transport": ttype,
-				})
-				go n.cmux.Handle(ss)
-			}
-		}(lst, ttype)
+			WithField("scheme", scheme).
+			WithError(err).
+			Warnf("Could not listen to transport")
+		return err
 	}
-	// TODO Implement common listener?
-	return nil, nil
+	logrus.
+		WithField("addr", addr).
+		WithField("scheme", scheme).
+		Infof("Started listening")
+
+	n.addListener(addr, lst)
+
+	go func() {
+		for {
+			sess, pid, err := lst.Accept()
+			if err != nil {
+				logrus.
+					WithField("addr", lst.Addr()).
+					WithError(err).
+					Warnf("Stopped accepting sessions")
+				return
+			}
+			telemetry.Publish("net:connection:accepted", map[string]interface{}{
+				"transport": scheme,
+			})
+			n.putSession(pid, sess)
+			go n.acceptStreams(sess, pid, "incoming")
+		}
+	}()
+
+	return nil
 }
 
+// AddTransport registers a transport for the schemes it handles, replacing
+// any transports previously registered for them
 func (n *network) AddTransport(tr Transport) error {
-	n.transports = append(n.transports, tr)
+	n.Lock()
+	defer n.Unlock()
+	for _, scheme := range tr.Schemes() {
+		n.transports[scheme] = tr
+	}
+	return nil
+}
+
+// SetResolver replaces the resolver used to resolve dns addresses
+func (n *network) SetResolver(resolver Resolver) {
+	n.resolver.setResolver(resolver)
+}
+
+// SetAddressPolicy changes which addresses are advertised, accepted from
+// other peers and dialed, the local peer's addresses are filtered again
+func (n *network) SetAddressPolicy(policy AddressPolicy) {
+	n.Lock()
+	n.policy = policy
+	n.Unlock()
+	n.setLocalAddresses(n.getLocalAddresses())
+}
+
+// SetPortMapper replaces the gateway ports are mapped on, nil disables port
+// mapping
+func (n *network) SetPortMapper(mapper PortMapper) {
+	n.portMapper.SetMapper(mapper)
+}
+
+// Reachability returns whether other peers can dial us directly
+func (n *network) Reachability() Reachability {
+	return n.autoNAT.Status()
+}
+
+// RegisterReachabilityHandler adds a handler that is called whenever
+// reachability changes
+func (n *network) RegisterReachabilityHandler(handler func(Reachability) error) error {
+	n.autoNAT.RegisterHandler(handler)
+	return nil
+}
+
+// Close stops listening, closes all sessions and removes port mappings
+func (n *network) Close() error {
+	n.portMapper.Close()
+	n.autoRelay.Close()
+
+	n.watcher.Close()
+
+	n.Lock()
+	select {
+	case <-n.done:
+	default:
+		close(n.done)
+	}
+	listeners := n.listeners
+	sessions := n.sessions
+	n.listeners = map[string][]io.Closer{}
+	n.sessions = map[string]session{}
+	n.Unlock()
+
+	for _, lsts := range listeners {
+		for _, lst := range lsts {
+			lst.Close()
+		}
+	}
+
+	for _, sess := range sessions {
+		sess.Close()
+	}
+
 	return nil
 }
 
+func (n *network) addListener(addr string, lst io.Closer) {
+	n.Lock()
+	n.listeners[addr] = append(n.listeners[addr], lst)
+	n.Unlock()
+}
+
+// removeListener stops listening on an address
+func (n *network) removeListener(addr string) {
+	n.Lock()
+	lsts := n.listeners[addr]
+	delete(n.listeners, addr)
+	n.Unlock()
+
+	for _, lst := range lsts {
+		lst.Close()
+	}
+}
+
+// getSessions returns the sessions with all peers we are connected to
+func (n *network) getSessions() map[string]session {
+	n.Lock()
+	defer n.Unlock()
+	sessions := map[string]session{}
+	for pid, sess := range n.sessions {
+		sessions[pid] = sess
+	}
+	return sessions
+}
+
+func (n *network) getAddressPolicy() AddressPolicy {
+	n.Lock()
+	defer n.Unlock()
+	return n.policy
+}
+
+// getTransport returns the transport for an address' scheme
+func (n *network) getTransport(addr string) (Transport, error) {
+	n.Lock()
+	tr, ok := n.transports[getScheme(addr)]
+	n.Unlock()
+	if !ok || tr.CanDial(addr) == false {
+		return nil, ErrTransportNotSupported
+	}
+	return tr, nil
+}
+
+func (n *network) getSession(pid string) (session, bool) {
+	n.Lock()
+	defer n.Unlock()
+	sess, ok := n.sessions[pid]
+	return sess, ok
+}
+
+// putSession stores a new session with a peer, marks the peer as connected
+// and identifies it
+func (n *network) putSession(pid string, sess session) {
+	n.Lock()
+	n.sessions[pid] = sess
+	n.Unlock()
+
+	// peers that connect to us might not be known yet
+	if _, err := n.peerstore.Get(pid); err != nil {
+		n.peerstore.Put(Peer{ID: pid})
+	}
+	n.peerstore.SetConnected(pid, true)
+
+	go func() {
+		if err := n.identify.Identify(pid, sess); err != nil {
+			logrus.
+				WithError(err).
+				WithField("pid", pid).
+				Debugf("Could not identify peer")
+		}
+	}()
+}
+
+func (n *network) removeSession(pid string) {
+	n.Lock()
+	delete(n.sessions, pid)
+	n.Unlock()
+}
+
+// closeSession removes a session that was closed and marks the peer as
+// disconnected, unless the session has already been replaced
+func (n *network) closeSession(pid string, sess session) {
+	n.Lock()
+	current := n.sessions[pid] == sess
+	if current {
+		delete(n.sessions, pid)
+	}
+	n.Unlock()
+
+	if current {
+		n.peerstore.SetConnected(pid, false)
+	}
+}
+
 // RegisterStreamHandler for incoming streams
 func (n *network) RegisterStreamHandler(protocolID string, handler func(proto string, stream io.ReadWriteCloser) error) error {
 	n.mux.AddHandler(protocolID, handler)
+	n.addLocalProtocol(protocolID)
+	return nil
+}
+
+// SetAgentVersion replaces the agent version sent to other peers
+func (n *network) SetAgentVersion(version string) {
+	n.Lock()
+	n.agent = version
+	n.Unlock()
+}
+
+func (n *network) getAgentVersion() string {
+	n.Lock()
+	defer n.Unlock()
+	return n.agent
+}
+
+// getLocalProtocols returns the protocols of the local peer, which are the
+// ones registered in the stream muxer
+func (n *network) getLocalProtocols() []string {
+	n.Lock()
+	defer n.Unlock()
+	protocols := make([]string, len(n.peer.Protocols))
+	copy(protocols, n.peer.Protocols)
+	return protocols
+}
+
+// addLocalProtocol advertises a protocol on the local peer
+func (n *network) addLocalProtocol(protocolID string) {
+	n.Lock()
+	defer n.Unlock()
+	if n.peer.SupportsProtocol(protocolID) {
+		return
+	}
+	n.peer.Protocols = append(n.peer.Protocols, protocolID)
+}
+
+// setLocalAddresses replaces the local peer's addresses, addresses the
+// policy does not allow us to advertise are left out
+func (n *network) setLocalAddresses(addrs []string) {
+	n.Lock()
+	previous := n.peer.Addresses
+	n.localAddrs = addrs
+	n.peer.Addresses = filterAddresses(addrs, n.policy.Advertise)
+	current := n.peer.Addresses
+	n.Unlock()
+
+	n.notifyAddresses(previous, current)
+}
+
+// updateLocalAddresses removes and adds local addresses, it returns the
+// addresses that were actually added as the rest already existed
+func (n *network) updateLocalAddresses(remove, add []string) []string {
+	n.Lock()
+
+	removed := map[string]bool{}
+	for _, addr := range remove {
+		removed[addr] = true
+	}
+
+	addrs := []string{}
+	existing := map[string]bool{}
+	for _, addr := range n.localAddrs {
+		if removed[addr] {
+			continue
+		}
+		addrs = append(addrs, addr)
+		existing[addr] = true
+	}
+
+	added := []string{}
+	for _, addr := range add {
+		if existing[addr] {
+			continue
+		}
+		addrs = append(addrs, addr)
+		added = append(added, addr)
+		existing[addr] = true
+	}
+
+	previous := n.peer.Addresses
+	n.localAddrs = addrs
+	n.peer.Addresses = filterAddresses(addrs, n.policy.Advertise)
+	current := n.peer.Addresses
+	n.Unlock()
+
+	n.notifyAddresses(previous, current)
+	return added
+}
+
+// notifyAddresses calls the address handlers if the advertised addresses
+// have changed
+func (n *network) notifyAddresses(previous, current []string) {
+	if equalAddresses(previous, current) {
+		return
+	}
+
+	n.Lock()
+	handlers := make([]func([]string) error, len(n.subscribers))
+	copy(handlers, n.subscribers)
+	n.Unlock()
+
+	for _, handler := range handlers {
+		addrs := make([]string, len(current))
+		copy(addrs, current)
+		handler(addrs)
+	}
+}
+
+// RegisterAddressHandler adds a handler that is called with the local peer's
+// addresses whenever they change
+func (n *network) RegisterAddressHandler(handler func(addrs []string) error) error {
+	n.Lock()
+	n.subscribers = append(n.subscribers, handler)
+	n.Unlock()
 	return nil
 }
 
+// getLocalAddresses returns all local addresses, including the ones that are
+// not advertised
+func (n *network) getLocalAddresses() []string {
+	n.Lock()
+	defer n.Unlock()
+	addrs := make([]string, len(n.localAddrs))
+	copy(addrs, n.localAddrs)
+	return addrs
+}
+
+// getAdvertisedAddresses returns the local peer's addresses
+func (n *network) getAdvertisedAddresses() []string {
+	n.Lock()
+	defer n.Unlock()
+	addrs := make([]string, len(n.peer.Addresses))
+	copy(addrs, n.peer.Addresses)
+	return addrs
+}
+
 func (n *network) handleConnection(proto string, rwc io.ReadWriteCloser) error {
 	// move to an identity protocol
 	reader := bufio.NewReader(rwc)
@@ -362,7 +906,7 @@ func (n *network) handleConnection(proto string, rwc io.ReadWriteCloser) error {
 
 	pid = strings.Trim(pid, "\n")
 	logrus.
-		WithField("lpid", n.GetLocalPeer().ID).
+		WithField("lpid", n.localPeerID()).
 		WithField("rpid", pid).
 		Debugf("Got remote peer id")
 
@@ -374,41 +918,63 @@ func (n *network) handleConnection(proto string, rwc io.ReadWriteCloser) error {
 		return err
 	}
 
-	n.sessions[pid] = msc
+	sess := &smuxSession{msc}
+	n.putSession(pid, sess)
 
 	logrus.Infof("Accepting mux streams")
-	go func(imsc *smux.Session) {
-		for {
-			mss, err := imsc.AcceptStream()
-			if err != nil {
-				logrus.WithError(err).Warnf("Could not accept stream")
-				imsc.Close()
-				return
-			}
-			logrus.Infof("Accepted mux stream")
-			telemetry.Publish("net:stream:accepted", map[string]interface{}{
-				"connection": "incoming",
-			})
-			go n.mux.Handle(mss)
-		}
-	}(msc)
+	go n.acceptStreams(sess, pid, "incoming")
 
 	return nil
 }
 
-// PutPeer adds or updates a Peer
+// PutPeer adds or updates a Peer, addresses the policy does not accept are
+// left out
 func (n *network) PutPeer(peer Peer) error {
+	peer.Addresses = filterAddresses(peer.Addresses, n.getAddressPolicy().Accept)
 	return n.peerstore.Put(peer)
 }
 
-// RemovePeer a Peer
+// PutPeerWithTTL adds or updates a Peer whose addresses expire after ttl
+func (n *network) PutPeerWithTTL(peer Peer, ttl time.Duration) error {
+	peer.Addresses = filterAddresses(peer.Addresses, n.getAddressPolicy().Accept)
+	return n.peerstore.PutWithTTL(peer, ttl)
+}
+
+// RemovePeer removes a Peer and closes our session with it
 func (n *network) RemovePeer(id string) error {
+	if sess, ok := n.getSession(id); ok {
+		n.removeSession(id)
+		sess.Close()
+	}
 	return n.peerstore.Remove(id)
 }
 
-// GetLocalPeer retrieves the local peer
+// GetLocalPeer retrieves a copy of the local peer, as its addresses and
+// protocols change while the network runs
 func (n *network) GetLocalPeer() *Peer {
-	return n.peer
+	n.Lock()
+	defer n.Unlock()
+	return copyPeer(n.peer)
+}
+
+// localPeerID returns the id of the local peer, which never changes and can
+// be read without locking
+func (n *network) localPeerID() string {
+	return n.peer.ID
+}
+
+// copyPeer returns a copy of a peer that shares nothing it can modify
+func copyPeer(peer *Peer) *Peer {
+	cp := *peer
+	cp.Addresses = append([]string{}, peer.Addresses...)
+	cp.Protocols = append([]string{}, peer.Protocols...)
+	if peer.Tags != nil {
+		cp.Tags = map[string]string{}
+		for key, value := range peer.Tags {
+			cp.Tags[key] = value
+		}
+	}
+	return &cp
 }
 
 // GetPeer retrieves a Peer by its ID
@@ -425,3 +991,8 @@ func (n *network) GetPeers() []Peer {
 func (n *network) RegisterPeerHandler(handler func(Peer) error) error {
 	return n.peerstore.RegisterPeerHandler(handler)
 }
+
+// GetPeerstore returns the peerstore the network uses
+func (n *network) GetPeerstore() Peerstore {
+	return n.peerstore
+}
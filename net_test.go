@@ -0,0 +1,78 @@
+package net
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRemovePeer(t *testing.T) {
+	a := newTestNetwork(t, &Peer{
+		ID:        "remove-a",
+		Addresses: []string{"mem:remove-a"},
+	})
+	b := newTestNetwork(t, &Peer{
+		ID:        "remove-b",
+		Addresses: []string{"mem:remove-b"},
+	})
+	connectDirect(t, a, b)
+	echo(t, a, "remove-b/echo")
+
+	// wait for b to be identified, so that it is not added back afterwards
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if peer, err := a.peerstore.Get("remove-b"); err == nil && peer.SupportsProtocol(IdentifyProtocolID) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Peer was not identified")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sess, ok := a.getSession("remove-b")
+	if !ok {
+		t.Fatal("Expected a session")
+	}
+
+	removed := make(chan Peer, 10)
+	a.peerstore.RegisterPeerHandler(func(peer Peer) error {
+		removed <- peer
+		return nil
+	})
+
+	if err := a.RemovePeer("remove-b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !sess.IsClosed() {
+		t.Fatal("Expected the session to be closed")
+	}
+	if _, ok := a.getSession("remove-b"); ok {
+		t.Fatal("Expected the session to be removed")
+	}
+
+	// updates from before the removal might still be queued
+	for found := false; !found; {
+		select {
+		case peer := <-removed:
+			found = peer.Removed
+			if found && (peer.ID != "remove-b" || peer.Connected) {
+				t.Fatalf("Expected the removed peer, got %+v", peer)
+			}
+		default:
+			t.Fatal("Expected handlers to be notified")
+		}
+	}
+
+	// we don't know how to reach the peer anymore
+	if _, err := a.Dial("remove-b/echo"); err == nil {
+		t.Fatal("Expected the removed peer not to be dialed")
+	}
+	if _, err := a.peerstore.Get("remove-b"); err != ErrorNotFound {
+		t.Fatalf("Expected ErrorNotFound, got %v", err)
+	}
+
+	if err := a.RemovePeer("remove-b"); err != ErrorNotFound {
+		t.Fatalf("Expected ErrorNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,219 @@
+package net
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// observedAddressQuorum is how many different networks peers need to
+	// have observed us from on the same IP before we advertise it
+	observedAddressQuorum = 3
+	// observerSubnetIPv4 and observerSubnetIPv6 are the sizes of the
+	// networks observers are grouped by
+	observerSubnetIPv4 = 24
+	observerSubnetIPv6 = 48
+	// observedAddressTTL is how long an observation counts for
+	observedAddressTTL = 30 * time.Minute
+	// observedAddressInterval is how often expired observations are removed
+	observedAddressInterval = time.Minute
+)
+
+// observedAddrs discovers our external addresses from the ones other peers
+// see us connecting from.
+//
+// Ports we dial from are usually ephemeral, and even incoming connections
+// can be translated to different ports by NATs, so observations are grouped
+// by scheme and IP. Once enough peers agree on an IP, it is advertised along
+// with the ports of our private addresses of the same scheme, which is where
+// NATs that preserve ports will forward connections to.
+//
+// Peer ids are free to make, so observers are counted by the network they
+// connect from rather than by id, and a single host can't make up a quorum.
+type observedAddrs struct {
+	mutex        sync.Mutex
+	net          *network
+	observations map[string]map[string]time.Time // observer subnets by scheme and ip
+	addrs        []string
+	update       chan struct{}
+}
+
+func newObservedAddrs(n *network) *observedAddrs {
+	return &observedAddrs{
+		net:          n,
+		observations: map[string]map[string]time.Time{},
+		update:       make(chan struct{}, 1),
+	}
+}
+
+// Start promotes observations whenever they change, and periodically removes
+// the expired ones
+func (o *observedAddrs) Start() {
+	go func() {
+		ticker := time.NewTicker(observedAddressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-o.update:
+			case <-o.net.done:
+				return
+			}
+			o.refresh()
+		}
+	}()
+}
+
+func (o *observedAddrs) trigger() {
+	select {
+	case o.update <- struct{}{}:
+	default:
+	}
+}
+
+// Record adds the address a peer connecting from the observer ip observed us
+// on, only public addresses are recorded as we already know our private ones
+func (o *observedAddrs) Record(observerIP net.IP, addr string) {
+	observer := observerSubnet(observerIP)
+	if observer == "" || ClassifyAddress(addr) != AddressClassPublic {
+		return
+	}
+
+	a, err := ParseAddress(addr)
+	if err != nil {
+		return
+	}
+
+	switch a.Scheme {
+	case "tcp4", "tcp6", "quic":
+	default:
+		return
+	}
+
+	key := (&Address{Scheme: a.Scheme, Host: a.Host, Zone: a.Zone}).String()
+
+	o.mutex.Lock()
+	observers, ok := o.observations[key]
+	if !ok {
+		observers = map[string]time.Time{}
+		o.observations[key] = observers
+	}
+	_, existed := observers[observer]
+	observers[observer] = time.Now().Add(observedAddressTTL)
+	o.mutex.Unlock()
+
+	if !existed {
+		o.trigger()
+	}
+}
+
+func (o *observedAddrs) refresh() {
+	now := time.Now()
+
+	o.mutex.Lock()
+	added := map[string]bool{}
+	for _, addr := range o.addrs {
+		added[addr] = true
+	}
+
+	confirmed := []*Address{}
+	for key, observers := range o.observations {
+		for observer, expires := range observers {
+			if !now.Before(expires) {
+				delete(observers, observer)
+			}
+		}
+		if len(observers) == 0 {
+			delete(o.observations, key)
+			continue
+		}
+		if len(observers) < observedAddressQuorum {
+			continue
+		}
+		if a, err := ParseAddress(key); err == nil {
+			confirmed = append(confirmed, a)
+		}
+	}
+	o.mutex.Unlock()
+
+	// the ports we are listening on, by scheme
+	ports := map[string][]int{}
+	for _, addr := range o.net.getLocalAddresses() {
+		if added[addr] || ClassifyAddress(addr) == AddressClassPublic {
+			continue
+		}
+		a, err := ParseAddress(addr)
+		if err != nil || a.Port == 0 {
+			continue
+		}
+		ports[a.Scheme] = append(ports[a.Scheme], a.Port)
+	}
+
+	addrs := []string{}
+	for _, a := range confirmed {
+		for _, port := range ports[a.Scheme] {
+			a.Port = port
+			addrs = append(addrs, a.String())
+		}
+	}
+	sort.Strings(addrs)
+
+	o.mutex.Lock()
+	previous := o.addrs
+	o.addrs = o.net.updateLocalAddresses(previous, addrs)
+	current := o.addrs
+	o.mutex.Unlock()
+
+	if equalAddresses(previous, current) {
+		return
+	}
+
+	logrus.
+		WithField("addrs", current).
+		Infof("Updated observed addresses")
+
+	// new public addresses need to be checked
+	o.net.autoNAT.trigger()
+}
+
+// observerSubnet returns the network an observer's ip belongs to, or an empty
+// string if there is no ip, ie. for relayed sessions
+func observerSubnet(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{
+			IP:   ip4.Mask(net.CIDRMask(observerSubnetIPv4, 32)),
+			Mask: net.CIDRMask(observerSubnetIPv4, 32),
+		}).String()
+	}
+	if ip16 := ip.To16(); ip16 != nil {
+		return (&net.IPNet{
+			IP:   ip16.Mask(net.CIDRMask(observerSubnetIPv6, 128)),
+			Mask: net.CIDRMask(observerSubnetIPv6, 128),
+		}).String()
+	}
+	return ""
+}
+
+// equalAddresses checks if two sets of addresses are the same
+func equalAddresses(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	in := map[string]bool{}
+	for _, addr := range a {
+		in[addr] = true
+	}
+	for _, addr := range b {
+		if !in[addr] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,75 @@
+package net
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+// observedAddresses returns the addresses promoted so far, refreshes can also
+// happen in the background
+func observedAddresses(o *observedAddrs) []string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.addrs
+}
+
+func TestObserverSubnet(t *testing.T) {
+	for ip, expected := range map[string]string{
+		"1.2.3.4":              "1.2.3.0/24",
+		"1.2.3.250":            "1.2.3.0/24",
+		"::ffff:1.2.3.4":       "1.2.3.0/24",
+		"2001:db8:1:2::1":      "2001:db8:1::/48",
+		"2001:db8:1:ffff::abc": "2001:db8:1::/48",
+	} {
+		if s := observerSubnet(net.ParseIP(ip)); s != expected {
+			t.Fatalf("Expected %s for %s, got %s", expected, ip, s)
+		}
+	}
+
+	if s := observerSubnet(nil); s != "" {
+		t.Fatalf("Expected no subnet without an ip, got %s", s)
+	}
+}
+
+func TestObservedAddrsQuorum(t *testing.T) {
+	n := newTestNetwork(t, &Peer{
+		ID:        "observed-a",
+		Addresses: []string{"tcp4:192.168.1.2:21600"},
+	})
+	o := n.observed
+
+	observed := "tcp4:8.8.8.8:40000"
+	expected := []string{"tcp4:8.8.8.8:21600"}
+
+	// many hosts of the same networks don't make up a quorum
+	for _, ip := range []string{"1.2.3.4", "1.2.3.5", "1.2.3.6", "2001:db8:1::1", "2001:db8:1:2::1", "2001:db8:1:3::1"} {
+		o.Record(net.ParseIP(ip), observed)
+	}
+	// and neither do peers we can't tell the ip of
+	o.Record(nil, observed)
+	o.refresh()
+	if addrs := observedAddresses(o); len(addrs) != 0 {
+		t.Fatalf("Expected no observed addresses, got %v", addrs)
+	}
+
+	o.Record(net.ParseIP("5.6.7.8"), observed)
+	o.refresh()
+	if addrs := observedAddresses(o); !reflect.DeepEqual(addrs, expected) {
+		t.Fatalf("Expected %v, got %v", expected, addrs)
+	}
+}
+
+func TestObservedAddrsPrivate(t *testing.T) {
+	n := newTestNetwork(t, &Peer{ID: "observed-b"})
+	o := n.observed
+
+	for _, ip := range []string{"1.2.3.4", "5.6.7.8", "9.10.11.12"} {
+		o.Record(net.ParseIP(ip), "tcp4:192.168.1.2:40000")
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if len(o.observations) != 0 {
+		t.Fatalf("Expected private addresses not to be recorded, got %v", o.observations)
+	}
+}
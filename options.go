@@ -0,0 +1,48 @@
+package net
+
+import (
+	"time"
+)
+
+// Option configures a network when it is created
+type Option func(*network)
+
+// WithPeerstore makes the network use the given peerstore instead of an
+// in-memory one, ie. to keep peers across restarts or share them between
+// networks
+func WithPeerstore(ps Peerstore) Option {
+	return func(n *network) {
+		n.peerstore = ps
+	}
+}
+
+// WithPortMapperDiscovery sets whether the network looks for a NAT-PMP or
+// UPnP gateway to map ports on, it does by default. Gateways can still be
+// set with SetPortMapper.
+func WithPortMapperDiscovery(discover bool) Option {
+	return func(n *network) {
+		n.discoverPortMapper = discover
+	}
+}
+
+// WithDNSTTL sets how long the answers of the system resolver are cached
+// for, as it does not report the TTLs of the records it looks up. Zero
+// disables caching. Resolvers set with SetResolver report their own TTLs.
+func WithDNSTTL(ttl time.Duration) Option {
+	return func(n *network) {
+		n.resolver = newCachingResolver(NewSystemResolver(ttl))
+	}
+}
+
+// WithPrivateNetwork sets whether the network's peers share a private
+// network, in which case it uses PrivateNetworkAddressPolicy and accepts the
+// link-local, private and CGNAT addresses of other peers.
+// The policy can still be changed with SetAddressPolicy.
+func WithPrivateNetwork(private bool) Option {
+	return func(n *network) {
+		n.policy = DefaultAddressPolicy
+		if private {
+			n.policy = PrivateNetworkAddressPolicy
+		}
+	}
+}
@@ -5,21 +5,55 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"time"
 
 	"golang.org/x/crypto/openpgp"
 )
 
 var (
-	ErrorCannotSign = errors.New("Peer cannot sign")
+	ErrorCannotSign  = errors.New("Peer cannot sign")
+	ErrorNoPublicKey = errors.New("Peer has no public key")
+	ErrorIDMismatch  = errors.New("Peer id does not match its public key")
 )
 
 type Peer struct {
 	ID        string   `json:"id"`
 	Addresses []string `json:"addresses"`
-	entity    *openpgp.Entity
+	Protocols []string `json:"protocols,omitempty"`
+	// AgentVersion is the software the peer runs, as it told us
+	AgentVersion string `json:"agentVersion,omitempty"`
+	// FirstSeen is when the peer was added to the peerstore
+	FirstSeen time.Time `json:"firstSeen"`
+	// LastSeen is when we last connected or disconnected from the peer
+	LastSeen time.Time `json:"lastSeen"`
+	// LastDialed is when we last dialed the peer successfully
+	LastDialed time.Time `json:"lastDialed"`
+	// Latency is a moving average of the round trip times to the peer
+	Latency time.Duration `json:"latency,omitempty"`
+	// Tags are the metadata the application has set for the peer
+	Tags map[string]string `json:"-"`
+	// Connected is whether we have a session with the peer right now
+	Connected bool `json:"-"`
+	// Removed is set on the peer handlers are given when it is removed
+	Removed bool `json:"-"`
+	entity  *openpgp.Entity
+}
+
+// SupportsProtocol checks if the peer has advertised a protocol
+func (p *Peer) SupportsProtocol(protocolID string) bool {
+	for _, pid := range p.Protocols {
+		if pid == protocolID {
+			return true
+		}
+	}
+	return false
 }
 
 func (p *Peer) Verify(target, signature []byte) (bool, error) {
+	if p.entity == nil {
+		return false, ErrorNoPublicKey
+	}
+
 	keyring := openpgp.EntityList{
 		p.entity,
 	}
@@ -38,7 +72,7 @@ func (p *Peer) Verify(target, signature []byte) (bool, error) {
 }
 
 func (p *Peer) Sign(data []byte) ([]byte, error) {
-	if p.entity.PrivateKey == nil {
+	if p.entity == nil || p.entity.PrivateKey == nil {
 		return nil, ErrorCannotSign
 	}
 
@@ -55,6 +89,44 @@ func (p *Peer) Sign(data []byte) ([]byte, error) {
 	return out.Bytes(), nil
 }
 
+// PublicKey returns the peer's serialized public key
+func (p *Peer) PublicKey() ([]byte, error) {
+	if p.entity == nil {
+		return nil, ErrorNoPublicKey
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := p.entity.Serialize(out); err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// NewPeerFromPublicKey creates a peer from a serialized public key, the
+// peer's id must match the key's fingerprint
+func NewPeerFromPublicKey(id string, key []byte) (*Peer, error) {
+	els, err := openpgp.ReadKeyRing(bytes.NewBuffer(key))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(els) == 0 {
+		return nil, ErrorNoPublicKey
+	}
+
+	peer, err := NewPeer(els[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if peer.ID != id {
+		return nil, ErrorIDMismatch
+	}
+
+	return peer, nil
+}
+
 func NewPeerFromArmorFile(path string) (*Peer, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -3,29 +3,101 @@ package net
 import (
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// latencySmoothing is the weight new round trip times have in the
+	// peers' latency averages
+	latencySmoothing = 0.1
+)
+
 var (
 	// ErrorNotFound is returned when peer does not exist in PeerStore
 	ErrorNotFound = errors.New("Peer not found")
+	// ErrorMetadataNotFound is returned when a peer has no metadata for a key
+	ErrorMetadataNotFound = errors.New("Metadata not found")
 )
 
+// Peerstore keeps track of the peers we know about
+type Peerstore interface {
+	// Put adds a peer or merges it with the one we already have, its
+	// addresses are kept until they are replaced or the peer is removed
+	Put(peer Peer) error
+	// PutWithTTL is like Put, but the peer's addresses expire after ttl
+	// unless they are added again
+	PutWithTTL(peer Peer, ttl time.Duration) error
+	// SetAddresses replaces a peer's addresses instead of merging them,
+	// except for the ones that were added with Put
+	SetAddresses(id string, addrs []string, ttl time.Duration) error
+	// Sweep removes the addresses that have expired
+	Sweep() error
+	// Get retrieves a peer by its id
+	Get(id string) (Peer, error)
+	// Remove removes a peer and its metadata, handlers are given the removed
+	// peer with Removed set
+	Remove(id string) error
+	// Peers returns all peers
+	Peers() []Peer
+	// RegisterPeerHandler adds a handler that is called whenever a peer is
+	// added or updated
+	RegisterPeerHandler(handler func(Peer) error) error
+	// SetConnected marks a peer as connected or disconnected, and as seen
+	SetConnected(id string, connected bool) error
+	// SetDialed records that we dialed a peer successfully
+	SetDialed(id string) error
+	// SetProtocols replaces the protocols a peer supports
+	SetProtocols(id string, protocols []string) error
+	// UpdateIdentified adds what a peer told us about itself as a single
+	// change, its protocols and addresses replace the ones we had as with
+	// SetProtocols and SetAddresses
+	UpdateIdentified(peer Peer, ttl time.Duration) error
+	// RecordLatency adds a round trip time to the peer's latency average
+	RecordLatency(id string, rtt time.Duration) error
+	// SetMetadata stores a value for a peer, which is one of its tags
+	SetMetadata(id, key, value string) error
+	// GetMetadata retrieves a value stored for a peer
+	GetMetadata(id, key string) (string, error)
+	// PeersWithProtocol returns the peers that support a protocol
+	PeersWithProtocol(protocolID string) []Peer
+	// PeersWithTag returns the peers that have the metadata key set to value
+	PeersWithTag(key, value string) []Peer
+}
+
 // peerstore is thread safe in-memory implementation of Peerstore
 type peerstore struct {
 	mutex    sync.RWMutex
 	peers    map[string]Peer
+	ttls     map[string]map[string]addressTTL // by peer id and address
+	metadata map[string]map[string]string     // by peer id and key
 	handlers []func(Peer) error
 }
 
 func (ps *peerstore) Put(peer Peer) error {
+	return ps.PutWithTTL(peer, AddressTTLPermanent)
+}
+
+// PutWithTTL -
+func (ps *peerstore) PutWithTTL(peer Peer, ttl time.Duration) error {
+	ps.put(peer, ttl)
+	ps.notifyPut(peer)
+	return nil
+}
+
+// put merges the peer with the one we already have and returns the result
+func (ps *peerstore) put(peer Peer, ttl time.Duration) Peer {
 	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	return ps.merge(peer, ttl)
+}
+
+// merge is put without locking
+func (ps *peerstore) merge(peer Peer, ttl time.Duration) Peer {
+	ps.extendTTLs(peer.ID, peer.Addresses, newAddressTTL(ttl))
 	if ep, ok := ps.peers[peer.ID]; ok {
 		for _, addr := range peer.Addresses {
-			if privateAddress(addr) {
-				continue
-			}
 			exists := false
 			for _, eaddr := range ep.Addresses {
 				if eaddr == addr {
@@ -37,25 +109,311 @@ func (ps *peerstore) Put(peer Peer) error {
 				ep.Addresses = append(ep.Addresses, addr)
 			}
 		}
+		for _, pid := range peer.Protocols {
+			if !ep.SupportsProtocol(pid) {
+				ep.Protocols = append(ep.Protocols, pid)
+			}
+		}
+		if peer.AgentVersion != "" {
+			ep.AgentVersion = peer.AgentVersion
+		}
+		if ep.entity == nil {
+			ep.entity = peer.entity
+		}
 		ps.peers[peer.ID] = ep
 	} else {
+		peer.FirstSeen = time.Now()
+		peer.Tags = nil
 		ps.peers[peer.ID] = peer
 	}
 	logrus.WithField("pid", peer.ID).WithField("addrs", ps.peers[peer.ID].Addresses).Infof("Updated peer info")
-	ps.mutex.Unlock()
+	return ps.peers[peer.ID]
+}
+
+// SetAddresses -
+func (ps *peerstore) SetAddresses(id string, addrs []string, ttl time.Duration) error {
+	peer, err := ps.setAddresses(id, addrs, ttl)
+	if err != nil {
+		return err
+	}
 	ps.notifyPut(peer)
 	return nil
 }
 
+func (ps *peerstore) setAddresses(id string, addrs []string, ttl time.Duration) (Peer, error) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	peer, ok := ps.peers[id]
+	if !ok {
+		return Peer{}, ErrorNotFound
+	}
+	return ps.replaceAddresses(peer, addrs, ttl), nil
+}
+
+// replaceAddresses is setAddresses without locking
+func (ps *peerstore) replaceAddresses(peer Peer, addrs []string, ttl time.Duration) Peer {
+	id := peer.ID
+	// permanent addresses were added on purpose, ie. the dns addresses of
+	// bootstrap peers, and are kept even if the peer does not know them
+	ttls := map[string]addressTTL{}
+	naddrs := []string{}
+	for _, addr := range peer.Addresses {
+		if ps.ttls[id][addr].permanent() {
+			naddrs = append(naddrs, addr)
+			ttls[addr] = addressTTL{}
+		}
+	}
+	for _, addr := range addrs {
+		if _, ok := ttls[addr]; ok {
+			continue
+		}
+		naddrs = append(naddrs, addr)
+		ttls[addr] = newAddressTTL(ttl)
+	}
+	peer.Addresses = naddrs
+	ps.peers[id] = peer
+	ps.ttls[id] = ttls
+	return peer
+}
+
+// extendTTLs sets the ttl of addresses, unless they already had a longer one
+func (ps *peerstore) extendTTLs(id string, addrs []string, ttl addressTTL) {
+	ttls, ok := ps.ttls[id]
+	if !ok {
+		ttls = map[string]addressTTL{}
+		ps.ttls[id] = ttls
+	}
+	for _, addr := range addrs {
+		if ettl, ok := ttls[addr]; ok && !ttl.outlives(ettl) {
+			continue
+		}
+		ttls[addr] = ttl
+	}
+}
+
+// Sweep -
+func (ps *peerstore) Sweep() error {
+	for _, peer := range ps.sweep() {
+		ps.notifyPut(peer)
+	}
+	return nil
+}
+
+// sweep removes expired addresses and returns the peers that had any
+func (ps *peerstore) sweep() []Peer {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	now := time.Now()
+	swept := []Peer{}
+	for id, peer := range ps.peers {
+		ttls := ps.ttls[id]
+		addrs := []string{}
+		for _, addr := range peer.Addresses {
+			if ttls[addr].expired(now) {
+				delete(ttls, addr)
+				continue
+			}
+			addrs = append(addrs, addr)
+		}
+		if len(addrs) == len(peer.Addresses) {
+			continue
+		}
+		logrus.
+			WithField("pid", id).
+			WithField("expired", len(peer.Addresses)-len(addrs)).
+			Debugf("Removed expired addresses")
+		peer.Addresses = addrs
+		ps.peers[id] = peer
+		swept = append(swept, peer)
+	}
+	return swept
+}
+
+// view returns a copy of the peer as it is given out, without the addresses
+// that have expired but have not been swept yet, and with its tags
+func (ps *peerstore) view(peer Peer, now time.Time) Peer {
+	ttls := ps.ttls[peer.ID]
+	addrs := []string{}
+	for _, addr := range peer.Addresses {
+		if !ttls[addr].expired(now) {
+			addrs = append(addrs, addr)
+		}
+	}
+	peer.Addresses = addrs
+	peer.Tags = map[string]string{}
+	for key, value := range ps.metadata[peer.ID] {
+		peer.Tags[key] = value
+	}
+	return peer
+}
+
+// getTTLs returns copies of the ttls of a peer's addresses
+func (ps *peerstore) getTTLs(id string) map[string]addressTTL {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+	ttls := map[string]addressTTL{}
+	for addr, ttl := range ps.ttls[id] {
+		ttls[addr] = ttl
+	}
+	return ttls
+}
+
+// setTTLs replaces the ttls of a peer's addresses
+func (ps *peerstore) setTTLs(id string, ttls map[string]addressTTL) {
+	ps.mutex.Lock()
+	ps.ttls[id] = ttls
+	ps.mutex.Unlock()
+}
+
+// set replaces a peer without merging it
+func (ps *peerstore) set(peer Peer) {
+	ps.mutex.Lock()
+	ps.peers[peer.ID] = peer
+	ps.mutex.Unlock()
+}
+
 func (ps *peerstore) Remove(id string) error {
-	// TODO Set alive false, put, notify
-	// ps.mutex.Lock()
-	// delete(ps.peers, id)
-	// ps.mutex.Unlock()
-	// ps.notifyPut(id)
+	peer, err := ps.remove(id)
+	if err != nil {
+		return err
+	}
+	ps.notifyPut(peer)
+	return nil
+}
+
+// remove deletes a peer and returns it with Removed set
+func (ps *peerstore) remove(id string) (Peer, error) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	peer, ok := ps.peers[id]
+	if !ok {
+		return Peer{}, ErrorNotFound
+	}
+	delete(ps.peers, id)
+	delete(ps.ttls, id)
+	delete(ps.metadata, id)
+	peer.Connected = false
+	peer.Removed = true
+	logrus.WithField("pid", id).Infof("Removed peer")
+	return peer, nil
+}
+
+// SetConnected -
+func (ps *peerstore) SetConnected(id string, connected bool) error {
+	peer, err := ps.setConnected(id, connected)
+	if err != nil {
+		return err
+	}
+	ps.notifyPut(peer)
+	return nil
+}
+
+func (ps *peerstore) setConnected(id string, connected bool) (Peer, error) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	peer, ok := ps.peers[id]
+	if !ok {
+		return Peer{}, ErrorNotFound
+	}
+	now := time.Now()
+	peer.Connected = connected
+	peer.LastSeen = now
+	ps.peers[id] = peer
+	// addresses we kept because we were connected start expiring
+	if !connected {
+		for addr, ttl := range ps.ttls[id] {
+			if ttl.connected {
+				ps.ttls[id][addr] = addressTTL{expires: now.Add(AddressTTLRecentlyConnected)}
+			}
+		}
+	}
+	return peer, nil
+}
+
+// SetProtocols -
+func (ps *peerstore) SetProtocols(id string, protocols []string) error {
+	peer, err := ps.setProtocols(id, protocols)
+	if err != nil {
+		return err
+	}
+	ps.notifyPut(peer)
 	return nil
 }
 
+func (ps *peerstore) setProtocols(id string, protocols []string) (Peer, error) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	peer, ok := ps.peers[id]
+	if !ok {
+		return Peer{}, ErrorNotFound
+	}
+	peer.Protocols = make([]string, len(protocols))
+	copy(peer.Protocols, protocols)
+	ps.peers[id] = peer
+	return peer, nil
+}
+
+// UpdateIdentified -
+func (ps *peerstore) UpdateIdentified(peer Peer, ttl time.Duration) error {
+	ps.notifyPut(ps.updateIdentified(peer, ttl))
+	return nil
+}
+
+// updateIdentified merges the peer's key and agent version with the ones we
+// already have, and replaces its protocols and addresses
+func (ps *peerstore) updateIdentified(peer Peer, ttl time.Duration) Peer {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	addrs := peer.Addresses
+	protocols := peer.Protocols
+	peer.Addresses = nil
+	peer.Protocols = nil
+	merged := ps.merge(peer, AddressTTLPermanent)
+	merged.Protocols = make([]string, len(protocols))
+	copy(merged.Protocols, protocols)
+	return ps.replaceAddresses(merged, addrs, ttl)
+}
+
+// RecordLatency -
+func (ps *peerstore) RecordLatency(id string, rtt time.Duration) error {
+	_, err := ps.recordLatency(id, rtt)
+	return err
+}
+
+func (ps *peerstore) recordLatency(id string, rtt time.Duration) (Peer, error) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	peer, ok := ps.peers[id]
+	if !ok {
+		return Peer{}, ErrorNotFound
+	}
+	if peer.Latency == 0 {
+		peer.Latency = rtt
+	} else {
+		peer.Latency += time.Duration(latencySmoothing * float64(rtt-peer.Latency))
+	}
+	ps.peers[id] = peer
+	return peer, nil
+}
+
+// SetDialed -
+func (ps *peerstore) SetDialed(id string) error {
+	_, err := ps.setDialed(id)
+	return err
+}
+
+func (ps *peerstore) setDialed(id string) (Peer, error) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	peer, ok := ps.peers[id]
+	if !ok {
+		return Peer{}, ErrorNotFound
+	}
+	peer.LastDialed = time.Now()
+	ps.peers[id] = peer
+	return peer, nil
+}
+
 func (ps *peerstore) Get(id string) (Peer, error) {
 	ps.mutex.RLock()
 	defer ps.mutex.RUnlock()
@@ -63,36 +421,172 @@ func (ps *peerstore) Get(id string) (Peer, error) {
 	if ok == false {
 		return Peer{}, ErrorNotFound
 	}
-	return peer, nil
+	return ps.view(peer, time.Now()), nil
 }
 
 func (ps *peerstore) Peers() []Peer {
 	ps.mutex.Lock()
 	defer ps.mutex.Unlock()
+	now := time.Now()
 	peers := make([]Peer, len(ps.peers))
 	i := 0
 	for _, peer := range ps.peers {
-		peers[i] = peer
+		peers[i] = ps.view(peer, now)
 		i++
 	}
 	return peers
 }
 
 func (ps *peerstore) RegisterPeerHandler(handler func(Peer) error) error {
+	ps.mutex.Lock()
 	ps.handlers = append(ps.handlers, handler)
+	ps.mutex.Unlock()
 	return nil
 }
 
+// SetMetadata stores a value for a peer, the peer must exist
+func (ps *peerstore) SetMetadata(id, key, value string) error {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	if _, ok := ps.peers[id]; !ok {
+		return ErrorNotFound
+	}
+	if _, ok := ps.metadata[id]; !ok {
+		ps.metadata[id] = map[string]string{}
+	}
+	ps.metadata[id][key] = value
+	return nil
+}
+
+// GetMetadata retrieves a value stored for a peer
+func (ps *peerstore) GetMetadata(id, key string) (string, error) {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+	if _, ok := ps.peers[id]; !ok {
+		return "", ErrorNotFound
+	}
+	value, ok := ps.metadata[id][key]
+	if !ok {
+		return "", ErrorMetadataNotFound
+	}
+	return value, nil
+}
+
+// PeersWithProtocol -
+func (ps *peerstore) PeersWithProtocol(protocolID string) []Peer {
+	return ps.filter(func(peer *Peer) bool {
+		return peer.SupportsProtocol(protocolID)
+	})
+}
+
+// PeersWithTag -
+func (ps *peerstore) PeersWithTag(key, value string) []Peer {
+	return ps.filter(func(peer *Peer) bool {
+		v, ok := peer.Tags[key]
+		return ok && v == value
+	})
+}
+
+// filter returns the peers that match
+func (ps *peerstore) filter(match func(peer *Peer) bool) []Peer {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+	now := time.Now()
+	peers := []Peer{}
+	for _, peer := range ps.peers {
+		peer = ps.view(peer, now)
+		if match(&peer) {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// size returns how many peers and metadata values there are
+func (ps *peerstore) size() int {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+	size := len(ps.peers)
+	for _, values := range ps.metadata {
+		size += len(values)
+	}
+	return size
+}
+
+// stage returns a peerstore that only holds a copy of a peer, so that changes
+// can be made to it and logged before they are committed
+func (ps *peerstore) stage(id string) *peerstore {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+	staged := newPeerstore()
+	if peer, ok := ps.peers[id]; ok {
+		peer.Addresses = append([]string{}, peer.Addresses...)
+		peer.Protocols = append([]string{}, peer.Protocols...)
+		staged.peers[id] = peer
+	}
+	if ttls, ok := ps.ttls[id]; ok {
+		staged.ttls[id] = map[string]addressTTL{}
+		for addr, ttl := range ttls {
+			staged.ttls[id][addr] = ttl
+		}
+	}
+	return staged
+}
+
+// commit replaces a peer with the one in a staged peerstore
+func (ps *peerstore) commit(staged *peerstore, id string) {
+	staged.mutex.RLock()
+	peer, ok := staged.peers[id]
+	ttls := staged.ttls[id]
+	staged.mutex.RUnlock()
+	if !ok {
+		return
+	}
+	ps.mutex.Lock()
+	ps.peers[id] = peer
+	ps.ttls[id] = ttls
+	ps.mutex.Unlock()
+}
+
+// snapshot returns copies of all peers and their metadata
+func (ps *peerstore) snapshot() ([]Peer, map[string]map[string]string) {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+	peers := []Peer{}
+	for _, peer := range ps.peers {
+		peers = append(peers, peer)
+	}
+	metadata := map[string]map[string]string{}
+	for id, values := range ps.metadata {
+		metadata[id] = map[string]string{}
+		for key, value := range values {
+			metadata[id][key] = value
+		}
+	}
+	return peers, metadata
+}
+
 func (ps *peerstore) notifyPut(peer Peer) error {
-	for _, handler := range ps.handlers {
+	ps.mutex.RLock()
+	handlers := make([]func(Peer) error, len(ps.handlers))
+	copy(handlers, ps.handlers)
+	ps.mutex.RUnlock()
+
+	for _, handler := range handlers {
 		handler(peer)
 	}
 	return nil
 }
 
-// NewPeerstore returns an empty peerstore
-func NewPeerstore() *peerstore {
+// NewPeerstore returns an empty in-memory peerstore
+func NewPeerstore() Peerstore {
+	return newPeerstore()
+}
+
+func newPeerstore() *peerstore {
 	return &peerstore{
-		peers: map[string]Peer{},
+		peers:    map[string]Peer{},
+		ttls:     map[string]map[string]addressTTL{},
+		metadata: map[string]map[string]string{},
 	}
 }
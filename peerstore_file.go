@@ -0,0 +1,606 @@
+package net
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// filePeerstoreCompactMin is how many records the log needs to have
+	// before it is compacted
+	filePeerstoreCompactMin = 1000
+	// filePeerstoreMaxRecordSize limits the size of a single record
+	filePeerstoreMaxRecordSize = 1024 * 1024
+
+	filePeerstoreOpPut      = "put"
+	filePeerstoreOpRemove   = "remove"
+	filePeerstoreOpMetadata = "metadata"
+)
+
+var (
+	// ErrPeerstoreCorrupted is returned when a record before the end of a
+	// peerstore's log can't be read
+	ErrPeerstoreCorrupted = errors.New("Peerstore log is corrupted")
+	// ErrPeerstoreRecordTooLarge is returned when a change needs a record
+	// larger than filePeerstoreMaxRecordSize
+	ErrPeerstoreRecordTooLarge = errors.New("Peerstore record too large")
+)
+
+// filePeerstoreRecord is a single change in the peerstore's log.
+// Put records hold the whole peer after it was merged, so replaying them
+// does not depend on how peers are merged.
+type filePeerstoreRecord struct {
+	Op        string               `json:"op"`
+	Peer      *Peer                `json:"peer,omitempty"`
+	PublicKey []byte               `json:"publicKey,omitempty"`
+	Expires   map[string]time.Time `json:"expires,omitempty"`   // by address, if not permanent
+	Connected []string             `json:"connected,omitempty"` // addresses kept while connected
+	ID        string               `json:"id,omitempty"`
+	Key       string               `json:"key,omitempty"`
+	Value     string               `json:"value,omitempty"`
+}
+
+// FilePeerstore is a peerstore that keeps its peers in an append-only log
+// of json records, one per line.
+//
+// Every change is appended and synced to disk before it is applied in memory
+// and acknowledged, so a change that fails to be logged is not applied.
+// A record that was only partially written when the process crashed is
+// dropped when the log is loaded, while a record that can't be read before
+// the end of the log fails loading with ErrPeerstoreCorrupted. Changes that
+// would need a record larger than 1MB are not logged and return
+// ErrPeerstoreRecordTooLarge.
+//
+// Once the log has grown to more than twice the records needed to describe
+// the current peers, it is compacted by writing a new log next to it and
+// renaming it over the old one.
+type FilePeerstore struct {
+	*peerstore
+	mutex   sync.Mutex // guards the log, held while changes are applied so they are logged in order
+	path    string
+	file    *os.File
+	records int
+	broken  bool // the log needs to be rewritten before it is appended to
+}
+
+// NewFilePeerstore returns a peerstore that is persisted in the file at the
+// given path, loading the peers already in it
+func NewFilePeerstore(path string) (*FilePeerstore, error) {
+	ps := &FilePeerstore{
+		peerstore: newPeerstore(),
+		path:      path,
+	}
+
+	if err := ps.load(); err != nil {
+		return nil, err
+	}
+
+	if ps.shouldCompact() {
+		if err := ps.compact(); err != nil {
+			ps.Close()
+			return nil, err
+		}
+	}
+
+	return ps, nil
+}
+
+// Put -
+func (ps *FilePeerstore) Put(peer Peer) error {
+	return ps.PutWithTTL(peer, AddressTTLPermanent)
+}
+
+// PutWithTTL -
+func (ps *FilePeerstore) PutWithTTL(peer Peer, ttl time.Duration) error {
+	ps.mutex.Lock()
+	staged := ps.peerstore.stage(peer.ID)
+	err := ps.appendPeer(staged, staged.put(peer, ttl))
+	ps.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	ps.notifyPut(peer)
+	return nil
+}
+
+// SetAddresses -
+func (ps *FilePeerstore) SetAddresses(id string, addrs []string, ttl time.Duration) error {
+	ps.mutex.Lock()
+	staged := ps.peerstore.stage(id)
+	peer, err := staged.setAddresses(id, addrs, ttl)
+	if err == nil {
+		err = ps.appendPeer(staged, peer)
+	}
+	ps.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	ps.notifyPut(peer)
+	return nil
+}
+
+// Sweep -
+func (ps *FilePeerstore) Sweep() error {
+	ps.mutex.Lock()
+	peers, _ := ps.peerstore.snapshot()
+	swept := []Peer{}
+	var err error
+	for _, peer := range peers {
+		staged := ps.peerstore.stage(peer.ID)
+		expired := staged.sweep()
+		if len(expired) == 0 {
+			continue
+		}
+		if err = ps.appendPeer(staged, expired[0]); err != nil {
+			break
+		}
+		swept = append(swept, expired[0])
+	}
+	ps.mutex.Unlock()
+
+	for _, peer := range swept {
+		ps.notifyPut(peer)
+	}
+
+	return err
+}
+
+// Remove -
+func (ps *FilePeerstore) Remove(id string) error {
+	ps.mutex.Lock()
+	_, err := ps.peerstore.Get(id)
+	if err == nil {
+		err = ps.append(&filePeerstoreRecord{
+			Op: filePeerstoreOpRemove,
+			ID: id,
+		})
+	}
+	var peer Peer
+	if err == nil {
+		peer, err = ps.peerstore.remove(id)
+		ps.compactIfNeeded()
+	}
+	ps.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	ps.notifyPut(peer)
+	return nil
+}
+
+// SetConnected -
+func (ps *FilePeerstore) SetConnected(id string, connected bool) error {
+	ps.mutex.Lock()
+	staged := ps.peerstore.stage(id)
+	peer, err := staged.setConnected(id, connected)
+	if err == nil {
+		err = ps.appendPeer(staged, peer)
+	}
+	ps.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	ps.notifyPut(peer)
+	return nil
+}
+
+// SetProtocols -
+func (ps *FilePeerstore) SetProtocols(id string, protocols []string) error {
+	ps.mutex.Lock()
+	staged := ps.peerstore.stage(id)
+	peer, err := staged.setProtocols(id, protocols)
+	if err == nil {
+		err = ps.appendPeer(staged, peer)
+	}
+	ps.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	ps.notifyPut(peer)
+	return nil
+}
+
+// UpdateIdentified -
+func (ps *FilePeerstore) UpdateIdentified(peer Peer, ttl time.Duration) error {
+	ps.mutex.Lock()
+	staged := ps.peerstore.stage(peer.ID)
+	merged := staged.updateIdentified(peer, ttl)
+	err := ps.appendPeer(staged, merged)
+	ps.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	ps.notifyPut(merged)
+	return nil
+}
+
+// RecordLatency -
+func (ps *FilePeerstore) RecordLatency(id string, rtt time.Duration) error {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	staged := ps.peerstore.stage(id)
+	peer, err := staged.recordLatency(id, rtt)
+	if err != nil {
+		return err
+	}
+
+	return ps.appendPeer(staged, peer)
+}
+
+// SetDialed -
+func (ps *FilePeerstore) SetDialed(id string) error {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	staged := ps.peerstore.stage(id)
+	peer, err := staged.setDialed(id)
+	if err != nil {
+		return err
+	}
+
+	return ps.appendPeer(staged, peer)
+}
+
+// SetMetadata -
+func (ps *FilePeerstore) SetMetadata(id, key, value string) error {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	if _, err := ps.peerstore.Get(id); err != nil {
+		return err
+	}
+
+	err := ps.append(&filePeerstoreRecord{
+		Op:    filePeerstoreOpMetadata,
+		ID:    id,
+		Key:   key,
+		Value: value,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = ps.peerstore.SetMetadata(id, key, value)
+	ps.compactIfNeeded()
+	return err
+}
+
+// Close closes the log, the peerstore can't be changed afterwards
+func (ps *FilePeerstore) Close() error {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	if ps.file == nil {
+		return nil
+	}
+	return ps.file.Close()
+}
+
+// load replays the log and opens it for appending
+func (ps *FilePeerstore) load() error {
+	f, err := os.OpenFile(ps.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	// offset is where the last complete record ends
+	offset := int64(0)
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// a last line without a newline was not written completely
+			break
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+		record, err := decodeRecord(line)
+		if err != nil {
+			// only the last record can have been left unfinished by a crash,
+			// anything before it should have been readable
+			if _, perr := reader.Peek(1); perr == io.EOF {
+				break
+			}
+			f.Close()
+			logrus.
+				WithError(err).
+				WithField("path", ps.path).
+				WithField("offset", offset).
+				Errorf("Could not read peerstore record")
+			return ErrPeerstoreCorrupted
+		}
+		ps.apply(record)
+		ps.records++
+		offset += int64(len(line))
+	}
+
+	// drop anything after the last complete record, it was left over from
+	// a write that did not finish
+	if info, err := f.Stat(); err == nil && info.Size() > offset {
+		logrus.
+			WithField("path", ps.path).
+			WithField("bytes", info.Size()-offset).
+			Warnf("Dropping incomplete peerstore records")
+		if err := f.Truncate(offset); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	ps.file = f
+	return nil
+}
+
+// apply replays a record on the in-memory peerstore
+func (ps *FilePeerstore) apply(record *filePeerstoreRecord) {
+	switch record.Op {
+	case filePeerstoreOpPut:
+		if record.Peer == nil {
+			return
+		}
+		peer := *record.Peer
+		if len(record.PublicKey) > 0 {
+			if kp, err := NewPeerFromPublicKey(peer.ID, record.PublicKey); err == nil {
+				peer.entity = kp.entity
+			}
+		}
+		ttls := map[string]addressTTL{}
+		for addr, expires := range record.Expires {
+			ttls[addr] = addressTTL{expires: expires}
+		}
+		// we are not connected to anyone while loading, so the addresses we
+		// kept while connected start expiring now
+		for _, addr := range record.Connected {
+			ttls[addr] = addressTTL{expires: time.Now().Add(AddressTTLRecentlyConnected)}
+		}
+		ps.peerstore.set(peer)
+		ps.peerstore.setTTLs(peer.ID, ttls)
+	case filePeerstoreOpRemove:
+		ps.peerstore.remove(record.ID)
+	case filePeerstoreOpMetadata:
+		ps.peerstore.SetMetadata(record.ID, record.Key, record.Value)
+	}
+}
+
+// putRecord returns the record of a peer and the ttls of its addresses
+func putRecord(peer Peer, ttls map[string]addressTTL) *filePeerstoreRecord {
+	record := &filePeerstoreRecord{
+		Op:   filePeerstoreOpPut,
+		Peer: &peer,
+	}
+	if pk, err := peer.PublicKey(); err == nil {
+		record.PublicKey = pk
+	}
+	// the addresses kept while connected only start expiring once the log
+	// is loaded again, however long ago they were logged
+	for addr, ttl := range ttls {
+		switch {
+		case ttl.permanent():
+			continue
+		case ttl.connected:
+			record.Connected = append(record.Connected, addr)
+			continue
+		}
+		if record.Expires == nil {
+			record.Expires = map[string]time.Time{}
+		}
+		record.Expires[addr] = ttl.expires
+	}
+	return record
+}
+
+// encodeRecord returns a record as a line of the log
+func encodeRecord(record *filePeerstoreRecord) ([]byte, error) {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	if len(b)+1 > filePeerstoreMaxRecordSize {
+		return nil, ErrPeerstoreRecordTooLarge
+	}
+	return append(b, '\n'), nil
+}
+
+// decodeRecord parses a line of the log
+func decodeRecord(line []byte) (*filePeerstoreRecord, error) {
+	if len(line) > filePeerstoreMaxRecordSize {
+		return nil, ErrPeerstoreRecordTooLarge
+	}
+	record := &filePeerstoreRecord{}
+	if err := json.Unmarshal(bytes.TrimSpace(line), record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// appendPeer logs the put record of a staged peer, and commits it once it
+// has been logged
+func (ps *FilePeerstore) appendPeer(staged *peerstore, peer Peer) error {
+	if err := ps.append(putRecord(peer, staged.getTTLs(peer.ID))); err != nil {
+		return err
+	}
+	ps.peerstore.commit(staged, peer.ID)
+	ps.compactIfNeeded()
+	return nil
+}
+
+// append writes a record to the log and waits for it to reach the disk.
+// If the record can't be written, whatever was written of it is removed so
+// that later records don't end up after a broken one, and if that fails the
+// log is rewritten from memory before anything else is appended.
+func (ps *FilePeerstore) append(record *filePeerstoreRecord) error {
+	b, err := encodeRecord(record)
+	if err != nil {
+		return err
+	}
+
+	if ps.broken {
+		if err := ps.compact(); err != nil {
+			return err
+		}
+	}
+
+	offset, err := ps.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	_, err = ps.file.Write(b)
+	if err == nil {
+		err = ps.file.Sync()
+	}
+	if err != nil {
+		if terr := ps.file.Truncate(offset); terr != nil {
+			logrus.
+				WithError(terr).
+				WithField("path", ps.path).
+				Warnf("Could not remove failed peerstore record")
+			ps.broken = true
+		}
+		return err
+	}
+
+	ps.records++
+	return nil
+}
+
+// compactIfNeeded compacts the log once it has grown enough, it is called
+// after changes have been applied in memory as that is what is written
+func (ps *FilePeerstore) compactIfNeeded() {
+	if !ps.shouldCompact() {
+		return
+	}
+	if err := ps.compact(); err != nil {
+		logrus.
+			WithError(err).
+			WithField("path", ps.path).
+			Warnf("Could not compact peerstore")
+	}
+}
+
+// shouldCompact checks if the log has grown enough to be worth compacting
+func (ps *FilePeerstore) shouldCompact() bool {
+	if ps.records < filePeerstoreCompactMin {
+		return false
+	}
+	return ps.records > 2*ps.peerstore.size()
+}
+
+// compact replaces the log with one that only has the current peers
+func (ps *FilePeerstore) compact() error {
+	peers, metadata := ps.peerstore.snapshot()
+
+	tmp := ps.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	records := 0
+	w := bufio.NewWriter(f)
+	write := func(record *filePeerstoreRecord) error {
+		b, err := encodeRecord(record)
+		if err != nil {
+			return err
+		}
+		records++
+		_, err = w.Write(b)
+		return err
+	}
+
+	for _, peer := range peers {
+		if err = write(putRecord(peer, ps.peerstore.getTTLs(peer.ID))); err != nil {
+			break
+		}
+		for key, value := range metadata[peer.ID] {
+			err = write(&filePeerstoreRecord{
+				Op:    filePeerstoreOpMetadata,
+				ID:    peer.ID,
+				Key:   key,
+				Value: value,
+			})
+			if err != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, ps.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	syncDir(filepath.Dir(ps.path))
+
+	// the old log is gone, if the new one can't be opened nothing can be
+	// appended until it is written again
+	if ps.file != nil {
+		ps.file.Close()
+		ps.file = nil
+	}
+	ps.broken = true
+
+	nf, err := os.OpenFile(ps.path, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	ps.file = nf
+	ps.broken = false
+	ps.records = records
+
+	logrus.
+		WithField("path", ps.path).
+		WithField("records", records).
+		Debugf("Compacted peerstore")
+
+	return nil
+}
+
+// syncDir makes sure a rename in a directory has reached the disk
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
@@ -0,0 +1,368 @@
+package net
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestLog returns the path of a peerstore log that already has two peers
+func newTestLog(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "peerstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	path := filepath.Join(dir, "peers.log")
+	ps, err := NewFilePeerstore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b"} {
+		if err := ps.Put(Peer{ID: id, Addresses: []string{"mem:" + id}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ps.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func appendToLog(t *testing.T, path, s string) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(s); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFilePeerstorePartialRecord(t *testing.T) {
+	for name, tail := range map[string]string{
+		"unterminated": `{"op":"put","peer":{"id":"c"`,
+		"garbage":      "\x00\x00\x00\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := newTestLog(t)
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			appendToLog(t, path, tail)
+
+			ps, err := NewFilePeerstore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ps.Close()
+
+			if len(ps.Peers()) != 2 {
+				t.Fatalf("Expected 2 peers, got %v", ps.Peers())
+			}
+
+			// the partial record was dropped from the log
+			if ninfo, err := os.Stat(path); err != nil || ninfo.Size() != info.Size() {
+				t.Fatalf("Expected log to be truncated to %d bytes", info.Size())
+			}
+		})
+	}
+}
+
+func TestFilePeerstoreCorrupted(t *testing.T) {
+	path := newTestLog(t)
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(b), "\n")
+	lines[0] = "\x00\x00\x00\n"
+	b = []byte(strings.Join(lines, ""))
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewFilePeerstore(path); err != ErrPeerstoreCorrupted {
+		t.Fatalf("Expected ErrPeerstoreCorrupted, got %v", err)
+	}
+
+	// the log was left as it was
+	if nb, err := ioutil.ReadFile(path); err != nil || len(nb) != len(b) {
+		t.Fatal("Expected log not to be truncated")
+	}
+}
+
+func TestFilePeerstoreRecordTooLarge(t *testing.T) {
+	path := newTestLog(t)
+
+	ps, err := NewFilePeerstore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ps.Put(Peer{
+		ID:           "c",
+		AgentVersion: strings.Repeat("x", filePeerstoreMaxRecordSize),
+	})
+	if err != ErrPeerstoreRecordTooLarge {
+		t.Fatalf("Expected ErrPeerstoreRecordTooLarge, got %v", err)
+	}
+	if _, err := ps.Get("c"); err != ErrorNotFound {
+		t.Fatalf("Expected the rejected peer not to be added, got %v", err)
+	}
+
+	// changes to existing peers are not applied either
+	err = ps.Put(Peer{
+		ID:           "a",
+		AgentVersion: strings.Repeat("x", filePeerstoreMaxRecordSize),
+	})
+	if err != ErrPeerstoreRecordTooLarge {
+		t.Fatalf("Expected ErrPeerstoreRecordTooLarge, got %v", err)
+	}
+	if peer, err := ps.Get("a"); err != nil || peer.AgentVersion != "" {
+		t.Fatalf("Expected the rejected change not to be applied, got %+v %v", peer, err)
+	}
+
+	// the log can still be loaded
+	ps.Close()
+	ps, err = NewFilePeerstore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps.Close()
+}
+
+func TestFilePeerstoreAppendFailed(t *testing.T) {
+	path := newTestLog(t)
+
+	ps, err := NewFilePeerstore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+
+	// writes to the log fail, and what was written can't be removed either
+	failWrites := func() {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ps.file.Close()
+		ps.file = f
+		ps.broken = false
+	}
+
+	failWrites()
+	if err := ps.Put(Peer{ID: "c", Addresses: []string{"mem:c"}}); err == nil {
+		t.Fatal("Expected the change to fail")
+	}
+	if _, err := ps.Get("c"); err != ErrorNotFound {
+		t.Fatalf("Expected the failed change not to be applied, got %v", err)
+	}
+
+	failWrites()
+	if err := ps.SetMetadata("a", "key", "value"); err == nil {
+		t.Fatal("Expected the change to fail")
+	}
+	if _, err := ps.GetMetadata("a", "key"); err != ErrorMetadataNotFound {
+		t.Fatalf("Expected the failed change not to be applied, got %v", err)
+	}
+
+	failWrites()
+	if err := ps.Remove("a"); err == nil {
+		t.Fatal("Expected the change to fail")
+	}
+	if _, err := ps.Get("a"); err != nil {
+		t.Fatalf("Expected the failed change not to be applied, got %v", err)
+	}
+
+	// the log is rewritten, as what was written could not be removed
+	if err := ps.Put(Peer{ID: "d", Addresses: []string{"mem:d"}}); err != nil {
+		t.Fatal(err)
+	}
+	ps.Close()
+
+	ps, err = NewFilePeerstore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b", "d"} {
+		if _, err := ps.Get(id); err != nil {
+			t.Fatalf("Expected %s to be loaded, got %v", id, err)
+		}
+	}
+	if _, err := ps.Get("c"); err != ErrorNotFound {
+		t.Fatalf("Expected the failed change not to be logged, got %v", err)
+	}
+}
+
+func TestFilePeerstoreCompact(t *testing.T) {
+	path := newTestLog(t)
+
+	ps, err := NewFilePeerstore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.SetMetadata("a", "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	// every change is a record, the same peer changing over and over again
+	// is compacted into one
+	for i := 0; i < 2*filePeerstoreCompactMin; i++ {
+		err := ps.Put(Peer{ID: "a", AgentVersion: fmt.Sprintf("v%d", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ps.records >= filePeerstoreCompactMin {
+		t.Fatalf("Expected the log to be compacted, got %d records", ps.records)
+	}
+
+	// changes after compacting are appended to the new log
+	if err := ps.Put(Peer{ID: "c", Addresses: []string{"mem:c"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.Remove("b"); err != nil {
+		t.Fatal(err)
+	}
+	records := ps.records
+	ps.Close()
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(b), "\n"); lines != records {
+		t.Fatalf("Expected %d records in the log, got %d", records, lines)
+	}
+
+	ps, err = NewFilePeerstore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+
+	peer, err := ps.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := fmt.Sprintf("v%d", 2*filePeerstoreCompactMin-1); peer.AgentVersion != expected {
+		t.Fatalf("Expected agent version %s, got %s", expected, peer.AgentVersion)
+	}
+	if value, err := ps.GetMetadata("a", "key"); err != nil || value != "value" {
+		t.Fatalf("Expected metadata to be kept, got %q %v", value, err)
+	}
+	if _, err := ps.Get("b"); err != ErrorNotFound {
+		t.Fatalf("Expected b to be removed, got %v", err)
+	}
+	if _, err := ps.Get("c"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFilePeerstoreCompactReopenFailed(t *testing.T) {
+	path := newTestLog(t)
+
+	ps, err := NewFilePeerstore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+
+	// the log was replaced, but the new one could not be opened
+	ps.file.Close()
+	ps.file = nil
+	ps.broken = true
+
+	if err := ps.Put(Peer{ID: "c", Addresses: []string{"mem:c"}}); err != nil {
+		t.Fatal(err)
+	}
+	if ps.broken || ps.file == nil {
+		t.Fatal("Expected the log to be rewritten and opened")
+	}
+	ps.Close()
+
+	ps, err = NewFilePeerstore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps.Peers()) != 3 {
+		t.Fatalf("Expected 3 peers, got %v", ps.Peers())
+	}
+}
+
+func TestFilePeerstoreConnectedAddresses(t *testing.T) {
+	path := newTestLog(t)
+
+	ps, err := NewFilePeerstore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.SetAddresses("a", []string{"mem:a2"}, AddressTTLConnected); err != nil {
+		t.Fatal(err)
+	}
+	ps.Close()
+
+	// the address is logged as connected rather than with an expiry, which
+	// would be in the past if we stayed connected for long enough
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"connected":["mem:a2"]`) {
+		t.Fatalf("Expected connected address to be logged, got %s", b)
+	}
+
+	ps, err = NewFilePeerstore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+
+	ttl := ps.getTTLs("a")["mem:a2"]
+	if ttl.connected || ttl.expires.Before(time.Now().Add(AddressTTLRecentlyConnected-time.Minute)) {
+		t.Fatalf("Expected address to expire after %s, got %v", AddressTTLRecentlyConnected, ttl)
+	}
+
+	peer, err := ps.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peer.Addresses) != 2 {
+		t.Fatalf("Expected the permanent and connected addresses, got %v", peer.Addresses)
+	}
+}
+
+func TestFilePeerstoreUpdateIdentified(t *testing.T) {
+	path := newTestLog(t)
+
+	ps, err := NewFilePeerstore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+
+	records := ps.records
+	err = ps.UpdateIdentified(Peer{
+		ID:        "a",
+		Addresses: []string{"mem:a2"},
+		Protocols: []string{"/new/v1"},
+	}, AddressTTLConnected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ps.records != records+1 {
+		t.Fatalf("Expected a single record, got %d", ps.records-records)
+	}
+}
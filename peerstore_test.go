@@ -0,0 +1,242 @@
+package net
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestPeerstoreSetAddressesKeepsPermanent(t *testing.T) {
+	ps := NewPeerstore()
+
+	err := ps.Put(Peer{
+		ID:        "a",
+		Addresses: []string{"dns4:bootstrap.example.com:21013"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.PutWithTTL(Peer{ID: "a", Addresses: []string{"tcp4:1.1.1.1:1"}}, AddressTTLGossiped); err != nil {
+		t.Fatal(err)
+	}
+
+	// the addresses the peer identifies with replace the ones that expire
+	for _, addrs := range [][]string{
+		{"tcp4:2.2.2.2:2"},
+		{"tcp4:3.3.3.3:3", "dns4:bootstrap.example.com:21013"},
+	} {
+		if err := ps.SetAddresses("a", addrs, AddressTTLConnected); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	peer, err := ps.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"dns4:bootstrap.example.com:21013", "tcp4:3.3.3.3:3"}
+	if !reflect.DeepEqual(peer.Addresses, expected) {
+		t.Fatalf("Expected addresses %v, got %v", expected, peer.Addresses)
+	}
+}
+
+func TestPeerstoreUpdateIdentified(t *testing.T) {
+	ps := NewPeerstore()
+
+	err := ps.Put(Peer{
+		ID:        "a",
+		Addresses: []string{"dns4:bootstrap.example.com:21013"},
+		Protocols: []string{"/old/v1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// handlers are only given the peer once it has been updated
+	updates := []Peer{}
+	ps.RegisterPeerHandler(func(peer Peer) error {
+		updates = append(updates, peer)
+		return nil
+	})
+
+	err = ps.UpdateIdentified(Peer{
+		ID:           "a",
+		Addresses:    []string{"tcp4:1.1.1.1:1"},
+		Protocols:    []string{"/new/v1"},
+		AgentVersion: "test",
+	}, AddressTTLConnected)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(updates) != 1 {
+		t.Fatalf("Expected a single update, got %v", updates)
+	}
+	peer := updates[0]
+	if !reflect.DeepEqual(peer.Addresses, []string{"dns4:bootstrap.example.com:21013", "tcp4:1.1.1.1:1"}) {
+		t.Fatalf("Unexpected addresses %v", peer.Addresses)
+	}
+	if !reflect.DeepEqual(peer.Protocols, []string{"/new/v1"}) {
+		t.Fatalf("Unexpected protocols %v", peer.Protocols)
+	}
+	if peer.AgentVersion != "test" {
+		t.Fatalf("Unexpected agent version %s", peer.AgentVersion)
+	}
+}
+
+// passTime moves the expiry of a peer's addresses back, as if d had passed
+func passTime(ps *peerstore, id string, d time.Duration) {
+	ttls := ps.getTTLs(id)
+	for addr, ttl := range ttls {
+		if !ttl.expires.IsZero() {
+			ttl.expires = ttl.expires.Add(-d)
+			ttls[addr] = ttl
+		}
+	}
+	ps.setTTLs(id, ttls)
+}
+
+func TestPeerstoreSweep(t *testing.T) {
+	ps := newPeerstore()
+
+	if err := ps.Put(Peer{ID: "a", Addresses: []string{"tcp4:1.1.1.1:1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.PutWithTTL(Peer{ID: "a", Addresses: []string{"tcp4:2.2.2.2:2"}}, AddressTTLGossiped); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.PutWithTTL(Peer{ID: "a", Addresses: []string{"tcp4:3.3.3.3:3"}}, AddressTTLConnected); err != nil {
+		t.Fatal(err)
+	}
+
+	swept := []Peer{}
+	ps.RegisterPeerHandler(func(peer Peer) error {
+		swept = append(swept, peer)
+		return nil
+	})
+
+	for _, step := range []struct {
+		name       string
+		disconnect bool
+		passed     time.Duration
+		expected   []string
+	}{
+		{
+			name:     "gossiped address is kept until its ttl",
+			passed:   AddressTTLGossiped - time.Minute,
+			expected: []string{"tcp4:1.1.1.1:1", "tcp4:2.2.2.2:2", "tcp4:3.3.3.3:3"},
+		},
+		{
+			name:     "gossiped address expires, connected address is kept",
+			passed:   2 * time.Minute,
+			expected: []string{"tcp4:1.1.1.1:1", "tcp4:3.3.3.3:3"},
+		},
+		{
+			name:     "connected address is kept while connected",
+			passed:   AddressTTLRecentlyConnected * 10,
+			expected: []string{"tcp4:1.1.1.1:1", "tcp4:3.3.3.3:3"},
+		},
+		{
+			name:       "connected address is kept for a while after disconnecting",
+			disconnect: true,
+			passed:     AddressTTLRecentlyConnected - time.Minute,
+			expected:   []string{"tcp4:1.1.1.1:1", "tcp4:3.3.3.3:3"},
+		},
+		{
+			name:     "recently connected address expires",
+			passed:   2 * time.Minute,
+			expected: []string{"tcp4:1.1.1.1:1"},
+		},
+		{
+			name:     "permanent address is kept",
+			passed:   AddressTTLRecentlyConnected * 10,
+			expected: []string{"tcp4:1.1.1.1:1"},
+		},
+	} {
+		if step.disconnect {
+			if err := ps.SetConnected("a", false); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		ps.mutex.RLock()
+		stored := len(ps.peers["a"].Addresses)
+		ps.mutex.RUnlock()
+		notified := len(swept)
+
+		passTime(ps, "a", step.passed)
+		if err := ps.Sweep(); err != nil {
+			t.Fatal(err)
+		}
+
+		peer, err := ps.Get("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(peer.Addresses)
+		if !reflect.DeepEqual(peer.Addresses, step.expected) {
+			t.Fatalf("%s: expected %v, got %v", step.name, step.expected, peer.Addresses)
+		}
+
+		// expired addresses are removed rather than just hidden, and
+		// handlers are told about the peers that had any
+		ps.mutex.RLock()
+		addrs := ps.peers["a"].Addresses
+		ps.mutex.RUnlock()
+		if len(addrs) != len(step.expected) {
+			t.Fatalf("%s: expected expired addresses to be removed, got %v", step.name, addrs)
+		}
+		switch {
+		case len(addrs) == stored && len(swept) != notified:
+			t.Fatalf("%s: expected handlers not to be called, got %v", step.name, swept[notified:])
+		case len(addrs) < stored && len(swept) != notified+1:
+			t.Fatalf("%s: expected handlers to be called once, got %v", step.name, swept[notified:])
+		}
+	}
+}
+
+func TestPeerstoreRemove(t *testing.T) {
+	ps := newPeerstore()
+
+	if err := ps.Put(Peer{ID: "a", Addresses: []string{"tcp4:1.1.1.1:1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.SetMetadata("a", "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.SetConnected("a", true); err != nil {
+		t.Fatal(err)
+	}
+
+	removed := []Peer{}
+	ps.RegisterPeerHandler(func(peer Peer) error {
+		removed = append(removed, peer)
+		return nil
+	})
+
+	if err := ps.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || !removed[0].Removed || removed[0].Connected {
+		t.Fatalf("Expected handlers to be given the removed peer, got %+v", removed)
+	}
+
+	if _, err := ps.Get("a"); err != ErrorNotFound {
+		t.Fatalf("Expected ErrorNotFound, got %v", err)
+	}
+	if _, err := ps.GetMetadata("a", "key"); err == nil {
+		t.Fatal("Expected metadata to be removed")
+	}
+	if err := ps.Remove("a"); err != ErrorNotFound {
+		t.Fatalf("Expected ErrorNotFound, got %v", err)
+	}
+
+	// a peer added again starts over
+	if err := ps.Put(Peer{ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if peer, err := ps.Get("a"); err != nil || len(peer.Addresses) != 0 || len(peer.Tags) != 0 {
+		t.Fatalf("Expected a new peer, got %+v %v", peer, err)
+	}
+}
@@ -0,0 +1,63 @@
+package net
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// AddressTTLPermanent keeps addresses until the peer is removed, it is
+	// used for the addresses added with Put
+	AddressTTLPermanent = time.Duration(math.MaxInt64)
+	// AddressTTLConnected keeps addresses for as long as we are connected to
+	// the peer, and AddressTTLRecentlyConnected after we disconnect
+	AddressTTLConnected = AddressTTLPermanent - 1
+	// AddressTTLRecentlyConnected is how long the addresses of peers we were
+	// connected to are kept after we disconnect
+	AddressTTLRecentlyConnected = 30 * time.Minute
+	// AddressTTLGossiped is meant for addresses we heard about from other
+	// peers rather than from the peer itself
+	AddressTTLGossiped = 10 * time.Minute
+)
+
+// addressTTL is when an address expires
+type addressTTL struct {
+	expires   time.Time // zero if the address never expires
+	connected bool      // the address is kept while we are connected
+}
+
+func newAddressTTL(ttl time.Duration) addressTTL {
+	switch ttl {
+	case AddressTTLPermanent:
+		return addressTTL{}
+	case AddressTTLConnected:
+		return addressTTL{connected: true}
+	}
+	return addressTTL{expires: time.Now().Add(ttl)}
+}
+
+// permanent checks if the address never expires
+func (t addressTTL) permanent() bool {
+	return t.expires.IsZero() && !t.connected
+}
+
+// expired checks if the address has expired by the given time
+func (t addressTTL) expired(now time.Time) bool {
+	return !t.expires.IsZero() && !now.Before(t.expires)
+}
+
+// outlives checks if the address will be kept longer with this ttl than with
+// the other one
+func (t addressTTL) outlives(o addressTTL) bool {
+	switch {
+	case o.permanent():
+		return false
+	case t.permanent():
+		return true
+	case o.connected:
+		return false
+	case t.connected:
+		return true
+	}
+	return t.expires.After(o.expires)
+}
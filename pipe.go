@@ -0,0 +1,112 @@
+package net
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	pipeBufferSize = 32 * 1024
+)
+
+var pipeBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, pipeBufferSize)
+		return &b
+	},
+}
+
+// closeWriter is implemented by connections that support half-closing,
+// ie. *net.TCPConn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Pipe copies data between a and b in both directions until both directions
+// are done or one of them fails, it then closes both ends.
+// When one direction reaches EOF the write side of the other end is closed,
+// if it supports half-closing, so the remote end is informed that no more
+// data are coming while still being able to respond.
+func Pipe(a, b io.ReadWriteCloser) error {
+	_, _, err := PipeCount(a, b)
+	return err
+}
+
+// PipeCount is Pipe but also returns the number of bytes copied from a to b
+// and from b to a
+func PipeCount(a, b io.ReadWriteCloser) (int64, int64, error) {
+	var ab, ba int64
+	err := pipe(a, b, &ab, &ba)
+	return ab, ba, err
+}
+
+// pipe is PipeCount but updates the byte counters as the data are copied, so
+// they can be read while the pipe is still running
+func pipe(a, b io.ReadWriteCloser, ab, ba *int64) error {
+	var closed int32
+	errs := make(chan error, 2)
+	go pipeOneWay(b, a, ab, &closed, errs)
+	go pipeOneWay(a, b, ba, &closed, errs)
+
+	// wait for both directions, if one fails close both ends so the other
+	// one is unblocked
+	var err error
+	for i := 0; i < 2; i++ {
+		cerr := <-errs
+		// once an end has been fully closed the other direction is expected
+		// to fail
+		if cerr == nil || err != nil || atomic.LoadInt32(&closed) == 1 {
+			continue
+		}
+		err = cerr
+		a.Close()
+		b.Close()
+	}
+
+	a.Close()
+	b.Close()
+	return err
+}
+
+// pipeOneWay copies from src to dst and half-closes dst once src is done
+func pipeOneWay(dst, src io.ReadWriteCloser, n *int64, closed *int32, errs chan<- error) {
+	buf := pipeBufferPool.Get().(*[]byte)
+	defer pipeBufferPool.Put(buf)
+
+	// src is wrapped so the pooled buffer is used even if it implements
+	// io.WriterTo, some streams' WriteTo also return io.EOF when they are done
+	_, err := io.CopyBuffer(&countingWriter{w: dst, n: n}, readerOnly{src}, *buf)
+	if err != nil {
+		errs <- err
+		return
+	}
+
+	if cw, ok := dst.(closeWriter); ok {
+		errs <- cw.CloseWrite()
+		return
+	}
+
+	// dst does not support half-closing, closing it is the only way to let
+	// the other end know we are done
+	atomic.StoreInt32(closed, 1)
+	errs <- dst.Close()
+}
+
+// readerOnly hides everything but Read, ie. io.WriterTo
+type readerOnly struct {
+	io.Reader
+}
+
+// countingWriter hides everything but Write, ie. io.ReaderFrom, and counts
+// the bytes written
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
@@ -0,0 +1,86 @@
+package net
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// tcpPair returns both ends of a tcp connection
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	lst, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lst.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := lst.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- c
+	}()
+
+	a, err := net.Dial("tcp4", lst.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, ok := <-accepted
+	if !ok {
+		t.Fatal("Could not accept connection")
+	}
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a.(*net.TCPConn), b.(*net.TCPConn)
+}
+
+func TestPipeHalfClose(t *testing.T) {
+	// client <-> a ... b <-> server
+	client, a := tcpPair(t)
+	b, server := tcpPair(t)
+
+	type result struct {
+		ab, ba int64
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		ab, ba, err := PipeCount(a, b)
+		done <- result{ab, ba, err}
+	}()
+
+	client.Write([]byte("ping"))
+	client.CloseWrite()
+
+	// the server sees the client is done, but can still respond
+	buf, err := ioutil.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("Expected ping, got %q", buf)
+	}
+	server.Write([]byte("pong!"))
+	server.CloseWrite()
+
+	buf, err = ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "pong!" {
+		t.Fatalf("Expected pong!, got %q", buf)
+	}
+
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.ab != 4 || r.ba != 5 {
+		t.Fatalf("Expected 4 and 5 bytes to be copied, got %d and %d", r.ab, r.ba)
+	}
+}
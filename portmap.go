@@ -0,0 +1,334 @@
+package net
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// portMappingLifetime is the lifetime we ask gateways to keep mappings
+	// for, they are renewed once half of it has passed
+	portMappingLifetime = time.Hour
+	// portMappingInterval is how often mappings are checked for renewal
+	portMappingInterval = 5 * time.Minute
+)
+
+var (
+	// ErrNoPortMapper is returned when no gateway that can map ports was found
+	ErrNoPortMapper = errors.New("No port mapping gateway found")
+)
+
+// PortMapper forwards ports on a NAT gateway to the local host
+type PortMapper interface {
+	// ExternalIP returns the gateway's external IP
+	ExternalIP() (net.IP, error)
+	// AddMapping asks the gateway to forward an external port to a local
+	// one, it returns the external port and lifetime the gateway granted,
+	// which might differ from the ones we asked for
+	AddMapping(protocol string, internalPort, externalPort int, lifetime time.Duration) (int, time.Duration, error)
+	// DeleteMapping removes a mapping
+	DeleteMapping(protocol string, internalPort, externalPort int) error
+}
+
+// PortMapping is a port forwarded by a gateway
+type PortMapping struct {
+	Protocol     string
+	InternalPort int
+	ExternalPort int
+	Expires      time.Time
+}
+
+// DiscoverPortMapper looks for a NAT-PMP gateway on the default route, and
+// then for a UPnP one
+func DiscoverPortMapper() (PortMapper, error) {
+	if gw, err := getDefaultGateway(); err == nil {
+		m := NewNATPMPMapper(gw)
+		if _, err := m.ExternalIP(); err == nil {
+			return m, nil
+		}
+	}
+
+	m := NewUPnPMapper()
+	if _, err := m.ExternalIP(); err == nil {
+		return m, nil
+	}
+
+	return nil, ErrNoPortMapper
+}
+
+// portMapper keeps the ports of the local peer's tcp4 addresses mapped on the
+// gateway and advertises the mapped external addresses.
+// Mappings are renewed before they expire and are removed when the network
+// is closed or the gateway is replaced.
+type portMapper struct {
+	mutex    sync.Mutex
+	net      *network
+	mapper   PortMapper
+	mappings map[int]*PortMapping // by internal port
+	explicit bool                 // the mapper was set with SetMapper
+	addrs    []string
+	update   chan struct{}
+	done     chan struct{}
+}
+
+func newPortMapper(n *network) *portMapper {
+	return &portMapper{
+		net:      n,
+		mappings: map[int]*PortMapping{},
+		update:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start maps ports periodically or whenever the gateway changes, if discover
+// is set it looks for a gateway once there are ports to map
+func (p *portMapper) Start(discover bool) {
+	go func() {
+		ticker := time.NewTicker(portMappingInterval)
+		defer ticker.Stop()
+		for {
+			if discover && p.discover() {
+				discover = false
+			}
+			p.refresh()
+			select {
+			case <-ticker.C:
+			case <-p.update:
+			case <-p.done:
+				return
+			}
+		}
+	}()
+}
+
+// discover looks for a gateway unless one was set explicitly, it returns
+// false if there were no ports to map yet
+func (p *portMapper) discover() bool {
+	p.mutex.Lock()
+	explicit := p.explicit
+	p.mutex.Unlock()
+
+	if explicit {
+		return true
+	}
+
+	if len(p.localPorts()) == 0 {
+		return false
+	}
+
+	mapper, err := DiscoverPortMapper()
+	if err != nil {
+		logrus.WithError(err).Infof("Not mapping ports")
+		return true
+	}
+
+	p.setMapper(mapper, false)
+	return true
+}
+
+// SetMapper replaces the gateway, mappings on the previous one are removed.
+// Gateways that are discovered afterwards are ignored.
+func (p *portMapper) SetMapper(mapper PortMapper) {
+	p.setMapper(mapper, true)
+}
+
+func (p *portMapper) setMapper(mapper PortMapper, explicit bool) {
+	p.mutex.Lock()
+	select {
+	case <-p.done:
+		p.mutex.Unlock()
+		return
+	default:
+	}
+	// discovered gateways don't replace the ones set explicitly
+	if !explicit && p.explicit {
+		p.mutex.Unlock()
+		return
+	}
+	p.explicit = explicit
+	old := p.mapper
+	mappings := p.mappings
+	p.mapper = mapper
+	p.mappings = map[int]*PortMapping{}
+	p.mutex.Unlock()
+
+	if old != nil {
+		p.deleteMappings(old, mappings)
+	}
+
+	p.trigger()
+}
+
+// Close removes all mappings and the addresses we advertised for them
+func (p *portMapper) Close() {
+	p.mutex.Lock()
+	select {
+	case <-p.done:
+		p.mutex.Unlock()
+		return
+	default:
+	}
+	close(p.done)
+	mapper := p.mapper
+	mappings := p.mappings
+	p.mapper = nil
+	p.mappings = map[int]*PortMapping{}
+	p.mutex.Unlock()
+
+	if mapper != nil {
+		p.deleteMappings(mapper, mappings)
+	}
+
+	p.updateAddresses(nil)
+}
+
+func (p *portMapper) trigger() {
+	select {
+	case p.update <- struct{}{}:
+	default:
+	}
+}
+
+func (p *portMapper) refresh() {
+	p.mutex.Lock()
+	mapper := p.mapper
+	p.mutex.Unlock()
+
+	if mapper == nil {
+		p.updateAddresses(nil)
+		return
+	}
+
+	eip, err := mapper.ExternalIP()
+	if err != nil || eip.To4() == nil {
+		logrus.WithError(err).Warnf("Could not get external IP")
+		p.updateAddresses(nil)
+		return
+	}
+
+	ports := p.localPorts()
+
+	p.mutex.Lock()
+	stale := map[int]*PortMapping{}
+	for port, m := range p.mappings {
+		if !ports[port] {
+			stale[port] = m
+			delete(p.mappings, port)
+		}
+	}
+	existing := map[int]PortMapping{}
+	for port, m := range p.mappings {
+		existing[port] = *m
+	}
+	p.mutex.Unlock()
+
+	p.deleteMappings(mapper, stale)
+
+	now := time.Now()
+	for port := range ports {
+		eport := port
+		if m, ok := existing[port]; ok {
+			// renew once half of the lifetime has passed
+			if m.Expires.Sub(now) > portMappingLifetime/2 {
+				continue
+			}
+			eport = m.ExternalPort
+		}
+
+		logger := logrus.WithField("port", port)
+		mport, lifetime, err := mapper.AddMapping("tcp", port, eport, portMappingLifetime)
+		if err != nil {
+			logger.WithError(err).Warnf("Could not map port")
+			p.mutex.Lock()
+			delete(p.mappings, port)
+			p.mutex.Unlock()
+			continue
+		}
+
+		logger.
+			WithField("externalPort", mport).
+			WithField("lifetime", lifetime).
+			Debugf("Mapped port")
+
+		p.mutex.Lock()
+		current := p.mapper == mapper
+		if current {
+			p.mappings[port] = &PortMapping{
+				Protocol:     "tcp",
+				InternalPort: port,
+				ExternalPort: mport,
+				Expires:      now.Add(lifetime),
+			}
+		}
+		p.mutex.Unlock()
+
+		// the mapper was replaced or closed in the meantime
+		if !current {
+			mapper.DeleteMapping("tcp", port, mport)
+			return
+		}
+	}
+
+	p.updateAddresses(eip)
+}
+
+// localPorts returns the ports of the private tcp4 addresses we listen on
+func (p *portMapper) localPorts() map[int]bool {
+	p.mutex.Lock()
+	added := map[string]bool{}
+	for _, addr := range p.addrs {
+		added[addr] = true
+	}
+	p.mutex.Unlock()
+
+	ports := map[int]bool{}
+	for _, addr := range p.net.getLocalAddresses() {
+		if added[addr] || ClassifyAddress(addr) != AddressClassPrivate {
+			continue
+		}
+		a, err := ParseAddress(addr)
+		if err != nil || a.Scheme != "tcp4" || a.Port == 0 {
+			continue
+		}
+		ports[a.Port] = true
+	}
+	return ports
+}
+
+func (p *portMapper) deleteMappings(mapper PortMapper, mappings map[int]*PortMapping) {
+	for _, m := range mappings {
+		if err := mapper.DeleteMapping(m.Protocol, m.InternalPort, m.ExternalPort); err != nil {
+			logrus.
+				WithError(err).
+				WithField("port", m.InternalPort).
+				Debugf("Could not remove port mapping")
+		}
+	}
+}
+
+// updateAddresses replaces the addresses we advertised for our mappings with
+// the current ones
+func (p *portMapper) updateAddresses(eip net.IP) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	addrs := []string{}
+	if eip != nil {
+		for _, m := range p.mappings {
+			a := &Address{
+				Scheme: "tcp4",
+				Host:   eip.String(),
+				Port:   m.ExternalPort,
+			}
+			addrs = append(addrs, a.String())
+		}
+	}
+	sort.Strings(addrs)
+
+	p.addrs = p.net.updateLocalAddresses(p.addrs, addrs)
+}
@@ -0,0 +1,215 @@
+package net
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// fakeGatewayFirstPort is where the fake gateway starts picking external
+	// ports from when the requested one is taken
+	fakeGatewayFirstPort = 40000
+)
+
+// FakeGateway is an in-process NAT gateway for tests.
+// It can be used directly as a PortMapper, or serve NAT-PMP on a local UDP
+// port so the NAT-PMP mapper can be tested against it.
+type FakeGateway struct {
+	mutex    sync.Mutex
+	ip       net.IP
+	started  time.Time
+	mappings map[string]*PortMapping // by protocol and external port
+	lastPort int
+	conn     net.PacketConn
+}
+
+// NewFakeGateway returns a gateway with the given external IP
+func NewFakeGateway(externalIP net.IP) *FakeGateway {
+	return &FakeGateway{
+		ip:       externalIP,
+		started:  time.Now(),
+		mappings: map[string]*PortMapping{},
+		lastPort: fakeGatewayFirstPort - 1,
+	}
+}
+
+// ExternalIP -
+func (g *FakeGateway) ExternalIP() (net.IP, error) {
+	return g.ip, nil
+}
+
+// AddMapping -
+func (g *FakeGateway) AddMapping(protocol string, internalPort, externalPort int, lifetime time.Duration) (int, time.Duration, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	protocol = strings.ToLower(protocol)
+	g.expire()
+
+	// renew existing mappings of the same internal port
+	for _, m := range g.mappings {
+		if m.Protocol == protocol && m.InternalPort == internalPort {
+			m.Expires = time.Now().Add(lifetime)
+			return m.ExternalPort, lifetime, nil
+		}
+	}
+
+	if externalPort == 0 || g.mappings[g.key(protocol, externalPort)] != nil {
+		port, err := g.freePort(protocol)
+		if err != nil {
+			return 0, 0, err
+		}
+		externalPort = port
+	}
+
+	g.mappings[g.key(protocol, externalPort)] = &PortMapping{
+		Protocol:     protocol,
+		InternalPort: internalPort,
+		ExternalPort: externalPort,
+		Expires:      time.Now().Add(lifetime),
+	}
+
+	return externalPort, lifetime, nil
+}
+
+// DeleteMapping -
+func (g *FakeGateway) DeleteMapping(protocol string, internalPort, externalPort int) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	protocol = strings.ToLower(protocol)
+	for k, m := range g.mappings {
+		if m.Protocol == protocol && m.InternalPort == internalPort {
+			delete(g.mappings, k)
+		}
+	}
+
+	return nil
+}
+
+// Mappings returns the mappings that have not expired, ordered by external
+// port
+func (g *FakeGateway) Mappings() []PortMapping {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.expire()
+	ms := []PortMapping{}
+	for _, m := range g.mappings {
+		ms = append(ms, *m)
+	}
+	sort.Slice(ms, func(i, j int) bool {
+		return ms[i].ExternalPort < ms[j].ExternalPort
+	})
+	return ms
+}
+
+// ListenNATPMP serves NAT-PMP on the given UDP address, ie.
+// `127.0.0.1:0`, and returns the address it is listening on
+func (g *FakeGateway) ListenNATPMP(addr string) (string, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return "", err
+	}
+
+	g.mutex.Lock()
+	g.conn = conn
+	g.mutex.Unlock()
+
+	go g.serveNATPMP(conn)
+	return conn.LocalAddr().String(), nil
+}
+
+// Close stops serving NAT-PMP
+func (g *FakeGateway) Close() error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.conn == nil {
+		return nil
+	}
+	err := g.conn.Close()
+	g.conn = nil
+	return err
+}
+
+func (g *FakeGateway) serveNATPMP(conn net.PacketConn) {
+	buf := make([]byte, 64)
+	for {
+		n, raddr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n < 2 || buf[0] != 0 {
+			continue
+		}
+
+		op := buf[1]
+		res := make([]byte, 16)
+		res[1] = op + 128
+		binary.BigEndian.PutUint32(res[4:8], uint32(time.Since(g.started)/time.Second))
+
+		switch {
+		case op == natPMPOpExternalAddress:
+			copy(res[8:12], g.ip.To4())
+			res = res[:12]
+		case (op == natPMPOpMapTCP || op == natPMPOpMapUDP) && n >= 12:
+			protocol := "tcp"
+			if op == natPMPOpMapUDP {
+				protocol = "udp"
+			}
+			iport := int(binary.BigEndian.Uint16(buf[4:6]))
+			eport := int(binary.BigEndian.Uint16(buf[6:8]))
+			lifetime := time.Duration(binary.BigEndian.Uint32(buf[8:12])) * time.Second
+			binary.BigEndian.PutUint16(res[8:10], uint16(iport))
+			if lifetime == 0 {
+				g.DeleteMapping(protocol, iport, eport)
+				break
+			}
+			mport, granted, err := g.AddMapping(protocol, iport, eport, lifetime)
+			if err != nil {
+				binary.BigEndian.PutUint16(res[2:4], 4)
+				break
+			}
+			binary.BigEndian.PutUint16(res[10:12], uint16(mport))
+			binary.BigEndian.PutUint32(res[12:16], uint32(granted/time.Second))
+		default:
+			// unsupported opcode
+			binary.BigEndian.PutUint16(res[2:4], 5)
+			res = res[:8]
+		}
+
+		conn.WriteTo(res, raddr)
+	}
+}
+
+func (g *FakeGateway) key(protocol string, port int) string {
+	return protocol + "/" + strconv.Itoa(port)
+}
+
+func (g *FakeGateway) freePort(protocol string) (int, error) {
+	for i := 0; i < 65536-fakeGatewayFirstPort; i++ {
+		g.lastPort++
+		if g.lastPort > 65535 {
+			g.lastPort = fakeGatewayFirstPort
+		}
+		if g.mappings[g.key(protocol, g.lastPort)] == nil {
+			return g.lastPort, nil
+		}
+	}
+	return 0, errors.New("No free ports")
+}
+
+func (g *FakeGateway) expire() {
+	now := time.Now()
+	for k, m := range g.mappings {
+		if !now.Before(m.Expires) {
+			delete(g.mappings, k)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package net
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/cpu"
+)
+
+const (
+	// natPMPPort is the port NAT-PMP gateways listen on
+	natPMPPort = 5351
+
+	natPMPOpExternalAddress = 0
+	natPMPOpMapUDP          = 1
+	natPMPOpMapTCP          = 2
+
+	// requests are retried with the timeout doubling every time
+	natPMPInitialTimeout = 250 * time.Millisecond
+	natPMPRetries        = 4
+)
+
+var (
+	// ErrGatewayTimeout is returned when the gateway did not respond
+	ErrGatewayTimeout = errors.New("Gateway did not respond")
+	// ErrNoDefaultGateway is returned when the default gateway can't be found
+	ErrNoDefaultGateway = errors.New("No default gateway")
+)
+
+// natPMPError is a result code other than success
+type natPMPError uint16
+
+// Error -
+func (e natPMPError) Error() string {
+	switch e {
+	case 1:
+		return "NAT-PMP unsupported version"
+	case 2:
+		return "NAT-PMP not authorized"
+	case 3:
+		return "NAT-PMP network failure"
+	case 4:
+		return "NAT-PMP out of resources"
+	case 5:
+		return "NAT-PMP unsupported opcode"
+	}
+	return fmt.Sprintf("NAT-PMP error %d", uint16(e))
+}
+
+// natPMPMapper maps ports with NAT-PMP, RFC 6886.
+// PCP gateways that are backwards compatible with NAT-PMP clients, as
+// described in RFC 6887, can be used as well.
+type natPMPMapper struct {
+	mutex   sync.Mutex
+	gateway string
+}
+
+// NewNATPMPMapper returns a port mapper for the NAT-PMP gateway at the given
+// `host:port` address, the port defaults to 5351
+func NewNATPMPMapper(gateway string) PortMapper {
+	if _, _, err := net.SplitHostPort(gateway); err != nil {
+		gateway = net.JoinHostPort(gateway, strconv.Itoa(natPMPPort))
+	}
+	return &natPMPMapper{
+		gateway: gateway,
+	}
+}
+
+// ExternalIP -
+func (m *natPMPMapper) ExternalIP() (net.IP, error) {
+	res, err := m.request([]byte{0, natPMPOpExternalAddress}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IPv4(res[8], res[9], res[10], res[11]), nil
+}
+
+// AddMapping -
+func (m *natPMPMapper) AddMapping(protocol string, internalPort, externalPort int, lifetime time.Duration) (int, time.Duration, error) {
+	res, err := m.mapPort(protocol, internalPort, externalPort, lifetime)
+	if err != nil {
+		return 0, 0, err
+	}
+	mport := int(binary.BigEndian.Uint16(res[10:12]))
+	granted := time.Duration(binary.BigEndian.Uint32(res[12:16])) * time.Second
+	return mport, granted, nil
+}
+
+// DeleteMapping -
+func (m *natPMPMapper) DeleteMapping(protocol string, internalPort, externalPort int) error {
+	// a zero lifetime and external port removes the mapping
+	_, err := m.mapPort(protocol, internalPort, 0, 0)
+	return err
+}
+
+func (m *natPMPMapper) mapPort(protocol string, internalPort, externalPort int, lifetime time.Duration) ([]byte, error) {
+	req := make([]byte, 12)
+	switch strings.ToLower(protocol) {
+	case "tcp":
+		req[1] = natPMPOpMapTCP
+	case "udp":
+		req[1] = natPMPOpMapUDP
+	default:
+		return nil, errors.New("Unsupported protocol " + protocol)
+	}
+	binary.BigEndian.PutUint16(req[4:6], uint16(internalPort))
+	binary.BigEndian.PutUint16(req[6:8], uint16(externalPort))
+	binary.BigEndian.PutUint32(req[8:12], uint32(lifetime/time.Second))
+	return m.request(req, 16)
+}
+
+// request sends a request to the gateway and waits for a response of at
+// least the given size, retrying with exponential back off
+func (m *natPMPMapper) request(req []byte, size int) ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	conn, err := net.Dial("udp", m.gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 16)
+	timeout := natPMPInitialTimeout
+	for i := 0; i < natPMPRetries; i++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			// ignore anything that is not a response to our request
+			if n < 4 || buf[0] != 0 || buf[1] != req[1]+128 {
+				continue
+			}
+			if code := binary.BigEndian.Uint16(buf[2:4]); code != 0 {
+				return nil, natPMPError(code)
+			}
+			if n < size {
+				continue
+			}
+			return buf[:n], nil
+		}
+		timeout *= 2
+	}
+
+	return nil, ErrGatewayTimeout
+}
+
+// getDefaultGateway returns the IPv4 gateway of the default route.
+// The routing table is only read on Linux, elsewhere there is no gateway we
+// can be sure of, and requests are not sent to hosts that might not be one.
+func getDefaultGateway() (string, error) {
+	gw, err := getLinuxDefaultGateway()
+	if err != nil {
+		return "", err
+	}
+	return gw.String(), nil
+}
+
+// getLinuxDefaultGateway reads the default route from /proc/net/route
+func getLinuxDefaultGateway() (net.IP, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, ErrNoDefaultGateway
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		gw, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil || gw == 0 {
+			continue
+		}
+		// addresses are printed as integers in host byte order
+		ip := make(net.IP, 4)
+		if cpu.IsBigEndian {
+			binary.BigEndian.PutUint32(ip, uint32(gw))
+		} else {
+			binary.LittleEndian.PutUint32(ip, uint32(gw))
+		}
+		return ip, nil
+	}
+
+	return nil, ErrNoDefaultGateway
+}
@@ -0,0 +1,86 @@
+package net
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// newPortMappedNetwork returns a network with a private tcp4 address, which
+// does not need to be bound for its port to be mapped
+func newPortMappedNetwork(t *testing.T, id string) *network {
+	return newTestNetwork(t, &Peer{
+		ID:        id,
+		Addresses: []string{"tcp4:10.255.255.1:21612"},
+	})
+}
+
+// waitMapped waits until the network advertises the mapped address, or
+// stops advertising it if mapped is false
+func waitMapped(t *testing.T, n *network, addr string, mapped bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		found := false
+		for _, a := range n.getLocalAddresses() {
+			if a == addr {
+				found = true
+			}
+		}
+		if found == mapped {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("Expected %s to be advertised: %v, got %v", addr, mapped, n.getLocalAddresses())
+}
+
+func TestPortMapperFakeGateway(t *testing.T) {
+	n := newPortMappedNetwork(t, "pm-fake")
+
+	gw := NewFakeGateway(net.ParseIP("1.2.3.4"))
+	n.SetPortMapper(gw)
+
+	waitMapped(t, n, "tcp4:1.2.3.4:21612", true)
+
+	ms := gw.Mappings()
+	if len(ms) != 1 || ms[0].InternalPort != 21612 || ms[0].Protocol != "tcp" {
+		t.Fatalf("Unexpected mappings %v", ms)
+	}
+
+	// discovered gateways don't replace the one we set
+	n.portMapper.setMapper(NewFakeGateway(net.ParseIP("5.6.7.8")), false)
+	n.portMapper.mutex.Lock()
+	mapper := n.portMapper.mapper
+	n.portMapper.mutex.Unlock()
+	if mapper != gw {
+		t.Fatal("Expected the gateway we set to be kept")
+	}
+
+	n.SetPortMapper(nil)
+
+	waitMapped(t, n, "tcp4:1.2.3.4:21612", false)
+	if ms := gw.Mappings(); len(ms) != 0 {
+		t.Fatalf("Expected mappings to be removed, got %v", ms)
+	}
+}
+
+func TestPortMapperNATPMP(t *testing.T) {
+	n := newPortMappedNetwork(t, "pm-natpmp")
+
+	gw := NewFakeGateway(net.ParseIP("1.2.3.4"))
+	addr, err := gw.ListenNATPMP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+
+	n.SetPortMapper(NewNATPMPMapper(addr))
+
+	waitMapped(t, n, "tcp4:1.2.3.4:21612", true)
+
+	// mappings are removed when the network is closed
+	n.Close()
+	if ms := gw.Mappings(); len(ms) != 0 {
+		t.Fatalf("Expected mappings to be removed, got %v", ms)
+	}
+}
@@ -0,0 +1,77 @@
+package net
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prestonTao/upnp"
+)
+
+var (
+	// ErrUPnPDeleteMapping is returned when the gateway did not remove a
+	// mapping
+	ErrUPnPDeleteMapping = errors.New("Gateway did not remove the mapping")
+)
+
+// upnpMapper maps ports on UPnP internet gateway devices.
+// Gateways are not asked for a lease duration, mappings are instead renewed
+// and removed like the ones of other mappers.
+type upnpMapper struct {
+	mutex sync.Mutex
+	upnp  *upnp.Upnp
+}
+
+// NewUPnPMapper returns a port mapper that looks for a UPnP gateway on the
+// local network
+func NewUPnPMapper() PortMapper {
+	return &upnpMapper{
+		upnp: new(upnp.Upnp),
+	}
+}
+
+// ExternalIP -
+func (m *upnpMapper) ExternalIP() (net.IP, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := m.upnp.ExternalIPAddr(); err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(m.upnp.GatewayOutsideIP)
+	if ip == nil {
+		return nil, errors.New("Invalid external IP " + m.upnp.GatewayOutsideIP)
+	}
+
+	return ip, nil
+}
+
+// AddMapping -
+func (m *upnpMapper) AddMapping(protocol string, internalPort, externalPort int, lifetime time.Duration) (int, time.Duration, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if externalPort == 0 {
+		externalPort = internalPort
+	}
+
+	if err := m.upnp.AddPortMapping(internalPort, externalPort, strings.ToUpper(protocol)); err != nil {
+		return 0, 0, err
+	}
+
+	return externalPort, lifetime, nil
+}
+
+// DeleteMapping -
+func (m *upnpMapper) DeleteMapping(protocol string, internalPort, externalPort int) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.upnp.DelPortMapping(externalPort, strings.ToUpper(protocol)) {
+		return ErrUPnPDeleteMapping
+	}
+	return nil
+}
@@ -1,56 +1,444 @@
 package net
 
 import (
-	"bufio"
 	"context"
 	"errors"
 	"io"
+	"io/ioutil"
 	"net"
-	"strings"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	ms "github.com/multiformats/go-multistream"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// maxRelayReservations is the default number of peers a relay will
+	// keep reservations for
+	maxRelayReservations = 128
+	// maxRelayCircuits is the default number of circuits a relay will
+	// keep open at the same time
+	maxRelayCircuits = 1024
+	// maxRelayHops is the maximum number of relays a circuit can go through
+	maxRelayHops = 4
+	// relayRequestTimeout is how long we wait for a relay to respond to a
+	// request, unless the context we were given has a deadline
+	relayRequestTimeout = 10 * time.Second
+)
+
+var (
+	// ErrRelayNoReservationSlots is returned when a relay is full
+	ErrRelayNoReservationSlots = errors.New("No reservation slots available")
+	// ErrRelayNoCircuitSlots is returned when a relay has too many circuits
+	ErrRelayNoCircuitSlots = errors.New("No circuit slots available")
+	// ErrRelayHopLimit is returned when a circuit goes through too many relays
+	ErrRelayHopLimit = errors.New("Relay hop limit exceeded")
+	// ErrRelayLoop is returned when a relay appears more than once in a route
+	ErrRelayLoop = errors.New("Relay route contains a loop")
+	// ErrRelayNoReservation is returned when the target of a circuit has no
+	// reservation with the relay
+	ErrRelayNoReservation = errors.New("Target has no reservation")
+	// ErrRelayReservationMismatch is returned when a peer asks for a
+	// reservation for someone else
+	ErrRelayReservationMismatch = errors.New("Reservation is not for the peer asking for it")
+	// ErrRelayUnknownSource is returned when a relay opens a circuit to us
+	// without telling us who it comes from
+	ErrRelayUnknownSource = errors.New("Circuit source is unknown")
+)
+
+// RelayCircuit holds the accounting for a single circuit going through
+// this relay
+type RelayCircuit struct {
+	ID uint64
+	// Hop is the position of this relay in the circuit, starting from 0
+	Hop int
+	// Next is the peer id of the next relay, or the target's for the last hop
+	Next    string
+	Target  string
+	Started time.Time
+	// BytesIn are the bytes sent towards the target, BytesOut the ones sent
+	// back towards the dialer
+	BytesIn  int64
+	BytesOut int64
+}
+
 // Relay -
 type Relay struct {
-	net Network
+	net             Network
+	mutex           sync.Mutex
+	reservations    map[string]io.ReadWriteCloser
+	maxReservations int
+	circuits        map[uint64]*RelayCircuit
+	maxCircuits     int
+	maxHops         int
+	lastCircuitID   uint64
+	// handle is given the circuits relays open to us, as streams from the
+	// peers the circuits come from
+	handle func(rwc io.ReadWriteCloser) error
+}
+
+// NewRelay -
+func NewRelay(n Network) *Relay {
+	return &Relay{
+		net:             n,
+		reservations:    map[string]io.ReadWriteCloser{},
+		maxReservations: maxRelayReservations,
+		circuits:        map[uint64]*RelayCircuit{},
+		maxCircuits:     maxRelayCircuits,
+		maxHops:         maxRelayHops,
+	}
+}
+
+// Circuits returns the circuits currently going through this relay
+func (r *Relay) Circuits() []RelayCircuit {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	circuits := make([]RelayCircuit, 0, len(r.circuits))
+	for _, circuit := range r.circuits {
+		cc := *circuit
+		cc.BytesIn = atomic.LoadInt64(&circuit.BytesIn)
+		cc.BytesOut = atomic.LoadInt64(&circuit.BytesOut)
+		circuits = append(circuits, cc)
+	}
+	sort.Slice(circuits, func(i, j int) bool {
+		return circuits[i].ID < circuits[j].ID
+	})
+	return circuits
 }
 
 func (r *Relay) handleNewStream(protocolID string, rwc io.ReadWriteCloser) error {
 	logrus.Infof("New relay stream with protocolID " + protocolID)
-	// defer rwc.Close()
 
-	reader := bufio.NewReader(rwc)
-	taddr, err := reader.ReadString('\n')
-	if err != nil {
+	req := &relayRequest{}
+	if err := readMessage(rwc, req); err != nil {
+		rwc.Close()
 		return err
 	}
 
-	taddr = strings.Trim(taddr, "\n")
+	if req.Version != RelayProtocolVersion {
+		rwc.Close()
+		return ErrRelayUnsupportedVersion
+	}
+
+	switch req.Type {
+	case relayRequestConnect:
+		return r.handleConnect(req, rwc)
+	case relayRequestReserve:
+		return r.handleReserve(req, rwc)
+	case relayRequestStop:
+		return r.handleStop(req, rwc)
+	}
+
+	rwc.Close()
+	return errors.New("Unknown relay request type " + req.Type)
+}
+
+func (r *Relay) handleConnect(req *relayRequest, rwc io.ReadWriteCloser) error {
+	logger := logrus.
+		WithField("taddr", req.Target).
+		WithField("route", req.Route).
+		WithField("hop", req.Hops)
+
+	if req.Hops >= r.maxHops {
+		r.respond(rwc, RelayStatusPermissionDenied, ErrRelayHopLimit)
+		rwc.Close()
+		return ErrRelayHopLimit
+	}
 
-	// dial target
-	c, err := r.net.Dial(taddr)
+	// the first relay knows who the circuit comes from, the rest are told
+	// by the relay before them
+	source := streamPeerID(rwc)
+	if req.Hops > 0 {
+		source = req.Peer
+	}
+	if source == "" {
+		r.respond(rwc, RelayStatusPermissionDenied, ErrRelayUnknownSource)
+		rwc.Close()
+		return ErrRelayUnknownSource
+	}
+
+	lpid := r.net.GetLocalPeer().ID
+	for _, rpid := range req.Route {
+		if rpid == lpid {
+			r.respond(rwc, RelayStatusPermissionDenied, ErrRelayLoop)
+			rwc.Close()
+			return ErrRelayLoop
+		}
+	}
+
+	circuit, err := r.openCircuit(req)
+	if err != nil {
+		r.respond(rwc, RelayStatusResourceLimit, err)
+		rwc.Close()
+		return err
+	}
+
+	var c net.Conn
+	if len(req.Route) > 0 {
+		// forward the request to the next relay in the route
+		c, err = r.dialNext(req, source)
+	} else if !r.hasReservation(circuit.Next) {
+		// we only relay to peers that asked us to
+		err = &RelayError{
+			Relay:   lpid,
+			Status:  RelayStatusNoReservation,
+			Message: ErrRelayNoReservation.Error(),
+		}
+	} else {
+		c, err = r.dialTarget(req.Target, source)
+	}
 	if err != nil {
-		logrus.
-			WithField("taddr", taddr).
+		logger.
 			WithError(err).
-			Warnf("Could not dial peer")
+			Warnf("Could not dial next hop")
+		r.closeCircuit(circuit)
+		r.respondError(rwc, err)
+		rwc.Close()
+		return err
+	}
+
+	if err := r.respond(rwc, RelayStatusOK, nil); err != nil {
+		r.closeCircuit(circuit)
+		c.Close()
+		rwc.Close()
 		return err
 	}
 
 	go func() {
-		if err := Pipe(c, rwc); err != nil {
-			logrus.
-				WithError(err).
-				Errorf("Could not start pipe")
+		defer r.closeCircuit(circuit)
+		err := pipe(rwc, c, &circuit.BytesIn, &circuit.BytesOut)
+		logger = logger.
+			WithField("circuit", circuit.ID).
+			WithField("bytesIn", atomic.LoadInt64(&circuit.BytesIn)).
+			WithField("bytesOut", atomic.LoadInt64(&circuit.BytesOut))
+		if err != nil {
+			logger.WithError(err).Debugf("Circuit closed with error")
+			return
 		}
+		logger.Debugf("Circuit closed")
 	}()
 
-	rwc.Write([]byte("ok\n"))
+	return nil
+}
+
+// dialTarget opens a stream to the target, tells it which peer the circuit
+// comes from and selects the protocol the peer asked for
+func (r *Relay) dialTarget(target, source string) (net.Conn, error) {
+	unreachable := func(err error) error {
+		if _, ok := err.(*RelayError); ok {
+			return err
+		}
+		return &RelayError{
+			Relay:   r.net.GetLocalPeer().ID,
+			Status:  RelayStatusTargetUnreachable,
+			Message: err.Error(),
+		}
+	}
+
+	tpid, protocolID, err := parsePeerAddress(target)
+	if err != nil {
+		return nil, unreachable(err)
+	}
+
+	c, err := r.net.Dial(tpid + "/" + RelayProtocolID)
+	if err != nil {
+		return nil, unreachable(err)
+	}
+
+	req := &relayRequest{
+		Version: RelayProtocolVersion,
+		Type:    relayRequestStop,
+		Peer:    source,
+	}
+	if err := r.request(context.Background(), tpid, c, req); err != nil {
+		c.Close()
+		return nil, unreachable(err)
+	}
+
+	if err := ms.SelectProtoOrFail(protocolID, c); err != nil {
+		c.Close()
+		return nil, unreachable(err)
+	}
+
+	return c, nil
+}
+
+// handleStop accepts a circuit a relay opened to us, the stream is then
+// handled as if the peer the circuit comes from had opened it
+func (r *Relay) handleStop(req *relayRequest, rwc io.ReadWriteCloser) error {
+	st, ok := rwc.(*peerStream)
+	if !ok || req.Peer == "" || r.handle == nil {
+		r.respond(rwc, RelayStatusPermissionDenied, ErrRelayUnknownSource)
+		rwc.Close()
+		return ErrRelayUnknownSource
+	}
+
+	if err := r.respond(rwc, RelayStatusOK, nil); err != nil {
+		rwc.Close()
+		return err
+	}
+
+	logrus.
+		WithField("rpid", st.pid).
+		WithField("pid", req.Peer).
+		Debugf("Accepted relayed circuit")
+
+	return r.handle(&peerStream{st.Conn, req.Peer})
+}
+
+// dialNext opens a stream to the next relay in the request's route and asks
+// it to continue the circuit
+func (r *Relay) dialNext(req *relayRequest, source string) (net.Conn, error) {
+	rpid := req.Route[0]
+	c, err := r.net.Dial(rpid + "/" + RelayProtocolID)
+	if err != nil {
+		return nil, &RelayError{
+			Relay:   r.net.GetLocalPeer().ID,
+			Status:  RelayStatusTargetUnreachable,
+			Message: err.Error(),
+		}
+	}
+
+	nreq := &relayRequest{
+		Version: RelayProtocolVersion,
+		Type:    relayRequestConnect,
+		Target:  req.Target,
+		Peer:    source,
+		Route:   req.Route[1:],
+		Hops:    req.Hops + 1,
+	}
+	if err := r.request(context.Background(), rpid, c, nreq); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// hasReservation checks if a peer holds a reservation with us
+func (r *Relay) hasReservation(pid string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	_, ok := r.reservations[pid]
+	return ok
+}
+
+func (r *Relay) openCircuit(req *relayRequest) (*RelayCircuit, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if len(r.circuits) >= r.maxCircuits {
+		return nil, ErrRelayNoCircuitSlots
+	}
+
+	next, _, _ := parsePeerAddress(req.Target)
+	if len(req.Route) > 0 {
+		next = req.Route[0]
+	}
+
+	r.lastCircuitID++
+	circuit := &RelayCircuit{
+		ID:      r.lastCircuitID,
+		Hop:     req.Hops,
+		Next:    next,
+		Target:  req.Target,
+		Started: time.Now(),
+	}
+	r.circuits[circuit.ID] = circuit
+	return circuit, nil
+}
 
+func (r *Relay) closeCircuit(circuit *RelayCircuit) {
+	r.mutex.Lock()
+	delete(r.circuits, circuit.ID)
+	r.mutex.Unlock()
+}
+
+// handleReserve keeps a reservation for the peer until it closes the stream.
+// The peer's session stays open for as long as the reservation is held, which
+// allows the relay to reach peers that it could not dial on its own.
+// Reservations are kept for the peer on the other end of the stream, which
+// can't ask for one on behalf of someone else.
+func (r *Relay) handleReserve(req *relayRequest, rwc io.ReadWriteCloser) error {
+	pid := streamPeerID(rwc)
+	logger := logrus.WithField("pid", pid)
+
+	if pid == "" || req.Peer != pid {
+		logger.
+			WithField("rpid", req.Peer).
+			Warnf("Peer asked for a reservation for someone else")
+		r.respond(rwc, RelayStatusPermissionDenied, ErrRelayReservationMismatch)
+		rwc.Close()
+		return ErrRelayReservationMismatch
+	}
+
+	r.mutex.Lock()
+	if _, ok := r.reservations[pid]; !ok && len(r.reservations) >= r.maxReservations {
+		r.mutex.Unlock()
+		r.respond(rwc, RelayStatusResourceLimit, ErrRelayNoReservationSlots)
+		rwc.Close()
+		return ErrRelayNoReservationSlots
+	}
+	if prwc, ok := r.reservations[pid]; ok {
+		prwc.Close()
+	}
+	r.reservations[pid] = rwc
+	r.mutex.Unlock()
+
+	if err := r.respond(rwc, RelayStatusOK, nil); err != nil {
+		r.removeReservation(pid, rwc)
+		return err
+	}
+
+	logger.Infof("Reservation accepted")
+
+	// nothing is expected on this stream, wait for it to close
+	io.Copy(ioutil.Discard, rwc)
+	r.removeReservation(pid, rwc)
+
+	logger.Infof("Reservation dropped")
 	return nil
 }
 
+func (r *Relay) removeReservation(pid string, rwc io.ReadWriteCloser) {
+	r.mutex.Lock()
+	if r.reservations[pid] == rwc {
+		delete(r.reservations, pid)
+	}
+	r.mutex.Unlock()
+	rwc.Close()
+}
+
+func (r *Relay) respond(w io.Writer, status RelayStatus, err error) error {
+	res := &relayResponse{
+		Version: RelayProtocolVersion,
+		Status:  status,
+		Relay:   r.net.GetLocalPeer().ID,
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return writeMessage(w, res)
+}
+
+// respondError passes errors from further down the circuit back to the
+// dialer as they are, so it knows which relay failed
+func (r *Relay) respondError(w io.Writer, err error) error {
+	rerr, ok := err.(*RelayError)
+	if !ok {
+		return r.respond(w, RelayStatusTargetUnreachable, err)
+	}
+	return writeMessage(w, &relayResponse{
+		Version: RelayProtocolVersion,
+		Status:  rerr.Status,
+		Relay:   rerr.Relay,
+		Error:   rerr.Message,
+	})
+}
+
 // Dial -
 func (r *Relay) Dial(addr string) (net.Conn, error) {
 	return r.DialContext(context.Background(), addr)
@@ -58,81 +446,193 @@ func (r *Relay) Dial(addr string) (net.Conn, error) {
 
 // DialContext -
 func (r *Relay) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	return r.DialStream(ctx, addr)
+}
+
+// DialStream asks the relays on the route to connect us to the target peer.
+// The returned connection is a stream to the target's protocol, as it is
+// already multiplexed by the relays it can't be upgraded to a session.
+func (r *Relay) DialStream(ctx context.Context, addr string) (net.Conn, error) {
 	if r.matches(addr) == false {
 		return nil, ErrTransportNotSupported
 	}
 
-	raddr, err := r.getRelayAddr(addr)
+	a, err := ParseAddress(addr)
 	if err != nil {
 		return nil, err
 	}
 
-	taddr, err := r.getTargetAddr(addr)
-	if err != nil {
-		return nil, err
-	}
+	route := a.Route
+	taddr := r.getTargetAddr(a)
 
-	raddr = raddr + "/relay"
+	rpid := route[0]
+	raddr := rpid + "/" + RelayProtocolID
 
 	logrus.
 		WithField("addr", addr).
 		WithField("raddr", raddr).
 		WithField("taddr", taddr).
+		WithField("route", route).
 		Warnf("Dialing target peer")
 
-	c, err := r.net.Dial(raddr)
+	c, err := r.dial(ctx, raddr)
 	if err != nil {
 		return nil, err
 	}
 
-	c.Write([]byte(taddr + "\n"))
+	req := &relayRequest{
+		Version: RelayProtocolVersion,
+		Type:    relayRequestConnect,
+		Target:  taddr,
+		Route:   route[1:],
+	}
+	if err := r.request(ctx, rpid, c, req); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
 
-	reader := bufio.NewReader(c)
-	if _, err := reader.ReadString('\n'); err != nil {
+// Reserve asks a relay to keep a reservation for the local peer.
+// The reservation is held for as long as the returned stream is open.
+func (r *Relay) Reserve(rpid string) (io.ReadWriteCloser, error) {
+	return r.ReserveContext(context.Background(), rpid)
+}
+
+// ReserveContext is Reserve, but gives up waiting for the relay to respond
+// once the context is done
+func (r *Relay) ReserveContext(ctx context.Context, rpid string) (io.ReadWriteCloser, error) {
+	c, err := r.dial(ctx, rpid+"/"+RelayProtocolID)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &relayRequest{
+		Version: RelayProtocolVersion,
+		Type:    relayRequestReserve,
+		Peer:    r.net.GetLocalPeer().ID,
+	}
+	if err := r.request(ctx, rpid, c, req); err != nil {
+		c.Close()
 		return nil, err
 	}
 
 	return c, nil
 }
 
+// dial opens a stream to a relay, giving up once the context is done if the
+// network supports it
+func (r *Relay) dial(ctx context.Context, addr string) (net.Conn, error) {
+	if d, ok := r.net.(interface {
+		DialWithContext(ctx context.Context, addr string) (net.Conn, error)
+	}); ok {
+		return d.DialWithContext(ctx, addr)
+	}
+	return r.net.Dial(addr)
+}
+
+// request sends a request to a relay and waits for its response, for no
+// longer than the context allows or relayRequestTimeout if it has no deadline
+func (r *Relay) request(ctx context.Context, rpid string, c net.Conn, req *relayRequest) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(relayRequestTimeout)
+	}
+	c.SetDeadline(deadline)
+
+	// cancelling the context unblocks the request as well
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			c.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	res := &relayResponse{}
+	err := writeMessage(c, req)
+	if err == nil {
+		err = readMessage(c, res)
+	}
+
+	close(stop)
+	<-stopped
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+
+	// the stream is used for the circuit or the reservation from now on
+	c.SetDeadline(time.Time{})
+
+	if res.Version != RelayProtocolVersion {
+		return ErrRelayUnsupportedVersion
+	}
+
+	if res.Status != RelayStatusOK {
+		// the error might have come from a relay further down the route
+		if res.Relay != "" {
+			rpid = res.Relay
+		}
+		return &RelayError{
+			Relay:   rpid,
+			Status:  res.Status,
+			Message: res.Error,
+		}
+	}
+
+	return nil
+}
+
 // Listen -
 func (r *Relay) Listen(addr string) (net.Listener, error) {
 	return nil, errors.New("Not implemented")
 }
 
-func (r *Relay) matches(addr string) bool {
-	pr := strings.Split(addr, ":")[0]
-	if pr == "relay" {
-		return true
-	}
-	return false
+// Schemes -
+func (r *Relay) Schemes() []string {
+	return []string{"relay"}
 }
 
-func (r *Relay) getRelayAddr(addr string) (string, error) {
-	pa := strings.Split(addr, "/")[0]
-	pr := strings.Split(pa, ":")
-	if len(pr) < 2 {
-		return "", errors.New("Invalid address")
+// CanDial -
+func (r *Relay) CanDial(addr string) bool {
+	if r.matches(addr) == false {
+		return false
 	}
-	return strings.Join(pr[1:], ":"), nil
+	_, err := ParseAddress(addr)
+	return err == nil
 }
 
-func (r *Relay) getTargetAddr(addr string) (string, error) {
-	pa := strings.Split(addr, "/")
-	if len(pa) < 2 {
-		return "", errors.New("Invalid address")
+func (r *Relay) matches(addr string) bool {
+	return getScheme(addr) == "relay"
+}
+
+// getTargetAddr returns the address the last relay in the route dials,
+// ie. `target/proto`
+func (r *Relay) getTargetAddr(a *Address) string {
+	if a.Protocol == "" {
+		return a.Peer
 	}
-	return strings.Join(pa[1:], "/"), nil
+	return a.Peer + "/" + a.Protocol
 }
 
-func Pipe(a, b io.ReadWriteCloser) error {
-	done := make(chan error, 1)
-	cp := func(r, w io.ReadWriteCloser) {
-		n, err := io.Copy(r, w)
-		logrus.Infof("copied %d bytes", n)
-		done <- err
+// getRelayRoute returns the relays in a relay address, or nil if the address
+// is not a relay address
+func getRelayRoute(addr string) []string {
+	a, err := ParseAddress(addr)
+	if err != nil || !a.IsRelay() {
+		return nil
 	}
-	go cp(a, b)
-	go cp(b, a)
-	return <-done
+	return a.Route
+}
+
+// isRelayAddress checks if an address goes through a relay
+func isRelayAddress(addr string) bool {
+	return getScheme(addr) == "relay"
 }
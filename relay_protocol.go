@@ -0,0 +1,104 @@
+package net
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// RelayProtocolID is the stream protocol relays register in the mux
+	RelayProtocolID = "/relay/v1"
+	// RelayProtocolVersion is the version of the relay wire format
+	RelayProtocolVersion = 1
+)
+
+var (
+	// ErrRelayUnsupportedVersion is returned when the other end speaks a
+	// different version of the relay wire format
+	ErrRelayUnsupportedVersion = errors.New("Unsupported relay protocol version")
+)
+
+// RelayStatus is the status code a relay responds with to a relay request
+type RelayStatus int
+
+const (
+	// RelayStatusOK means the relay connected us to the target
+	RelayStatusOK RelayStatus = iota
+	// RelayStatusNoReservation means the target has no reservation with
+	// the relay
+	RelayStatusNoReservation
+	// RelayStatusPermissionDenied means the relay refuses to relay for us
+	RelayStatusPermissionDenied
+	// RelayStatusResourceLimit means the relay is out of resources
+	RelayStatusResourceLimit
+	// RelayStatusTargetUnreachable means the relay could not dial the target
+	RelayStatusTargetUnreachable
+)
+
+// String returns the wire name of the status
+func (s RelayStatus) String() string {
+	switch s {
+	case RelayStatusOK:
+		return "OK"
+	case RelayStatusNoReservation:
+		return "NO_RESERVATION"
+	case RelayStatusPermissionDenied:
+		return "PERMISSION_DENIED"
+	case RelayStatusResourceLimit:
+		return "RESOURCE_LIMIT"
+	case RelayStatusTargetUnreachable:
+		return "TARGET_UNREACHABLE"
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", int(s))
+}
+
+// RelayError is returned by the relay transport when the relay did not
+// respond with RelayStatusOK
+type RelayError struct {
+	Relay   string
+	Status  RelayStatus
+	Message string
+}
+
+// Error -
+func (e *RelayError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("Relay %s responded with %s", e.Relay, e.Status)
+	}
+	return fmt.Sprintf("Relay %s responded with %s: %s", e.Relay, e.Status, e.Message)
+}
+
+const (
+	// relayRequestConnect asks the relay to connect us to a target
+	relayRequestConnect = "connect"
+	// relayRequestReserve asks the relay to keep a slot for us for as long
+	// as the stream stays open
+	relayRequestReserve = "reserve"
+	// relayRequestStop is sent by the last relay of a circuit to the target,
+	// telling it which peer the circuit comes from
+	relayRequestStop = "stop"
+)
+
+// relayRequest is sent by the dialer once the relay stream is open
+type relayRequest struct {
+	Version int    `json:"version"`
+	Type    string `json:"type"`
+	Target  string `json:"target,omitempty"`
+	// Peer is the peer asking for a reservation, or the one a circuit comes
+	// from when relays forward a request or open it to the target
+	Peer string `json:"peer,omitempty"`
+	// Route holds the relays the circuit still has to go through after the
+	// one receiving the request, Hops how many it has already gone through
+	Route []string `json:"route,omitempty"`
+	Hops  int      `json:"hops,omitempty"`
+}
+
+// relayResponse is sent back by the relay once it has tried to reach the
+// target, error holds the target's dial error if there was one and relay the
+// id of the relay that failed
+type relayResponse struct {
+	Version int         `json:"version"`
+	Status  RelayStatus `json:"status"`
+	Relay   string      `json:"relay,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
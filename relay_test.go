@@ -0,0 +1,229 @@
+package net
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestRelayHalfClose(t *testing.T) {
+	_, a, b := newRelayedPeers(t, "relay-half-close")
+
+	// b is done writing before it reads what a has to say
+	received := make(chan string, 1)
+	b.RegisterStreamHandler("half", func(protocolID string, rwc io.ReadWriteCloser) error {
+		defer rwc.Close()
+		rwc.Write([]byte("hello"))
+		if cw, ok := rwc.(closeWriter); ok {
+			cw.CloseWrite()
+		}
+		buf := make([]byte, 3)
+		io.ReadFull(rwc, buf)
+		received <- string(buf)
+		return nil
+	})
+
+	c, err := a.Dial(b.GetLocalPeer().ID + "/half")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("Expected hello, got %q", buf)
+	}
+
+	// the relay only closed our reading side, we can still respond
+	if _, err := c.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case r := <-received:
+		if r != "bye" {
+			t.Fatalf("Expected bye, got %q", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Response did not get through the relay")
+	}
+}
+
+func TestRelayReservationForSomeoneElse(t *testing.T) {
+	r, a, b := newRelayedPeers(t, "relay-spoof")
+
+	// a can't take over b's reservation
+	c, err := a.Dial(r.GetLocalPeer().ID + "/" + RelayProtocolID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = NewRelay(a).request(context.Background(), r.GetLocalPeer().ID, c, &relayRequest{
+		Version: RelayProtocolVersion,
+		Type:    relayRequestReserve,
+		Peer:    b.GetLocalPeer().ID,
+	})
+	if rerr, ok := err.(*RelayError); !ok || rerr.Status != RelayStatusPermissionDenied {
+		t.Fatalf("Expected PERMISSION_DENIED, got %v", err)
+	}
+
+	echo(t, a, b.GetLocalPeer().ID+"/echo")
+}
+
+func TestRelayNoReservation(t *testing.T) {
+	r, a, _ := newRelayedPeers(t, "relay-no-reservation")
+	newTestNetwork(t, &Peer{
+		ID:        "relay-no-reservation-c",
+		Addresses: []string{"mem:relay-no-reservation-c"},
+	})
+
+	// the relay could dial c, but c has not asked it to relay for it
+	err := r.PutPeer(Peer{
+		ID:        "relay-no-reservation-c",
+		Addresses: []string{"mem:relay-no-reservation-c"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewRelay(a).Dial(NewRelayAddress("relay-no-reservation-c", r.GetLocalPeer().ID).String())
+	if rerr, ok := err.(*RelayError); !ok || rerr.Status != RelayStatusNoReservation {
+		t.Fatalf("Expected NO_RESERVATION, got %v", err)
+	}
+}
+
+func TestRelayRequestTimeout(t *testing.T) {
+	a := newTestNetwork(t, &Peer{
+		ID:        "relay-timeout-a",
+		Addresses: []string{"mem:relay-timeout-a"},
+	})
+	s := newTestNetwork(t, &Peer{
+		ID:        "relay-timeout-s",
+		Addresses: []string{"mem:relay-timeout-s"},
+	})
+
+	// s accepts relay streams but never responds
+	s.RegisterStreamHandler(RelayProtocolID, func(protocolID string, rwc io.ReadWriteCloser) error {
+		defer rwc.Close()
+		_, err := io.Copy(ioutil.Discard, rwc)
+		return err
+	})
+	err := a.PutPeer(Peer{
+		ID:        "relay-timeout-s",
+		Addresses: []string{"mem:relay-timeout-s"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := NewRelay(a).ReserveContext(ctx, "relay-timeout-s"); err == nil {
+		t.Fatal("Expected reservation to fail")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("Reservation gave up after %s", d)
+	}
+}
+
+// newRelayChain returns a peer and a target that is only reachable through
+// the relays, one after the other
+func newRelayChain(t *testing.T, prefix string, relays int) (*network, *network, []*network) {
+	rs := []*network{}
+	for i := 0; i < relays; i++ {
+		id := fmt.Sprintf("%s-r%d", prefix, i)
+		rs = append(rs, newTestNetwork(t, &Peer{
+			ID:        id,
+			Addresses: []string{"mem:" + id},
+		}))
+	}
+	a := newTestNetwork(t, &Peer{
+		ID:        prefix + "-a",
+		Addresses: []string{"mem:" + prefix + "-a"},
+	})
+	b := newTestNetwork(t, &Peer{
+		ID:        prefix + "-b",
+		Addresses: []string{"mem:" + prefix + "-b"},
+	})
+	connectRelayed(t, rs[len(rs)-1], b)
+
+	// every relay only knows how to reach the next one
+	prev := a
+	for _, r := range rs {
+		err := prev.PutPeer(Peer{
+			ID:        r.GetLocalPeer().ID,
+			Addresses: r.getLocalAddresses(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		prev = r
+	}
+	return a, b, rs
+}
+
+func relayRoute(rs []*network) []string {
+	route := []string{}
+	for _, r := range rs {
+		route = append(route, r.GetLocalPeer().ID)
+	}
+	return route
+}
+
+func TestRelayMultiHop(t *testing.T) {
+	a, b, rs := newRelayChain(t, "relay-multi-hop", 3)
+
+	received := make(chan string, 1)
+	b.RegisterStreamHandler("whoami", func(protocolID string, rwc io.ReadWriteCloser) error {
+		defer rwc.Close()
+		received <- streamPeerID(rwc)
+		return nil
+	})
+
+	// the target is told who the circuit comes from, not the last relay
+	addr := NewRelayAddress(b.GetLocalPeer().ID, relayRoute(rs)...).String()
+	c, err := NewRelay(a).Dial(addr + "/whoami")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	select {
+	case pid := <-received:
+		if pid != a.GetLocalPeer().ID {
+			t.Fatalf("Expected stream from %s, got %s", a.GetLocalPeer().ID, pid)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stream did not get through the relays")
+	}
+}
+
+func TestRelayHopLimit(t *testing.T) {
+	a, b, rs := newRelayChain(t, "relay-hop-limit", 3)
+
+	// the last relay is one hop too many for the one before it
+	rs[1].autoRelay.relay.maxHops = 1
+
+	addr := NewRelayAddress(b.GetLocalPeer().ID, relayRoute(rs)...).String()
+	_, err := NewRelay(a).Dial(addr + "/echo")
+	if rerr, ok := err.(*RelayError); !ok || rerr.Status != RelayStatusPermissionDenied {
+		t.Fatalf("Expected PERMISSION_DENIED, got %v", err)
+	}
+}
+
+func TestRelayLoop(t *testing.T) {
+	a, b, rs := newRelayChain(t, "relay-loop", 2)
+
+	route := append(relayRoute(rs), rs[0].GetLocalPeer().ID)
+	addr := NewRelayAddress(b.GetLocalPeer().ID, route...).String()
+	_, err := NewRelay(a).Dial(addr + "/echo")
+	if rerr, ok := err.(*RelayError); !ok || rerr.Status != RelayStatusPermissionDenied {
+		t.Fatalf("Expected PERMISSION_DENIED, got %v", err)
+	}
+}
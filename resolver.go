@@ -0,0 +1,173 @@
+package net
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultDNSTTL is how long the system resolver's answers are cached for,
+	// as it does not report the records' TTLs, see WithDNSTTL
+	DefaultDNSTTL = time.Minute
+)
+
+// Resolver looks up the IPs of host names
+type Resolver interface {
+	// LookupIP returns the IPs of a host for a network, `ip`, `ip4` or `ip6`,
+	// along with how long they can be cached for
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, time.Duration, error)
+}
+
+// systemResolver uses the operating system's resolver
+type systemResolver struct {
+	ttl time.Duration
+}
+
+// NewSystemResolver returns a resolver that uses the operating system's
+// resolver, answers are cached for the given ttl
+func NewSystemResolver(ttl time.Duration) Resolver {
+	return &systemResolver{
+		ttl: ttl,
+	}
+}
+
+// LookupIP -
+func (r *systemResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, time.Duration, error) {
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ips, r.ttl, nil
+}
+
+// cachingResolver caches the answers of another resolver for as long as
+// their TTL allows
+type cachingResolver struct {
+	mutex    sync.Mutex
+	resolver Resolver
+	entries  map[string]*resolverEntry
+}
+
+type resolverEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+func newCachingResolver(resolver Resolver) *cachingResolver {
+	return &cachingResolver{
+		resolver: resolver,
+		entries:  map[string]*resolverEntry{},
+	}
+}
+
+// setResolver replaces the underlying resolver and drops its cached answers
+func (c *cachingResolver) setResolver(resolver Resolver) {
+	c.mutex.Lock()
+	c.resolver = resolver
+	c.entries = map[string]*resolverEntry{}
+	c.mutex.Unlock()
+}
+
+// LookupIP -
+func (c *cachingResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, time.Duration, error) {
+	key := network + "/" + host
+	now := time.Now()
+
+	c.mutex.Lock()
+	if e, ok := c.entries[key]; ok && now.Before(e.expires) {
+		c.mutex.Unlock()
+		return e.ips, e.expires.Sub(now), nil
+	}
+	resolver := c.resolver
+	c.mutex.Unlock()
+
+	ips, ttl, err := resolver.LookupIP(ctx, network, host)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if ttl <= 0 {
+		return ips, ttl, nil
+	}
+
+	c.mutex.Lock()
+	// the resolver might have been replaced while we were waiting on it
+	if c.resolver == resolver {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.entries[key] = &resolverEntry{
+			ips:     ips,
+			expires: now.Add(ttl),
+		}
+	}
+	c.mutex.Unlock()
+
+	return ips, ttl, nil
+}
+
+// resolveAddresses replaces `dns`, `dns4` and `dns6` addresses with the
+// `tcp4` and `tcp6` addresses their hosts resolve to, other addresses are
+// left as they are
+func resolveAddresses(ctx context.Context, resolver Resolver, addrs []string) []string {
+	raddrs := []string{}
+	seen := map[string]bool{}
+	add := func(addr string) {
+		if seen[addr] {
+			return
+		}
+		seen[addr] = true
+		raddrs = append(raddrs, addr)
+	}
+
+	for _, addr := range addrs {
+		network, ok := map[string]string{
+			"dns":  "ip",
+			"dns4": "ip4",
+			"dns6": "ip6",
+		}[getScheme(addr)]
+		if !ok {
+			add(addr)
+			continue
+		}
+
+		a, err := ParseAddress(addr)
+		if err != nil {
+			continue
+		}
+
+		ips, _, err := resolver.LookupIP(ctx, network, a.Host)
+		if err != nil {
+			logrus.
+				WithError(err).
+				WithField("addr", addr).
+				Debugf("Could not resolve address")
+			continue
+		}
+
+		for _, ip := range ips {
+			// resolvers might not filter answers by family
+			if (network == "ip4" && ip.To4() == nil) || (network == "ip6" && ip.To4() != nil) {
+				continue
+			}
+			ra := &Address{
+				Scheme:   "tcp4",
+				Host:     ip.String(),
+				Port:     a.Port,
+				Protocol: a.Protocol,
+			}
+			if ip.To4() == nil {
+				ra.Scheme = "tcp6"
+			}
+			add(ra.String())
+		}
+	}
+
+	return raddrs
+}
@@ -0,0 +1,217 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errNoSuchHost = errors.New("No such host")
+
+// fakeResolver answers with fixed IPs and counts its lookups
+type fakeResolver struct {
+	mutex   sync.Mutex
+	hosts   map[string][]net.IP
+	ttl     time.Duration
+	lookups int
+}
+
+func (r *fakeResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, time.Duration, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.lookups++
+	ips, ok := r.hosts[host]
+	if !ok {
+		return nil, 0, errNoSuchHost
+	}
+	return ips, r.ttl, nil
+}
+
+func (r *fakeResolver) getLookups() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.lookups
+}
+
+func TestCachingResolverExpiry(t *testing.T) {
+	fr := &fakeResolver{
+		hosts: map[string][]net.IP{
+			"example.com": {net.ParseIP("1.2.3.4")},
+		},
+		ttl: 100 * time.Millisecond,
+	}
+	cr := newCachingResolver(fr)
+	ctx := context.Background()
+
+	if _, _, err := cr.LookupIP(ctx, "ip", "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	_, ttl, err := cr.LookupIP(ctx, "ip", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fr.getLookups() != 1 {
+		t.Fatalf("Expected the answer to be cached, got %d lookups", fr.getLookups())
+	}
+	if ttl <= 0 || ttl > fr.ttl {
+		t.Fatalf("Expected the remaining ttl, got %s", ttl)
+	}
+
+	// networks are cached separately
+	if _, _, err := cr.LookupIP(ctx, "ip4", "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if fr.getLookups() != 2 {
+		t.Fatalf("Expected 2 lookups, got %d", fr.getLookups())
+	}
+
+	time.Sleep(fr.ttl)
+	if _, _, err := cr.LookupIP(ctx, "ip", "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if fr.getLookups() != 3 {
+		t.Fatalf("Expected the answer to expire, got %d lookups", fr.getLookups())
+	}
+}
+
+func TestCachingResolverNegative(t *testing.T) {
+	fr := &fakeResolver{
+		hosts: map[string][]net.IP{},
+		ttl:   time.Minute,
+	}
+	cr := newCachingResolver(fr)
+	ctx := context.Background()
+
+	if _, _, err := cr.LookupIP(ctx, "ip", "example.com"); err != errNoSuchHost {
+		t.Fatalf("Expected errNoSuchHost, got %v", err)
+	}
+
+	// failures are not cached, the host is looked up again once it exists
+	fr.mutex.Lock()
+	fr.hosts["example.com"] = []net.IP{net.ParseIP("1.2.3.4")}
+	fr.mutex.Unlock()
+
+	ips, _, err := cr.LookupIP(ctx, "ip", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || fr.getLookups() != 2 {
+		t.Fatalf("Expected a second lookup, got %v after %d", ips, fr.getLookups())
+	}
+}
+
+func TestCachingResolverNoTTL(t *testing.T) {
+	fr := &fakeResolver{
+		hosts: map[string][]net.IP{
+			"example.com": {net.ParseIP("1.2.3.4")},
+		},
+	}
+	cr := newCachingResolver(fr)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := cr.LookupIP(ctx, "ip", "example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fr.getLookups() != 2 {
+		t.Fatalf("Expected answers without a ttl not to be cached, got %d lookups", fr.getLookups())
+	}
+}
+
+func TestCachingResolverSetResolver(t *testing.T) {
+	fr := &fakeResolver{
+		hosts: map[string][]net.IP{
+			"example.com": {net.ParseIP("1.2.3.4")},
+		},
+		ttl: time.Minute,
+	}
+	cr := newCachingResolver(fr)
+	ctx := context.Background()
+
+	if _, _, err := cr.LookupIP(ctx, "ip", "example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the new resolver's answers are used right away
+	nr := &fakeResolver{
+		hosts: map[string][]net.IP{
+			"example.com": {net.ParseIP("5.6.7.8")},
+		},
+		ttl: time.Minute,
+	}
+	cr.setResolver(nr)
+	ips, _, err := cr.LookupIP(ctx, "ip", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("5.6.7.8")) {
+		t.Fatalf("Expected 5.6.7.8, got %v", ips)
+	}
+}
+
+func TestResolveAddresses(t *testing.T) {
+	fr := &fakeResolver{
+		hosts: map[string][]net.IP{
+			"example.com": {
+				net.ParseIP("1.2.3.4"),
+				net.ParseIP("2001:db8::1"),
+			},
+		},
+	}
+
+	for addr, expected := range map[string][]string{
+		"dns:example.com:21600/proto": {
+			"tcp4:1.2.3.4:21600/proto",
+			"tcp6:[2001:db8::1]:21600/proto",
+		},
+		// resolvers might not filter answers by family
+		"dns4:example.com:21600": {
+			"tcp4:1.2.3.4:21600",
+		},
+		"dns6:example.com:21600": {
+			"tcp6:[2001:db8::1]:21600",
+		},
+		"dns:unknown.example.com:21600": {},
+		"tcp4:5.6.7.8:21600": {
+			"tcp4:5.6.7.8:21600",
+		},
+		"mem:n1": {
+			"mem:n1",
+		},
+	} {
+		raddrs := resolveAddresses(context.Background(), fr, []string{addr})
+		if !reflect.DeepEqual(raddrs, expected) {
+			t.Fatalf("Expected %s to resolve to %v, got %v", addr, expected, raddrs)
+		}
+	}
+
+	// addresses that resolve to the same ones are only dialed once
+	raddrs := resolveAddresses(context.Background(), fr, []string{
+		"tcp4:1.2.3.4:21600",
+		"dns4:example.com:21600",
+	})
+	if len(raddrs) != 1 {
+		t.Fatalf("Expected duplicates to be removed, got %v", raddrs)
+	}
+}
+
+func TestWithDNSTTL(t *testing.T) {
+	n, err := NewNetwork(&Peer{
+		ID:        "dns-ttl",
+		Addresses: []string{"mem:dns-ttl"},
+	}, 0, WithPortMapperDiscovery(false), WithDNSTTL(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	sr, ok := n.(*network).resolver.resolver.(*systemResolver)
+	if !ok || sr.ttl != time.Second {
+		t.Fatalf("Expected the system resolver's answers to be kept for 1s, got %+v", sr)
+	}
+}
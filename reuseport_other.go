@@ -0,0 +1,14 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package net
+
+import (
+	"syscall"
+)
+
+// reusePortControl is a no-op on platforms without SO_REUSEPORT, hole
+// punching sockets can then only be reached by the other peer's dials
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,82 @@
+package net
+
+import (
+	"context"
+	"io"
+	"net"
+
+	smux "github.com/xtaci/smux"
+)
+
+// session is a multiplexed connection with a remote peer
+type session interface {
+	OpenStream() (net.Conn, error)
+	AcceptStream() (net.Conn, error)
+	IsClosed() bool
+	Close() error
+}
+
+// sessionTransport is implemented by transports that provide their own
+// stream multiplexing and peer authentication, ie. QUIC.
+// Sessions from these transports are used as they are, without selecting a
+// multiplexer or exchanging peer ids.
+type sessionTransport interface {
+	Transport
+	// DialSession connects to the peer and makes sure it is who we expect
+	DialSession(ctx context.Context, addr, pid string) (session, error)
+	ListenSessions(addr string) (sessionListener, error)
+}
+
+// sessionListener accepts sessions along with the remote peer's id
+type sessionListener interface {
+	Accept() (session, string, error)
+	Close() error
+	Addr() net.Addr
+}
+
+// smuxSession adapts smux sessions to session
+type smuxSession struct {
+	*smux.Session
+}
+
+// OpenStream -
+func (s *smuxSession) OpenStream() (net.Conn, error) {
+	st, err := s.Session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// AcceptStream -
+func (s *smuxSession) AcceptStream() (net.Conn, error) {
+	st, err := s.Session.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// peerStream is a stream the remote peer of a session opened
+type peerStream struct {
+	net.Conn
+	pid string
+}
+
+// CloseWrite half-closes the stream if it supports it, so pipes through the
+// stream still let the other end know when we are done writing
+func (s *peerStream) CloseWrite() error {
+	if cw, ok := s.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return s.Conn.Close()
+}
+
+// streamPeerID returns the id of the peer that opened a stream, or an empty
+// string if the stream did not come from a session
+func streamPeerID(rwc io.ReadWriteCloser) string {
+	if st, ok := rwc.(*peerStream); ok {
+		return st.pid
+	}
+	return ""
+}
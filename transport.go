@@ -3,11 +3,31 @@ package net
 import (
 	"context"
 	"net"
+	"strings"
 )
 
 // Transport -
 type Transport interface {
+	// Schemes returns the address schemes the transport handles, ie. `tcp4`
+	Schemes() []string
+	// CanDial checks if the transport can dial the given address
+	CanDial(addr string) bool
 	Dial(addr string) (net.Conn, error)
 	DialContext(ctx context.Context, addr string) (net.Conn, error)
 	Listen(addr string) (net.Listener, error)
 }
+
+// streamTransport is implemented by transports whose connections are
+// already streams to a protocol on the remote peer, ie. relays.
+// These connections are returned as they are, without being upgraded to
+// sessions.
+type streamTransport interface {
+	Transport
+	DialStream(ctx context.Context, addr string) (net.Conn, error)
+}
+
+// getScheme returns the scheme of an address, ie. `tcp4` for
+// `tcp4:1.2.3.4:21600/proto`
+func getScheme(addr string) string {
+	return strings.Split(addr, ":")[0]
+}
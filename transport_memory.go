@@ -0,0 +1,414 @@
+package net
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// memBufferSize is how many bytes can be written to a memory connection
+	// before writers block until the other end reads them
+	memBufferSize = 256 * 1024
+)
+
+var (
+	// ErrAddressInUse is returned when listening on an address that another
+	// listener is already using
+	ErrAddressInUse = errors.New("Address already in use")
+	// ErrConnectionRefused is returned when dialing an address nobody is
+	// listening on
+	ErrConnectionRefused = errors.New("Connection refused")
+	// ErrListenerClosed is returned when accepting from a closed listener
+	ErrListenerClosed = errors.New("Listener closed")
+
+	// DefaultSwitchboard is used by the memory transport NewNetwork adds
+	DefaultSwitchboard = NewSwitchboard()
+)
+
+// Switchboard connects memory transports that live in the same process.
+// Listeners register a name, ie. `mem:n1`, and dialers are connected to them
+// through in-memory pipes without touching the OS network stack.
+type Switchboard struct {
+	mutex     sync.Mutex
+	listeners map[string]*memListener
+	lastID    uint64
+}
+
+// NewSwitchboard returns an empty switchboard
+func NewSwitchboard() *Switchboard {
+	return &Switchboard{
+		listeners: map[string]*memListener{},
+	}
+}
+
+func (s *Switchboard) listen(name string) (*memListener, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.listeners[name]; ok {
+		return nil, ErrAddressInUse
+	}
+	l := &memListener{
+		switchboard: s,
+		addr:        memAddr(name),
+		conns:       make(chan net.Conn),
+		done:        make(chan struct{}),
+	}
+	s.listeners[name] = l
+	return l, nil
+}
+
+// dial connects to the listener with the given name, if laddr is empty the
+// dialer gets a unique address
+func (s *Switchboard) dial(ctx context.Context, laddr memAddr, name string) (net.Conn, error) {
+	s.mutex.Lock()
+	l, ok := s.listeners[name]
+	if laddr == "" {
+		s.lastID++
+		laddr = memAddr(fmt.Sprintf("dialer-%d", s.lastID))
+	}
+	s.mutex.Unlock()
+	if !ok {
+		return nil, ErrConnectionRefused
+	}
+
+	lc, rc := newMemConnPair(laddr, l.addr)
+	select {
+	case l.conns <- rc:
+		return lc, nil
+	case <-l.done:
+		return nil, ErrConnectionRefused
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *Switchboard) remove(l *memListener) {
+	s.mutex.Lock()
+	if s.listeners[string(l.addr)] == l {
+		delete(s.listeners, string(l.addr))
+	}
+	s.mutex.Unlock()
+}
+
+// MemoryTransport -
+type MemoryTransport struct {
+	switchboard *Switchboard
+}
+
+// NewMemoryTransport returns a transport for `mem:` addresses that connects
+// to listeners on the given switchboard
+func NewMemoryTransport(switchboard *Switchboard) Transport {
+	return &MemoryTransport{
+		switchboard: switchboard,
+	}
+}
+
+// Dial -
+func (t *MemoryTransport) Dial(addr string) (net.Conn, error) {
+	return t.DialContext(context.Background(), addr)
+}
+
+// DialContext -
+func (t *MemoryTransport) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	if t.matches(addr) == false {
+		return nil, ErrTransportNotSupported
+	}
+
+	name, err := t.getName(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.switchboard.dial(ctx, "", name)
+}
+
+// Listen -
+func (t *MemoryTransport) Listen(addr string) (net.Listener, error) {
+	if t.matches(addr) == false {
+		return nil, ErrTransportNotSupported
+	}
+
+	name, err := t.getName(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.switchboard.listen(name)
+}
+
+// Schemes -
+func (t *MemoryTransport) Schemes() []string {
+	return []string{"mem"}
+}
+
+// CanDial -
+func (t *MemoryTransport) CanDial(addr string) bool {
+	if t.matches(addr) == false {
+		return false
+	}
+	_, err := t.getName(addr)
+	return err == nil
+}
+
+func (t *MemoryTransport) matches(addr string) bool {
+	return getScheme(addr) == "mem"
+}
+
+func (t *MemoryTransport) getName(addr string) (string, error) {
+	a, err := ParseAddress(addr)
+	if err != nil {
+		return "", err
+	}
+	return a.Host, nil
+}
+
+// memAddr is the net.Addr of memory connections and listeners
+type memAddr string
+
+// Network -
+func (a memAddr) Network() string {
+	return "mem"
+}
+
+// String -
+func (a memAddr) String() string {
+	return "mem:" + string(a)
+}
+
+type memListener struct {
+	switchboard *Switchboard
+	addr        memAddr
+	conns       chan net.Conn
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+// Accept -
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Close -
+func (l *memListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.switchboard.remove(l)
+	})
+	return nil
+}
+
+// Addr -
+func (l *memListener) Addr() net.Addr {
+	return l.addr
+}
+
+// memBuffer is one direction of a memory connection, writes block once
+// memBufferSize bytes are waiting to be read
+type memBuffer struct {
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	buf       bytes.Buffer
+	closed    bool // no more writes
+	rclosed   bool // no more reads
+	rdeadline memDeadline
+	wdeadline memDeadline
+}
+
+// memDeadline wakes up the readers or writers of a buffer once it passes
+type memDeadline struct {
+	t     time.Time
+	timer *time.Timer
+}
+
+func (d *memDeadline) passed() bool {
+	return !d.t.IsZero() && !time.Now().Before(d.t)
+}
+
+func (d *memDeadline) stop() {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+}
+
+func newMemBuffer() *memBuffer {
+	b := &memBuffer{}
+	b.cond = sync.NewCond(&b.mutex)
+	return b
+}
+
+func (b *memBuffer) Read(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for {
+		if b.rclosed {
+			return 0, io.ErrClosedPipe
+		}
+		if b.buf.Len() > 0 {
+			n, err := b.buf.Read(p)
+			// writers might be waiting for room
+			b.cond.Broadcast()
+			return n, err
+		}
+		if b.closed {
+			return 0, io.EOF
+		}
+		if b.rdeadline.passed() {
+			return 0, errMemTimeout
+		}
+		b.cond.Wait()
+	}
+}
+
+func (b *memBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	n := 0
+	for len(p) > 0 {
+		if b.closed || b.rclosed {
+			return n, io.ErrClosedPipe
+		}
+		if b.wdeadline.passed() {
+			return n, errMemTimeout
+		}
+		room := memBufferSize - b.buf.Len()
+		if room <= 0 {
+			b.cond.Wait()
+			continue
+		}
+		if room > len(p) {
+			room = len(p)
+		}
+		b.buf.Write(p[:room])
+		n += room
+		p = p[room:]
+		b.cond.Broadcast()
+	}
+	return n, nil
+}
+
+func (b *memBuffer) setReadDeadline(t time.Time) {
+	b.setDeadline(&b.rdeadline, t)
+}
+
+func (b *memBuffer) setWriteDeadline(t time.Time) {
+	b.setDeadline(&b.wdeadline, t)
+}
+
+func (b *memBuffer) setDeadline(d *memDeadline, t time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	d.t = t
+	d.stop()
+	if !t.IsZero() {
+		d.timer = time.AfterFunc(time.Until(t), func() {
+			b.mutex.Lock()
+			b.cond.Broadcast()
+			b.mutex.Unlock()
+		})
+	}
+	b.cond.Broadcast()
+}
+
+func (b *memBuffer) closeWrite() {
+	b.mutex.Lock()
+	b.closed = true
+	b.cond.Broadcast()
+	b.mutex.Unlock()
+}
+
+func (b *memBuffer) closeRead() {
+	b.mutex.Lock()
+	b.rclosed = true
+	b.rdeadline.stop()
+	b.wdeadline.stop()
+	b.cond.Broadcast()
+	b.mutex.Unlock()
+}
+
+// memTimeoutError satisfies net.Error for deadlines
+type memTimeoutError struct{}
+
+func (memTimeoutError) Error() string   { return "i/o timeout" }
+func (memTimeoutError) Timeout() bool   { return true }
+func (memTimeoutError) Temporary() bool { return true }
+
+var errMemTimeout net.Error = memTimeoutError{}
+
+// memConn is one end of an in-memory connection
+type memConn struct {
+	r      *memBuffer
+	w      *memBuffer
+	local  memAddr
+	remote memAddr
+}
+
+func newMemConnPair(a, b memAddr) (*memConn, *memConn) {
+	ab := newMemBuffer()
+	ba := newMemBuffer()
+	return &memConn{r: ba, w: ab, local: a, remote: b},
+		&memConn{r: ab, w: ba, local: b, remote: a}
+}
+
+// Read -
+func (c *memConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Write -
+func (c *memConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+// CloseWrite lets the other end know no more data will be written
+func (c *memConn) CloseWrite() error {
+	c.w.closeWrite()
+	return nil
+}
+
+// Close -
+func (c *memConn) Close() error {
+	c.w.closeWrite()
+	c.r.closeRead()
+	return nil
+}
+
+// LocalAddr -
+func (c *memConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr -
+func (c *memConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// SetDeadline -
+func (c *memConn) SetDeadline(t time.Time) error {
+	c.r.setReadDeadline(t)
+	c.w.setWriteDeadline(t)
+	return nil
+}
+
+// SetReadDeadline -
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.r.setReadDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline -
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	c.w.setWriteDeadline(t)
+	return nil
+}
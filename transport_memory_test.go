@@ -0,0 +1,167 @@
+package net
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMemoryTransport(t *testing.T) {
+	tr := NewMemoryTransport(NewSwitchboard())
+
+	if _, err := tr.Dial("mem:a"); err != ErrConnectionRefused {
+		t.Fatalf("Expected ErrConnectionRefused, got %v", err)
+	}
+
+	lst, err := tr.Listen("mem:a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tr.Listen("mem:a"); err != ErrAddressInUse {
+		t.Fatalf("Expected ErrAddressInUse, got %v", err)
+	}
+
+	go func() {
+		c, err := lst.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	c, err := tr.Dial("mem:a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if c.RemoteAddr().String() != "mem:a" {
+		t.Fatalf("Unexpected remote address %s", c.RemoteAddr())
+	}
+
+	if _, err := c.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "hello\n" {
+		t.Fatalf("Expected echo, got %q", line)
+	}
+
+	lst.Close()
+	if _, err := tr.Dial("mem:a"); err != ErrConnectionRefused {
+		t.Fatalf("Expected ErrConnectionRefused after close, got %v", err)
+	}
+}
+
+func TestMemConnCloseWrite(t *testing.T) {
+	a, b := newMemConnPair("a", "b")
+
+	a.Write([]byte("ping"))
+	a.CloseWrite()
+
+	buf, err := ioutil.ReadAll(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("Expected ping, got %q", buf)
+	}
+
+	// the other direction still works
+	if _, err := b.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	buf, err = ioutil.ReadAll(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "pong" {
+		t.Fatalf("Expected pong, got %q", buf)
+	}
+}
+
+func TestMemConnDeadlines(t *testing.T) {
+	a, b := newMemConnPair("a", "b")
+	defer a.Close()
+	defer b.Close()
+
+	a.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := a.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Fatalf("Expected read to time out, got %v", err)
+	}
+
+	// nobody reads from b, so writes block once its buffer is full
+	a.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	n, err := a.Write(make([]byte, memBufferSize+1))
+	if !isTimeout(err) {
+		t.Fatalf("Expected write to time out, got %v", err)
+	}
+	if n != memBufferSize {
+		t.Fatalf("Expected %d bytes to be written, got %d", memBufferSize, n)
+	}
+
+	// reading makes room for the rest
+	a.SetDeadline(time.Time{})
+	go io.Copy(ioutil.Discard, b)
+	if _, err := a.Write(make([]byte, memBufferSize)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryNetworks(t *testing.T) {
+	a := newTestNetwork(t, &Peer{
+		ID:        "mem-net-a",
+		Addresses: []string{"mem:mem-net-a"},
+	})
+	b := newTestNetwork(t, &Peer{
+		ID:        "mem-net-b",
+		Addresses: []string{"mem:mem-net-b"},
+	})
+
+	b.RegisterStreamHandler("echo", func(protocolID string, rwc io.ReadWriteCloser) error {
+		defer rwc.Close()
+		_, err := io.Copy(rwc, rwc)
+		return err
+	})
+
+	err := a.PutPeer(Peer{
+		ID:        "mem-net-b",
+		Addresses: []string{"mem:mem-net-b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	echo(t, a, "mem-net-b/echo")
+	echo(t, a, "mem-net-b/echo")
+
+	sess, ok := a.getSession("mem-net-b")
+	if !ok {
+		t.Fatal("Expected a session with mem-net-b")
+	}
+
+	if err := a.identify.ping("mem-net-b", sess); err != nil {
+		t.Fatal(err)
+	}
+	peer, err := a.peerstore.Get("mem-net-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer.Latency == 0 {
+		t.Fatal("Expected the peer's latency to be recorded")
+	}
+}
+
+func isTimeout(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
+}
@@ -0,0 +1,568 @@
+package net
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// QUICNextProto is the ALPN protocol negotiated on QUIC connections
+	QUICNextProto = "nimona/1"
+
+	// quicIdentityLabel is used to export keying material from the TLS
+	// session, peers sign it to prove who they are
+	quicIdentityLabel = "EXPORTER-nimona-identity"
+	// quicHandshakeTimeout is how long the identity handshake can take
+	quicHandshakeTimeout = 10 * time.Second
+	// quicOpenStreamTimeout is how long opening a stream can wait for the
+	// remote peer to allow more streams
+	quicOpenStreamTimeout = 10 * time.Second
+	// quicPunchPackets is how many packets are sent to punch through NATs,
+	// quicPunchInterval how far apart
+	quicPunchPackets  = 5
+	quicPunchInterval = 100 * time.Millisecond
+)
+
+var (
+	// ErrQUICSessionsOnly is returned when the QUIC transport is used as a
+	// plain transport, it can only provide sessions
+	ErrQUICSessionsOnly = errors.New("QUIC transport only provides sessions")
+	// ErrIdentityMismatch is returned when the peer we connected to is not
+	// the one we dialed
+	ErrIdentityMismatch = errors.New("Remote peer is not the one we dialed")
+	// ErrInvalidIdentity is returned when the remote peer's identity
+	// signature does not verify
+	ErrInvalidIdentity = errors.New("Invalid identity signature")
+	// ErrUnsignedIdentity is returned when the remote peer did not sign the
+	// session, ie. because it has no keys
+	ErrUnsignedIdentity = errors.New("Identity was not signed")
+	// ErrIdentityRejected is returned when the peer we dialed did not accept
+	// our identity
+	ErrIdentityRejected = errors.New("Identity was rejected by the remote peer")
+	// ErrQUICNotListening is returned when punching without a listener to
+	// punch from
+	ErrQUICNotListening = errors.New("QUIC transport is not listening")
+)
+
+// quicIdentity is exchanged on the first stream of every QUIC connection.
+// The signature covers keying material exported from the connection's TLS
+// session, binding the peer's identity to this specific connection.
+type quicIdentity struct {
+	ID        string `json:"id"`
+	PublicKey []byte `json:"publicKey,omitempty"`
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// QUICTransport -
+type QUICTransport struct {
+	mutex      sync.Mutex
+	peer       *Peer
+	tlsOnce    sync.Once
+	tlsConfig  *tls.Config
+	tlsErr     error
+	quicConfig *quic.Config
+	transports map[string]*quic.Transport // of our listeners, by udp network
+}
+
+// NewQUICTransport returns a transport for `quic:` addresses.
+// Connections use a self-signed TLS certificate, which is only generated
+// once the transport is first used, peers are instead authenticated by
+// signing the TLS session with their own keys. Peers without keys can't
+// connect to or accept connections from others.
+func NewQUICTransport(peer *Peer) (Transport, error) {
+	return &QUICTransport{
+		peer: peer,
+		quicConfig: &quic.Config{
+			KeepAlivePeriod: 15 * time.Second,
+		},
+		transports: map[string]*quic.Transport{},
+	}, nil
+}
+
+// getTLSConfig generates the certificate the first time it is called
+func (t *QUICTransport) getTLSConfig() (*tls.Config, error) {
+	t.tlsOnce.Do(func() {
+		cert, err := generateCertificate()
+		if err != nil {
+			t.tlsErr = err
+			return
+		}
+		t.tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{QUICNextProto},
+			// certificates are not used to identify peers
+			InsecureSkipVerify: true,
+		}
+	})
+	return t.tlsConfig, t.tlsErr
+}
+
+// Dial -
+func (t *QUICTransport) Dial(addr string) (net.Conn, error) {
+	return nil, ErrQUICSessionsOnly
+}
+
+// DialContext -
+func (t *QUICTransport) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	return nil, ErrQUICSessionsOnly
+}
+
+// Listen -
+func (t *QUICTransport) Listen(addr string) (net.Listener, error) {
+	return nil, ErrQUICSessionsOnly
+}
+
+// DialSession -
+func (t *QUICTransport) DialSession(ctx context.Context, addr, pid string) (session, error) {
+	if t.matches(addr) == false {
+		return nil, ErrTransportNotSupported
+	}
+
+	caddr, err := t.getCleanAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*maxDialTimeoutSeconds)
+	defer cancel()
+
+	raddr, err := net.ResolveUDPAddr("udp", caddr)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := t.getTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// connections are dialed from the socket we listen on if there is one,
+	// so that NATs we punched through let them through
+	var conn quic.Connection
+	if qt := t.getTransport(raddr.IP); qt != nil {
+		conn, err = qt.Dial(ctx, raddr, tlsConfig, t.quicConfig)
+	} else {
+		conn, err = quic.DialAddr(ctx, caddr, tlsConfig, t.quicConfig)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, err
+	}
+
+	rpid, err := t.handshake(conn, st, "client")
+	st.Close()
+	if err != nil {
+		conn.CloseWithError(0, err.Error())
+		return nil, err
+	}
+
+	if rpid != pid {
+		conn.CloseWithError(0, ErrIdentityMismatch.Error())
+		return nil, ErrIdentityMismatch
+	}
+
+	return &quicSession{conn: conn}, nil
+}
+
+// ListenSessions -
+func (t *QUICTransport) ListenSessions(addr string) (sessionListener, error) {
+	if t.matches(addr) == false {
+		return nil, ErrTransportNotSupported
+	}
+
+	caddr, err := t.getCleanAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	laddr, err := net.ResolveUDPAddr("udp", caddr)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := t.getTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	network := udpNetwork(laddr.IP)
+	udpConn, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	qt := &quic.Transport{Conn: udpConn}
+	lst, err := qt.Listen(tlsConfig, t.quicConfig)
+	if err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+
+	t.mutex.Lock()
+	t.transports[network] = qt
+	t.mutex.Unlock()
+
+	ql := &quicListener{
+		transport: t,
+		network:   network,
+		qt:        qt,
+		conn:      udpConn,
+		listener:  lst,
+		sessions:  make(chan *quicAccepted),
+		done:      make(chan struct{}),
+	}
+	go ql.accept()
+	return ql, nil
+}
+
+// punch sends a few packets to the address from the socket we listen on,
+// so that our NAT lets the other peer's packets through. The packets are
+// not QUIC packets, the other end drops them.
+func (t *QUICTransport) punch(ctx context.Context, addr string) error {
+	caddr, err := t.getCleanAddr(addr)
+	if err != nil {
+		return err
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp", caddr)
+	if err != nil {
+		return err
+	}
+
+	qt := t.getTransport(raddr.IP)
+	if qt == nil {
+		return ErrQUICNotListening
+	}
+
+	b := make([]byte, 32)
+	for i := 0; i < quicPunchPackets; i++ {
+		if _, err := qt.WriteTo(b, raddr); err != nil {
+			return err
+		}
+		select {
+		case <-time.After(quicPunchInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// getTransport returns the transport of the listener for the ip's family
+func (t *QUICTransport) getTransport(ip net.IP) *quic.Transport {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.transports[udpNetwork(ip)]
+}
+
+func (t *QUICTransport) removeTransport(network string, qt *quic.Transport) {
+	t.mutex.Lock()
+	if t.transports[network] == qt {
+		delete(t.transports, network)
+	}
+	t.mutex.Unlock()
+}
+
+// handshake exchanges identities over the given stream, it returns the
+// remote peer's id once it has been verified
+func (t *QUICTransport) handshake(conn quic.Connection, st quic.Stream, role string) (string, error) {
+	st.SetDeadline(time.Now().Add(quicHandshakeTimeout))
+
+	state := conn.ConnectionState().TLS
+	material, err := state.ExportKeyingMaterial(quicIdentityLabel, nil, 32)
+	if err != nil {
+		return "", err
+	}
+
+	remoteRole := "server"
+	if role == "server" {
+		remoteRole = "client"
+	}
+
+	// peers without keys can't prove who they are
+	pk, err := t.peer.PublicKey()
+	if err != nil {
+		return "", err
+	}
+
+	sig, err := t.peer.Sign(append(material[:len(material):len(material)], role...))
+	if err != nil {
+		return "", err
+	}
+
+	lid := &quicIdentity{
+		ID:        t.peer.ID,
+		PublicKey: pk,
+		Signature: sig,
+	}
+
+	if err := writeMessage(st, lid); err != nil {
+		return "", err
+	}
+
+	rid := &quicIdentity{}
+	if err := readMessage(st, rid); err != nil {
+		return "", err
+	}
+
+	if len(rid.PublicKey) == 0 {
+		logrus.
+			WithField("rpid", rid.ID).
+			Debugf("Remote peer did not sign the session")
+		return "", ErrUnsignedIdentity
+	}
+
+	rp, err := NewPeerFromPublicKey(rid.ID, rid.PublicKey)
+	if err != nil {
+		return "", err
+	}
+
+	ok, err := rp.Verify(append(material[:len(material):len(material)], remoteRole...), rid.Signature)
+	if err != nil {
+		return "", err
+	}
+
+	if !ok {
+		return "", ErrInvalidIdentity
+	}
+
+	// the server closes the stream once it has verified our identity, and
+	// the connection if it did not
+	if role == "client" {
+		if _, err := st.Read(make([]byte, 1)); err != io.EOF {
+			return "", ErrIdentityRejected
+		}
+	}
+
+	return rid.ID, nil
+}
+
+// Schemes -
+func (t *QUICTransport) Schemes() []string {
+	return []string{"quic"}
+}
+
+// CanDial -
+func (t *QUICTransport) CanDial(addr string) bool {
+	if t.matches(addr) == false {
+		return false
+	}
+	_, err := t.getCleanAddr(addr)
+	return err == nil
+}
+
+func (t *QUICTransport) matches(addr string) bool {
+	return getScheme(addr) == "quic"
+}
+
+func (t *QUICTransport) getCleanAddr(addr string) (string, error) {
+	a, err := ParseAddress(addr)
+	if err != nil {
+		return "", err
+	}
+	return a.HostPort(), nil
+}
+
+type quicAccepted struct {
+	session *quicSession
+	pid     string
+}
+
+type quicListener struct {
+	transport *QUICTransport
+	network   string
+	qt        *quic.Transport
+	conn      *net.UDPConn
+	listener  *quic.Listener
+	sessions  chan *quicAccepted
+	done      chan struct{}
+}
+
+func (l *quicListener) accept() {
+	for {
+		conn, err := l.listener.Accept(context.Background())
+		if err != nil {
+			close(l.done)
+			return
+		}
+		// handshakes run on their own so slow peers don't hold up others
+		go l.handshake(conn)
+	}
+}
+
+func (l *quicListener) handshake(conn quic.Connection) {
+	ctx, cancel := context.WithTimeout(context.Background(), quicHandshakeTimeout)
+	defer cancel()
+
+	st, err := conn.AcceptStream(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return
+	}
+
+	pid, err := l.transport.handshake(conn, st, "server")
+	if err != nil {
+		logrus.WithError(err).Debugf("QUIC handshake failed")
+		conn.CloseWithError(0, err.Error())
+		return
+	}
+
+	// let the client know we accepted its identity
+	st.Close()
+
+	select {
+	case l.sessions <- &quicAccepted{session: &quicSession{conn: conn}, pid: pid}:
+	case <-l.done:
+		conn.CloseWithError(0, "")
+	}
+}
+
+// Accept -
+func (l *quicListener) Accept() (session, string, error) {
+	select {
+	case a := <-l.sessions:
+		return a.session, a.pid, nil
+	case <-l.done:
+		return nil, "", ErrListenerClosed
+	}
+}
+
+// Close closes the listener along with the sessions dialed from its socket
+func (l *quicListener) Close() error {
+	l.transport.removeTransport(l.network, l.qt)
+	l.listener.Close()
+	l.qt.Close()
+	return l.conn.Close()
+}
+
+// Addr -
+func (l *quicListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// quicSession uses the connection's native streams
+type quicSession struct {
+	conn quic.Connection
+}
+
+// OpenStream -
+func (s *quicSession) OpenStream() (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), quicOpenStreamTimeout)
+	defer cancel()
+
+	st, err := s.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &quicStream{Stream: st, conn: s.conn}, nil
+}
+
+// AcceptStream -
+func (s *quicSession) AcceptStream() (net.Conn, error) {
+	st, err := s.conn.AcceptStream(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &quicStream{Stream: st, conn: s.conn}, nil
+}
+
+// IsClosed -
+func (s *quicSession) IsClosed() bool {
+	select {
+	case <-s.conn.Context().Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// Close -
+func (s *quicSession) Close() error {
+	return s.conn.CloseWithError(0, "")
+}
+
+// quicStream adapts QUIC streams to net.Conn
+type quicStream struct {
+	quic.Stream
+	conn quic.Connection
+}
+
+// LocalAddr -
+func (s *quicStream) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// RemoteAddr -
+func (s *quicStream) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// CloseWrite closes the sending side of the stream
+func (s *quicStream) CloseWrite() error {
+	return s.Stream.Close()
+}
+
+// Close closes both sides of the stream, QUIC streams only close their
+// sending side on Close
+func (s *quicStream) Close() error {
+	s.Stream.CancelRead(0)
+	return s.Stream.Close()
+}
+
+// generateCertificate creates a self-signed certificate for TLS sessions
+// that don't rely on certificates to identify peers
+func generateCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * 365 * time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
+
+// udpNetwork returns the udp network of an ip, unspecified ips listen on
+// both families and count as udp4 unless they are IPv6
+func udpNetwork(ip net.IP) string {
+	if ip != nil && ip.To4() == nil {
+		return "udp6"
+	}
+	return "udp4"
+}
@@ -0,0 +1,167 @@
+package net
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// newKeyedPeer returns a peer with its own keys, as QUIC requires
+func newKeyedPeer(t *testing.T, name string) *Peer {
+	ent, err := openpgp.NewEntity(name, "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPeer(ent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func newQUICTransport(t *testing.T, peer *Peer) *QUICTransport {
+	tr, err := NewQUICTransport(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr.(*QUICTransport)
+}
+
+type quicAcceptResult struct {
+	sess session
+	pid  string
+}
+
+// listenQUIC returns the address the transport listens on, along with the
+// sessions it accepts
+func listenQUIC(t *testing.T, tr *QUICTransport) (string, chan quicAcceptResult) {
+	addr := fmt.Sprintf("quic:127.0.0.1:%d", GetPort())
+	lst, err := tr.ListenSessions(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		lst.Close()
+	})
+
+	accepted := make(chan quicAcceptResult, 1)
+	go func() {
+		for {
+			sess, pid, err := lst.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- quicAcceptResult{sess, pid}
+		}
+	}()
+	return addr, accepted
+}
+
+func TestQUICHandshake(t *testing.T) {
+	ap := newKeyedPeer(t, "a")
+	bp := newKeyedPeer(t, "b")
+	a := newQUICTransport(t, ap)
+	b := newQUICTransport(t, bp)
+
+	addr, accepted := listenQUIC(t, b)
+
+	sess, err := a.DialSession(context.Background(), addr, bp.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	var r quicAcceptResult
+	select {
+	case r = <-accepted:
+	case <-time.After(quicHandshakeTimeout):
+		t.Fatal("Session was not accepted")
+	}
+	defer r.sess.Close()
+	if r.pid != ap.ID {
+		t.Fatalf("Expected session from %s, got %s", ap.ID, r.pid)
+	}
+
+	// streams go through once both peers know who they are talking to
+	go func() {
+		st, err := r.sess.AcceptStream()
+		if err != nil {
+			return
+		}
+		defer st.Close()
+		io.Copy(st, st)
+	}()
+	st, err := sess.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if _, err := st.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	st.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(st, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("Expected hello, got %q", buf)
+	}
+}
+
+func TestQUICHandshakeIdentityMismatch(t *testing.T) {
+	ap := newKeyedPeer(t, "a")
+	bp := newKeyedPeer(t, "b")
+	a := newQUICTransport(t, ap)
+	b := newQUICTransport(t, bp)
+
+	addr, _ := listenQUIC(t, b)
+
+	// we reached b, not the peer we wanted
+	if _, err := a.DialSession(context.Background(), addr, ap.ID); err != ErrIdentityMismatch {
+		t.Fatalf("Expected ErrIdentityMismatch, got %v", err)
+	}
+}
+
+func TestQUICHandshakeForgedIdentity(t *testing.T) {
+	ap := newKeyedPeer(t, "a")
+	bp := newKeyedPeer(t, "b")
+	cp := newKeyedPeer(t, "c")
+	b := newQUICTransport(t, bp)
+
+	addr, accepted := listenQUIC(t, b)
+
+	// c claims to be a, but can only sign with its own keys
+	forged := &Peer{
+		ID:     ap.ID,
+		entity: cp.entity,
+	}
+	c := newQUICTransport(t, forged)
+	if _, err := c.DialSession(context.Background(), addr, bp.ID); err == nil {
+		t.Fatal("Expected forged identity to be rejected")
+	}
+
+	select {
+	case r := <-accepted:
+		r.sess.Close()
+		t.Fatalf("Expected no session, got one from %s", r.pid)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestQUICHandshakeUnsigned(t *testing.T) {
+	bp := newKeyedPeer(t, "b")
+	b := newQUICTransport(t, bp)
+
+	addr, _ := listenQUIC(t, b)
+
+	// peers without keys can't prove who they are
+	a := newQUICTransport(t, &Peer{ID: "quic-unsigned-a"})
+	if _, err := a.DialSession(context.Background(), addr, bp.ID); err == nil {
+		t.Fatal("Expected peer without keys to fail")
+	}
+}
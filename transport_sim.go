@@ -0,0 +1,567 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// simMinRetransmitDelay is the least a lost write is delayed by, similar
+	// to TCP's minimum retransmission timeout
+	simMinRetransmitDelay = 200 * time.Millisecond
+	// simQueueSize is how many writes can be in flight on a connection
+	// before writers block
+	simQueueSize = 256
+)
+
+var (
+	// ErrPartitioned is returned when dialing or writing across a partition
+	ErrPartitioned = errors.New("Network partitioned")
+	// ErrConnectionDropped is returned when a dial was dropped by the
+	// simulated network
+	ErrConnectionDropped = errors.New("Connection dropped")
+
+	// errSimDeadlineChanged makes a blocked write wait for the new deadline
+	errSimDeadlineChanged = errors.New("Write deadline changed")
+)
+
+// LinkConfig describes the link between two nodes of a simulated network
+type LinkConfig struct {
+	// Latency is the one way delay of every write
+	Latency time.Duration
+	// Jitter is the maximum random delay added on top of the latency
+	Jitter time.Duration
+	// Bandwidth caps the bytes per second that can be written, 0 means
+	// unlimited
+	Bandwidth int
+	// LossRate is the probability of a write being lost, since connections
+	// are reliable lost writes are delayed as if they were retransmitted
+	LossRate float64
+	// DropRate is the probability of a new connection being dropped
+	DropRate float64
+	// Partitioned links refuse new connections and break existing ones
+	Partitioned bool
+}
+
+// SimNetwork is an in-process network where links between nodes can be
+// configured with latency, jitter, bandwidth caps, losses and partitions.
+// Links can be changed at runtime and apply to existing connections.
+// Randomness comes from a seeded source so runs can be reproduced.
+type SimNetwork struct {
+	mutex       sync.Mutex
+	switchboard *Switchboard
+	rand        *rand.Rand
+	defaultLink LinkConfig
+	links       map[[2]string]LinkConfig
+	conns       map[*simConn]struct{}
+}
+
+// NewSimNetwork returns a simulated network with perfect links
+func NewSimNetwork(seed int64) *SimNetwork {
+	return &SimNetwork{
+		switchboard: NewSwitchboard(),
+		rand:        rand.New(rand.NewSource(seed)),
+		links:       map[[2]string]LinkConfig{},
+		conns:       map[*simConn]struct{}{},
+	}
+}
+
+// Transport returns a transport for `sim:` addresses that dials from and
+// listens as the given node
+func (s *SimNetwork) Transport(name string) Transport {
+	return &SimTransport{
+		net:  s,
+		name: name,
+	}
+}
+
+// SetDefaultLink configures all links that have not been set explicitly
+func (s *SimNetwork) SetDefaultLink(cfg LinkConfig) {
+	s.mutex.Lock()
+	s.defaultLink = cfg
+	s.mutex.Unlock()
+	s.breakPartitioned()
+}
+
+// SetLink configures the link between two nodes, in both directions
+func (s *SimNetwork) SetLink(a, b string, cfg LinkConfig) {
+	s.mutex.Lock()
+	s.links[s.linkKey(a, b)] = cfg
+	s.mutex.Unlock()
+	s.breakPartitioned()
+}
+
+// ResetLink makes the link between two nodes use the default config again
+func (s *SimNetwork) ResetLink(a, b string) {
+	s.mutex.Lock()
+	delete(s.links, s.linkKey(a, b))
+	s.mutex.Unlock()
+	s.breakPartitioned()
+}
+
+// Partition cuts every node in one group off from every node in the other
+func (s *SimNetwork) Partition(as, bs []string) {
+	for _, a := range as {
+		for _, b := range bs {
+			cfg := s.Link(a, b)
+			cfg.Partitioned = true
+			s.SetLink(a, b, cfg)
+		}
+	}
+}
+
+// Heal removes the partitions between two groups of nodes
+func (s *SimNetwork) Heal(as, bs []string) {
+	for _, a := range as {
+		for _, b := range bs {
+			cfg := s.Link(a, b)
+			cfg.Partitioned = false
+			s.SetLink(a, b, cfg)
+		}
+	}
+}
+
+// Link returns the config of the link between two nodes
+func (s *SimNetwork) Link(a, b string) LinkConfig {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if cfg, ok := s.links[s.linkKey(a, b)]; ok {
+		return cfg
+	}
+	return s.defaultLink
+}
+
+func (s *SimNetwork) linkKey(a, b string) [2]string {
+	if a > b {
+		a, b = b, a
+	}
+	return [2]string{a, b}
+}
+
+// chance returns true with the given probability
+func (s *SimNetwork) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.rand.Float64() < p
+}
+
+// jitter returns a random duration up to max
+func (s *SimNetwork) jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return time.Duration(s.rand.Int63n(int64(max)))
+}
+
+func (s *SimNetwork) dial(ctx context.Context, from, to string) (net.Conn, error) {
+	cfg := s.Link(from, to)
+	if cfg.Partitioned {
+		return nil, ErrPartitioned
+	}
+
+	if s.chance(cfg.DropRate) {
+		return nil, ErrConnectionDropped
+	}
+
+	// connecting takes a round trip
+	select {
+	case <-time.After(2 * (cfg.Latency + s.jitter(cfg.Jitter))):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	c, err := s.switchboard.dial(ctx, memAddr(from), to)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.wrap(c, from, to), nil
+}
+
+func (s *SimNetwork) wrap(c net.Conn, from, to string) *simConn {
+	sc := &simConn{
+		Conn:     c,
+		net:      s,
+		from:     from,
+		to:       to,
+		queue:    make(chan simWrite, simQueueSize),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+		wchanged: make(chan struct{}),
+	}
+	s.mutex.Lock()
+	s.conns[sc] = struct{}{}
+	s.mutex.Unlock()
+	go sc.deliver()
+	return sc
+}
+
+func (s *SimNetwork) remove(sc *simConn) {
+	s.mutex.Lock()
+	delete(s.conns, sc)
+	s.mutex.Unlock()
+}
+
+// breakPartitioned closes the connections over partitioned links
+func (s *SimNetwork) breakPartitioned() {
+	s.mutex.Lock()
+	conns := []*simConn{}
+	for sc := range s.conns {
+		conns = append(conns, sc)
+	}
+	s.mutex.Unlock()
+
+	for _, sc := range conns {
+		if s.Link(sc.from, sc.to).Partitioned {
+			sc.abort()
+		}
+	}
+}
+
+// SimTransport -
+type SimTransport struct {
+	net  *SimNetwork
+	name string
+}
+
+// Dial -
+func (t *SimTransport) Dial(addr string) (net.Conn, error) {
+	return t.DialContext(context.Background(), addr)
+}
+
+// DialContext -
+func (t *SimTransport) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	if t.matches(addr) == false {
+		return nil, ErrTransportNotSupported
+	}
+
+	name, err := t.getName(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.net.dial(ctx, t.name, name)
+}
+
+// Listen -
+func (t *SimTransport) Listen(addr string) (net.Listener, error) {
+	if t.matches(addr) == false {
+		return nil, ErrTransportNotSupported
+	}
+
+	name, err := t.getName(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if name != t.name {
+		return nil, errors.New("Cannot listen as another node")
+	}
+
+	lst, err := t.net.switchboard.listen(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &simListener{
+		memListener: lst,
+		net:         t.net,
+	}, nil
+}
+
+// Schemes -
+func (t *SimTransport) Schemes() []string {
+	return []string{"sim"}
+}
+
+// CanDial -
+func (t *SimTransport) CanDial(addr string) bool {
+	if t.matches(addr) == false {
+		return false
+	}
+	_, err := t.getName(addr)
+	return err == nil
+}
+
+func (t *SimTransport) matches(addr string) bool {
+	return getScheme(addr) == "sim"
+}
+
+func (t *SimTransport) getName(addr string) (string, error) {
+	a, err := ParseAddress(addr)
+	if err != nil {
+		return "", err
+	}
+	return a.Host, nil
+}
+
+type simListener struct {
+	*memListener
+	net *SimNetwork
+}
+
+// Accept -
+func (l *simListener) Accept() (net.Conn, error) {
+	c, err := l.memListener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	// the dialer's node name is its address on the switchboard
+	from := string(l.addr)
+	to := string(c.RemoteAddr().(memAddr))
+	return l.net.wrap(c, from, to), nil
+}
+
+// simWrite is a write waiting to be delivered, or a close if close is set
+type simWrite struct {
+	data  []byte
+	at    time.Time
+	close func() error
+}
+
+// simConn delays writes according to the link config between its two nodes.
+// Writes are queued and delivered in order by a single goroutine, so the
+// latency is not paid by the writer, while bandwidth caps and full queues
+// block the writer until its write deadline.
+type simConn struct {
+	net.Conn
+	net       *SimNetwork
+	from      string
+	to        string
+	mutex     sync.Mutex
+	last      time.Time
+	closed    bool
+	wdeadline time.Time
+	wchanged  chan struct{} // closed when the write deadline changes
+	queue     chan simWrite
+	closing   chan struct{} // closed once no more writes will be queued
+	done      chan struct{}
+	closeOnce sync.Once
+	abortOnce sync.Once
+}
+
+// Write -
+func (c *simConn) Write(p []byte) (int, error) {
+	cfg := c.net.Link(c.from, c.to)
+	if cfg.Partitioned {
+		c.abort()
+		return 0, ErrPartitioned
+	}
+
+	if cfg.Bandwidth > 0 {
+		d := time.Duration(len(p)) * time.Second / time.Duration(cfg.Bandwidth)
+		if err := c.wait(time.Now().Add(d)); err != nil {
+			return 0, err
+		}
+	}
+
+	delay := cfg.Latency + c.net.jitter(cfg.Jitter)
+	if c.net.chance(cfg.LossRate) {
+		retransmit := 2 * cfg.Latency
+		if retransmit < simMinRetransmitDelay {
+			retransmit = simMinRetransmitDelay
+		}
+		delay += retransmit
+	}
+
+	data := make([]byte, len(p))
+	copy(data, p)
+	if err := c.enqueue(simWrite{data: data}, delay); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// CloseWrite half-closes the connection once all pending writes have been
+// delivered
+func (c *simConn) CloseWrite() error {
+	cw, ok := c.Conn.(closeWriter)
+	if !ok {
+		return c.Close()
+	}
+	return c.enqueue(simWrite{close: cw.CloseWrite}, 0)
+}
+
+// Close stops reads and writes right away, the writes that are still
+// pending are delivered before the other end sees the connection close
+func (c *simConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mutex.Lock()
+		c.closed = true
+		c.mutex.Unlock()
+		close(c.closing)
+		if mc, ok := c.Conn.(*memConn); ok {
+			mc.r.closeRead()
+		}
+	})
+	return nil
+}
+
+// SetDeadline -
+func (c *simConn) SetDeadline(t time.Time) error {
+	c.SetWriteDeadline(t)
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline applies to writes waiting for bandwidth or for room in
+// the queue, once queued writes are delivered regardless
+func (c *simConn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.wdeadline = t
+	close(c.wchanged)
+	c.wchanged = make(chan struct{})
+	c.mutex.Unlock()
+	return nil
+}
+
+func (c *simConn) getWriteDeadline() (time.Time, chan struct{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.wdeadline, c.wchanged
+}
+
+func (c *simConn) enqueue(w simWrite, delay time.Duration) error {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return io.ErrClosedPipe
+	}
+	// writes can't overtake each other
+	w.at = time.Now().Add(delay)
+	if w.at.Before(c.last) {
+		w.at = c.last
+	}
+	c.last = w.at
+	c.mutex.Unlock()
+
+	for {
+		deadline, changed := c.getWriteDeadline()
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+		var err error
+		select {
+		case c.queue <- w:
+		case <-timeout:
+			err = errMemTimeout
+		case <-changed:
+			err = errSimDeadlineChanged
+		case <-c.closing:
+			err = io.ErrClosedPipe
+		case <-c.done:
+			err = io.ErrClosedPipe
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != errSimDeadlineChanged {
+			return err
+		}
+	}
+}
+
+// wait blocks writes until the link had the bandwidth to send them, it
+// gives up when the write deadline passes or the connection is closed
+func (c *simConn) wait(until time.Time) error {
+	timer := time.NewTimer(time.Until(until))
+	defer timer.Stop()
+
+	for {
+		deadline, changed := c.getWriteDeadline()
+		var dtimer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			dtimer = time.NewTimer(time.Until(deadline))
+			timeout = dtimer.C
+		}
+		var err error
+		select {
+		case <-timer.C:
+		case <-timeout:
+			err = errMemTimeout
+		case <-changed:
+			err = errSimDeadlineChanged
+		case <-c.closing:
+			err = io.ErrClosedPipe
+		case <-c.done:
+			err = io.ErrClosedPipe
+			if c.net.Link(c.from, c.to).Partitioned {
+				err = ErrPartitioned
+			}
+		}
+		if dtimer != nil {
+			dtimer.Stop()
+		}
+		if err != errSimDeadlineChanged {
+			return err
+		}
+	}
+}
+
+func (c *simConn) deliver() {
+	defer c.net.remove(c)
+	for {
+		select {
+		case w := <-c.queue:
+			if !c.write(w) {
+				return
+			}
+		case <-c.closing:
+			// deliver what was written before closing
+			for len(c.queue) > 0 {
+				if !c.write(<-c.queue) {
+					return
+				}
+			}
+			c.Conn.Close()
+			return
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// write delivers a queued write once it is due, it returns false if the
+// connection was aborted
+func (c *simConn) write(w simWrite) bool {
+	select {
+	case <-time.After(time.Until(w.at)):
+	case <-c.done:
+		return false
+	}
+	if w.close != nil {
+		w.close()
+		return true
+	}
+	if _, err := c.Conn.Write(w.data); err != nil {
+		c.abort()
+		return false
+	}
+	return true
+}
+
+// abort closes the connection right away, dropping pending writes
+func (c *simConn) abort() {
+	c.abortOnce.Do(func() {
+		c.mutex.Lock()
+		c.closed = true
+		c.mutex.Unlock()
+		close(c.done)
+		c.Conn.Close()
+	})
+}
@@ -0,0 +1,220 @@
+package net
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newSimPair returns both ends of a connection from a to b
+func newSimPair(t *testing.T, sim *SimNetwork) (net.Conn, net.Conn) {
+	lst, err := sim.Transport("b").Listen("sim:b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		lst.Close()
+	})
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := lst.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- c
+	}()
+
+	a, err := sim.Transport("a").Dial("sim:b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, ok := <-accepted
+	if !ok {
+		t.Fatal("Could not accept connection")
+	}
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a, b
+}
+
+func TestSimLatency(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.SetLink("a", "b", LinkConfig{Latency: 50 * time.Millisecond})
+
+	a, b := newSimPair(t, sim)
+
+	start := time.Now()
+	if _, err := a.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 25*time.Millisecond {
+		t.Fatal("Writer should not pay the latency")
+	}
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(b, buf); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Fatalf("Write was delivered after %s, before the latency", d)
+	}
+}
+
+func TestSimPartition(t *testing.T) {
+	sim := NewSimNetwork(1)
+
+	a, _ := newSimPair(t, sim)
+
+	sim.Partition([]string{"a"}, []string{"b"})
+
+	if _, err := a.Write([]byte("ping")); err == nil {
+		t.Fatal("Expected write across the partition to fail")
+	}
+	if _, err := sim.Transport("a").Dial("sim:b"); err != ErrPartitioned {
+		t.Fatalf("Expected ErrPartitioned, got %v", err)
+	}
+
+	sim.Heal([]string{"a"}, []string{"b"})
+
+	if cfg := sim.Link("a", "b"); cfg.Partitioned {
+		t.Fatal("Expected link to be healed")
+	}
+}
+
+func TestSimWriteDeadline(t *testing.T) {
+	sim := NewSimNetwork(1)
+
+	a, _ := newSimPair(t, sim)
+
+	sim.SetLink("a", "b", LinkConfig{Latency: time.Hour})
+
+	// the delivering goroutine holds one write, the rest fill up the queue
+	for i := 0; i < simQueueSize+1; i++ {
+		if _, err := a.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	if _, err := a.Write([]byte("x")); !isTimeout(err) {
+		t.Fatalf("Expected write to time out, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Write timed out after %s", d)
+	}
+
+	sim.SetLink("a", "b", LinkConfig{Bandwidth: 10})
+	a.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := a.Write(make([]byte, 100)); !isTimeout(err) {
+		t.Fatalf("Expected write to time out on bandwidth, got %v", err)
+	}
+}
+
+func TestSimClose(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.SetLink("a", "b", LinkConfig{Latency: 100 * time.Millisecond})
+
+	a, b := newSimPair(t, sim)
+
+	if _, err := a.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	reading := make(chan error, 1)
+	go func() {
+		_, err := a.Read(make([]byte, 1))
+		reading <- err
+	}()
+
+	start := time.Now()
+	a.Close()
+	if d := time.Since(start); d > 25*time.Millisecond {
+		t.Fatalf("Close took %s", d)
+	}
+
+	select {
+	case err := <-reading:
+		if err == nil {
+			t.Fatal("Expected read on closed connection to fail")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read was not unblocked by close")
+	}
+
+	if _, err := a.Write([]byte("x")); err == nil {
+		t.Fatal("Expected write on closed connection to fail")
+	}
+
+	// what was written before closing still arrives
+	buf, err := readAllTimeout(b, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("Expected ping, got %q", buf)
+	}
+}
+
+func readAllTimeout(c net.Conn, d time.Duration) ([]byte, error) {
+	c.SetReadDeadline(time.Now().Add(d))
+	buf := []byte{}
+	b := make([]byte, 64)
+	for {
+		n, err := c.Read(b)
+		buf = append(buf, b[:n]...)
+		if err == io.EOF {
+			return buf, nil
+		}
+		if err != nil {
+			return buf, err
+		}
+	}
+}
+
+func TestSimBandwidthInterrupted(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.SetLink("a", "b", LinkConfig{Bandwidth: 10})
+
+	for name, interrupt := range map[string]func(a net.Conn){
+		"close": func(a net.Conn) {
+			a.Close()
+		},
+		"partition": func(a net.Conn) {
+			sim.Partition([]string{"a"}, []string{"b"})
+		},
+		"deadline": func(a net.Conn) {
+			a.SetWriteDeadline(time.Now())
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			defer sim.Heal([]string{"a"}, []string{"b"})
+
+			a, _ := newSimPair(t, sim)
+
+			// the write would wait 10 seconds for the bandwidth
+			writing := make(chan error, 1)
+			go func() {
+				_, err := a.Write(make([]byte, 100))
+				writing <- err
+			}()
+
+			time.Sleep(50 * time.Millisecond)
+			interrupt(a)
+
+			select {
+			case err := <-writing:
+				if err == nil {
+					t.Fatal("Expected write to fail")
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Write was not interrupted")
+			}
+		})
+	}
+}
@@ -2,9 +2,7 @@ package net
 
 import (
 	"context"
-	"errors"
 	"net"
-	"strings"
 	"time"
 )
 
@@ -32,18 +30,21 @@ func (t *TCPTransport) DialContext(ctx context.Context, addr string) (net.Conn,
 		return nil, ErrTransportNotSupported
 	}
 
-	caddr, err := t.getCleanAddr(addr)
+	a, err := ParseAddress(addr)
 	if err != nil {
 		return nil, err
 	}
 
 	d := net.Dialer{Timeout: time.Second * maxDialTimeoutSeconds}
-	c, err := d.DialContext(ctx, "tcp", caddr)
-	if err != nil {
-		return nil, err
+	for _, caddr := range t.getDialAddrs(a) {
+		var c net.Conn
+		c, err = d.DialContext(ctx, a.Scheme, caddr)
+		if err == nil {
+			return c, nil
+		}
 	}
 
-	return c, nil
+	return nil, err
 }
 
 // Listen -
@@ -52,27 +53,134 @@ func (t *TCPTransport) Listen(addr string) (net.Listener, error) {
 		return nil, ErrTransportNotSupported
 	}
 
-	caddr, err := t.getCleanAddr(addr)
+	network, caddr, err := t.getCleanAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return net.Listen(network, caddr)
+}
+
+// listenPunch binds a new socket for a hole punching attempt.
+// Port reuse is only allowed on these sockets, so that the attempt can dial
+// from the port it listens on without anyone else being able to bind to the
+// ports of our listeners.
+func (t *TCPTransport) listenPunch(scheme string) (punchSocket, error) {
+	if scheme != "tcp4" && scheme != "tcp6" {
+		return nil, ErrTransportNotSupported
+	}
+
+	lc := net.ListenConfig{Control: reusePortControl}
+	lst, err := lc.Listen(context.Background(), scheme, ":0")
 	if err != nil {
 		return nil, err
 	}
 
-	return net.Listen("tcp", caddr)
+	return &tcpPunchSocket{
+		Listener: lst,
+		network:  scheme,
+		port:     lst.Addr().(*net.TCPAddr).Port,
+	}, nil
+}
+
+// tcpPunchSocket listens on and dials from the same port, which allows
+// simultaneous opens to punch through NATs that preserve ports
+type tcpPunchSocket struct {
+	net.Listener
+	network string
+	port    int
+}
+
+// Address returns our address with the socket's port, as NATs that
+// preserve ports will map it to the same port on their external address
+func (s *tcpPunchSocket) Address(addr string) string {
+	a, err := ParseAddress(addr)
+	if err != nil || a.Scheme != s.network {
+		return ""
+	}
+	a.Port = s.port
+	a.Protocol = ""
+	return a.String()
+}
+
+// DialContext dials from the socket's port
+func (s *tcpPunchSocket) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	a, err := ParseAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	if a.Scheme != s.network {
+		return nil, ErrTransportNotSupported
+	}
+
+	d := net.Dialer{
+		Timeout:   time.Second * maxDialTimeoutSeconds,
+		LocalAddr: &net.TCPAddr{Port: s.port},
+		Control:   reusePortControl,
+	}
+	return d.DialContext(ctx, s.network, a.HostPort())
+}
+
+// getDialAddrs returns the host and port pairs to try when dialing an
+// address. Link-local IPv6 addresses we got from other peers carry the zone
+// of the interface on their end, which might not exist here, so they are
+// dialed through each of our interfaces that have link-local addresses.
+func (t *TCPTransport) getDialAddrs(a *Address) []string {
+	ip := a.IP()
+	if ip == nil || ip.To4() != nil || !ip.IsLinkLocalUnicast() {
+		return []string{a.HostPort()}
+	}
+
+	zones := []string{}
+	if _, err := net.InterfaceByName(a.Zone); err == nil {
+		zones = append(zones, a.Zone)
+	}
+	for _, zone := range getLinkLocalZones() {
+		if zone != a.Zone {
+			zones = append(zones, zone)
+		}
+	}
+
+	caddrs := []string{}
+	for _, zone := range zones {
+		za := *a
+		za.Zone = zone
+		caddrs = append(caddrs, za.HostPort())
+	}
+	if len(caddrs) == 0 {
+		return []string{a.HostPort()}
+	}
+	return caddrs
+}
+
+// Schemes -
+func (t *TCPTransport) Schemes() []string {
+	return []string{"tcp", "tcp4", "tcp6"}
+}
+
+// CanDial -
+func (t *TCPTransport) CanDial(addr string) bool {
+	if t.matches(addr) == false {
+		return false
+	}
+	_, _, err := t.getCleanAddr(addr)
+	return err == nil
 }
 
 func (t *TCPTransport) matches(addr string) bool {
-	pr := strings.Split(addr, ":")[0]
+	pr := getScheme(addr)
 	if pr == "tcp" || pr == "tcp4" || pr == "tcp6" {
 		return true
 	}
 	return false
 }
 
-func (t *TCPTransport) getCleanAddr(addr string) (string, error) {
-	pa := strings.Split(addr, "/")[0]
-	pr := strings.Split(pa, ":")
-	if len(pr) < 2 {
-		return "", errors.New("Invalid address")
+// getCleanAddr returns the network and the host and port to use with the
+// net package, ie. `tcp6` and `[::1]:21600`
+func (t *TCPTransport) getCleanAddr(addr string) (string, string, error) {
+	a, err := ParseAddress(addr)
+	if err != nil {
+		return "", "", err
 	}
-	return strings.Join(pr[1:], ":"), nil
+	return a.Scheme, a.HostPort(), nil
 }
@@ -0,0 +1,120 @@
+package net
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestTCPTransportIPv6(t *testing.T) {
+	lst, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 is not available")
+	}
+	lst.Close()
+
+	tr := NewTCPTransport()
+	addr := fmt.Sprintf("tcp6:[::1]:%d", GetPort())
+
+	lst, err = tr.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lst.Close()
+
+	go func() {
+		if c, err := lst.Accept(); err == nil {
+			c.Write([]byte("x"))
+			c.Close()
+		}
+	}()
+
+	c, err := tr.Dial(addr + "/proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if ip := c.RemoteAddr().(*net.TCPAddr).IP; ip.To4() != nil {
+		t.Fatalf("Expected an IPv6 connection, got %s", ip)
+	}
+}
+
+func TestTCPTransportSchemes(t *testing.T) {
+	tr := NewTCPTransport()
+
+	for addr, expected := range map[string]bool{
+		"tcp:1.2.3.4:21600":          true,
+		"tcp4:1.2.3.4:21600":         true,
+		"tcp6:[::1]:21600":           true,
+		"tcp6:[fe80::1%eth0]:21600":  true,
+		"tcp4:[::1]:21600":           false,
+		"tcp6:1.2.3.4:21600":         false,
+		"dns4:example.com:21600":     false,
+		"tcp4:1.2.3.4:21600/proto":   true,
+		"tcp6:[::1]:21600/proto/v1":  true,
+		"tcp4:1.2.3.4:not-a-port":    false,
+		"tcp6:[fe80::1%e/th0]:21600": false,
+	} {
+		if ok := tr.CanDial(addr); ok != expected {
+			t.Fatalf("Expected CanDial(%s) to be %t", addr, expected)
+		}
+	}
+}
+
+func TestTCPDialAddrsLinkLocal(t *testing.T) {
+	tr := &TCPTransport{}
+
+	// global addresses are dialed as they are
+	a, _ := ParseAddress("tcp6:[2001:db8::1]:21600")
+	if caddrs := tr.getDialAddrs(a); len(caddrs) != 1 || caddrs[0] != "[2001:db8::1]:21600" {
+		t.Fatalf("Expected [2001:db8::1]:21600, got %v", caddrs)
+	}
+
+	// the other peer's zone does not exist here, so the address is dialed
+	// through each of our interfaces with link-local addresses
+	a, _ = ParseAddress("tcp6:[fe80::1%no-such-interface]:21600")
+	caddrs := tr.getDialAddrs(a)
+	zones := getLinkLocalZones()
+	if len(zones) == 0 {
+		if len(caddrs) != 1 || caddrs[0] != a.HostPort() {
+			t.Fatalf("Expected %s, got %v", a.HostPort(), caddrs)
+		}
+		return
+	}
+	if len(caddrs) != len(zones) {
+		t.Fatalf("Expected an address for each of %v, got %v", zones, caddrs)
+	}
+	for i, zone := range zones {
+		if expected := "[fe80::1%" + zone + "]:21600"; caddrs[i] != expected {
+			t.Fatalf("Expected %s, got %s", expected, caddrs[i])
+		}
+	}
+}
+
+func TestGetAddresses(t *testing.T) {
+	addrs, err := GetAddresses(21600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, addr := range addrs {
+		a, err := ParseAddress(addr)
+		if err != nil {
+			t.Fatalf("Could not parse %s: %v", addr, err)
+		}
+		ip := a.IP()
+		switch {
+		case ip == nil:
+			t.Fatalf("Expected %s to hold an IP", addr)
+		case a.Scheme == "tcp4" && ip.To4() == nil,
+			a.Scheme == "tcp6" && ip.To4() != nil:
+			t.Fatalf("Expected %s to match its family", addr)
+		case a.Zone != "" && !ip.IsLinkLocalUnicast(),
+			a.Zone == "" && ip.To4() == nil && ip.IsLinkLocalUnicast():
+			t.Fatalf("Expected only link-local addresses to have a zone, got %s", addr)
+		}
+	}
+}
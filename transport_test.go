@@ -0,0 +1,115 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+var errFakeDial = errors.New("Fake dial")
+
+// fakeTransport records the addresses it is asked to dial
+type fakeTransport struct {
+	schemes []string
+	dialed  chan string
+}
+
+func (t *fakeTransport) Schemes() []string {
+	return t.schemes
+}
+
+func (t *fakeTransport) CanDial(addr string) bool {
+	return !strings.Contains(addr, ":undialable")
+}
+
+func (t *fakeTransport) Dial(addr string) (net.Conn, error) {
+	return t.DialContext(context.Background(), addr)
+}
+
+func (t *fakeTransport) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	t.dialed <- addr
+	return nil, errFakeDial
+}
+
+func (t *fakeTransport) Listen(addr string) (net.Listener, error) {
+	return nil, ErrTransportNotSupported
+}
+
+func TestTransportBySchemes(t *testing.T) {
+	n := newTestNetwork(t, &Peer{
+		ID:        "transport-schemes",
+		Addresses: []string{"mem:transport-schemes"},
+	})
+
+	for addr, expected := range map[string]string{
+		"tcp:127.0.0.1:21600":         "*net.TCPTransport",
+		"tcp4:127.0.0.1:21600":        "*net.TCPTransport",
+		"tcp6:[::1]:21600":            "*net.TCPTransport",
+		"ws:127.0.0.1:21600":          "*net.WebSocketTransport",
+		"wss:127.0.0.1:21600":         "*net.WebSocketTransport",
+		"mem:other":                   "*net.MemoryTransport",
+		"relay:r/p":                   "*net.Relay",
+		UnixAddress("/tmp/peer.sock"): "*net.UnixTransport",
+	} {
+		tr, err := n.getTransport(addr)
+		if err != nil {
+			t.Fatalf("Expected a transport for %s, got %v", addr, err)
+		}
+		if typ := fmt.Sprintf("%T", tr); typ != expected {
+			t.Fatalf("Expected %s for %s, got %s", expected, addr, typ)
+		}
+	}
+
+	if _, err := n.getTransport("carrier-pigeon:home"); err != ErrTransportNotSupported {
+		t.Fatalf("Expected ErrTransportNotSupported, got %v", err)
+	}
+}
+
+func TestTransportAdded(t *testing.T) {
+	n := newTestNetwork(t, &Peer{
+		ID:        "transport-added",
+		Addresses: []string{"mem:transport-added"},
+	})
+
+	fake := &fakeTransport{
+		schemes: []string{"fake", "mem"},
+		dialed:  make(chan string, 10),
+	}
+	if err := n.AddTransport(fake); err != nil {
+		t.Fatal(err)
+	}
+
+	// the new transport replaces the one we had for its schemes
+	for _, addr := range []string{"fake:a", "mem:a"} {
+		if tr, err := n.getTransport(addr); err != nil || tr != fake {
+			t.Fatalf("Expected the added transport for %s, got %v", addr, err)
+		}
+	}
+
+	// addresses it can't dial are skipped
+	if _, err := n.getTransport("fake:undialable"); err != ErrTransportNotSupported {
+		t.Fatalf("Expected ErrTransportNotSupported, got %v", err)
+	}
+
+	err := n.PutPeer(Peer{
+		ID:        "transport-added-b",
+		Addresses: []string{"fake:undialable", "fake:b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.Dial("transport-added-b/echo"); err == nil {
+		t.Fatal("Expected dial to fail")
+	}
+	close(fake.dialed)
+	dialed := []string{}
+	for addr := range fake.dialed {
+		dialed = append(dialed, addr)
+	}
+	if len(dialed) != 1 || dialed[0] != "fake:b/echo" {
+		t.Fatalf("Expected fake:b/echo to be dialed, got %v", dialed)
+	}
+}
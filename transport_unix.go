@@ -0,0 +1,213 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// DefaultUnixSocketMode only allows the owner to connect to the socket
+	DefaultUnixSocketMode os.FileMode = 0600
+)
+
+var (
+	// ErrPeerCredentialsNotSupported is returned on platforms where the
+	// credentials of the other end of a unix socket can't be retrieved
+	ErrPeerCredentialsNotSupported = errors.New("Peer credentials not supported")
+)
+
+// UnixAddress returns the address of a unix socket.
+// Paths are escaped as addresses use `/` to separate the protocol.
+func UnixAddress(path string) string {
+	a := &Address{
+		Scheme: "unix",
+		Host:   path,
+	}
+	return a.String()
+}
+
+// PeerCredentials of the process on the other end of a unix socket
+type PeerCredentials struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// UnixConn is a unix socket connection that knows the credentials of the
+// process on the other end
+type UnixConn struct {
+	*net.UnixConn
+	creds    *PeerCredentials
+	credsErr error
+}
+
+func newUnixConn(c *net.UnixConn) *UnixConn {
+	creds, err := getPeerCredentials(c)
+	return &UnixConn{
+		UnixConn: c,
+		creds:    creds,
+		credsErr: err,
+	}
+}
+
+// PeerCredentials returns the credentials of the process on the other end,
+// as they were when the connection was established
+func (c *UnixConn) PeerCredentials() (*PeerCredentials, error) {
+	return c.creds, c.credsErr
+}
+
+// UnixTransport -
+type UnixTransport struct {
+	mode os.FileMode
+}
+
+// NewUnixTransport returns a transport for `unix:` addresses, sockets it
+// listens on are given the provided file mode
+func NewUnixTransport(mode os.FileMode) Transport {
+	return &UnixTransport{
+		mode: mode,
+	}
+}
+
+// Dial -
+func (t *UnixTransport) Dial(addr string) (net.Conn, error) {
+	return t.DialContext(context.Background(), addr)
+}
+
+// DialContext -
+func (t *UnixTransport) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	if t.matches(addr) == false {
+		return nil, ErrTransportNotSupported
+	}
+
+	path, err := t.getPath(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	d := net.Dialer{Timeout: time.Second * maxDialTimeoutSeconds}
+	c, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return newUnixConn(c.(*net.UnixConn)), nil
+}
+
+// Listen -
+func (t *UnixTransport) Listen(addr string) (net.Listener, error) {
+	if t.matches(addr) == false {
+		return nil, ErrTransportNotSupported
+	}
+
+	path, err := t.getPath(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	t.removeStale(path)
+
+	// the socket is bound in a directory only we can access and moved in
+	// place once it has its mode, so nobody can connect to it before that
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".unix-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "s")
+	lst, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	lst.SetUnlinkOnClose(false)
+
+	if err := os.Chmod(tmp, t.mode); err != nil {
+		lst.Close()
+		return nil, err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		lst.Close()
+		return nil, err
+	}
+
+	return &unixListener{
+		UnixListener: lst,
+		path:         path,
+	}, nil
+}
+
+// removeStale removes sockets left behind by processes that did not shut
+// down cleanly, sockets that are still being listened on are left alone
+func (t *UnixTransport) removeStale(path string) {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+
+	c, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		c.Close()
+		return
+	}
+
+	os.Remove(path)
+}
+
+// Schemes -
+func (t *UnixTransport) Schemes() []string {
+	return []string{"unix"}
+}
+
+// CanDial -
+func (t *UnixTransport) CanDial(addr string) bool {
+	if t.matches(addr) == false {
+		return false
+	}
+	_, err := t.getPath(addr)
+	return err == nil
+}
+
+func (t *UnixTransport) matches(addr string) bool {
+	return getScheme(addr) == "unix"
+}
+
+func (t *UnixTransport) getPath(addr string) (string, error) {
+	a, err := ParseAddress(addr)
+	if err != nil {
+		return "", err
+	}
+	return a.Host, nil
+}
+
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+// Accept -
+func (l *unixListener) Accept() (net.Conn, error) {
+	c, err := l.AcceptUnix()
+	if err != nil {
+		return nil, err
+	}
+	return newUnixConn(c), nil
+}
+
+// Close closes the listener and removes its socket
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+// Addr returns the path the socket was moved to
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
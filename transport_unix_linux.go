@@ -0,0 +1,32 @@
+package net
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+func getPeerCredentials(c *net.UnixConn) (*PeerCredentials, error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var ucred *unix.Ucred
+	var uerr error
+	err = rc.Control(func(fd uintptr) {
+		ucred, uerr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if uerr != nil {
+		return nil, uerr
+	}
+
+	return &PeerCredentials{
+		PID: ucred.Pid,
+		UID: ucred.Uid,
+		GID: ucred.Gid,
+	}, nil
+}
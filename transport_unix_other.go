@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package net
+
+import (
+	"net"
+)
+
+func getPeerCredentials(c *net.UnixConn) (*PeerCredentials, error) {
+	return nil, ErrPeerCredentialsNotSupported
+}
@@ -0,0 +1,137 @@
+package net
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// newSocketPath returns a path in a directory that is removed with the test
+func newSocketPath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	return filepath.Join(dir, "peer.sock")
+}
+
+func TestUnixAddress(t *testing.T) {
+	path := "/tmp/some dir/peer.sock"
+	addr := UnixAddress(path)
+
+	a, err := ParseAddress(addr + "/proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Host != path || a.Protocol != "proto" {
+		t.Fatalf("Expected %s and proto, got %s and %s", path, a.Host, a.Protocol)
+	}
+}
+
+func TestUnixTransport(t *testing.T) {
+	path := newSocketPath(t)
+	addr := UnixAddress(path)
+	tr := NewUnixTransport(DefaultUnixSocketMode)
+
+	lst, err := tr.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lst.Close()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != DefaultUnixSocketMode {
+		t.Fatalf("Expected socket mode %s, got %s", DefaultUnixSocketMode, mode)
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := lst.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- c
+	}()
+
+	c, err := tr.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ac, ok := <-accepted
+	if !ok {
+		t.Fatal("Could not accept connection")
+	}
+	defer ac.Close()
+
+	creds, err := ac.(*UnixConn).PeerCredentials()
+	if runtime.GOOS != "linux" {
+		if err != ErrPeerCredentialsNotSupported {
+			t.Fatalf("Expected ErrPeerCredentialsNotSupported, got %v", err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(creds.PID) != os.Getpid() || int(creds.UID) != os.Getuid() {
+		t.Fatalf("Expected our own credentials, got %+v", creds)
+	}
+}
+
+func TestUnixTransportStaleSocket(t *testing.T) {
+	path := newSocketPath(t)
+	addr := UnixAddress(path)
+	tr := NewUnixTransport(DefaultUnixSocketMode)
+
+	// a socket left behind by a process that did not shut down cleanly
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	lst, err := tr.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lst.Close()
+
+	go func() {
+		if c, err := lst.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+
+	c, err := tr.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestUnixNetworks(t *testing.T) {
+	a := newTestNetwork(t, &Peer{
+		ID:        "unix-a",
+		Addresses: []string{UnixAddress(newSocketPath(t))},
+	})
+	b := newTestNetwork(t, &Peer{
+		ID:        "unix-b",
+		Addresses: []string{UnixAddress(newSocketPath(t))},
+	})
+	connectDirect(t, a, b)
+
+	echo(t, a, "unix-b/echo")
+}
@@ -0,0 +1,358 @@
+package net
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultWebSocketPath is the http path websocket connections are
+	// upgraded on
+	DefaultWebSocketPath = "/nimona"
+)
+
+var (
+	// ErrMissingTLSConfig is returned when listening on a wss address
+	// without a TLS config
+	ErrMissingTLSConfig = errors.New("Missing TLS config")
+	// ErrMissingWebSocketPort is returned when listening on the ServeMux of
+	// an existing http server without the port the server listens on
+	ErrMissingWebSocketPort = errors.New("Missing port of the http server")
+)
+
+// WebSocketConfig -
+type WebSocketConfig struct {
+	// Path is the http path connections are upgraded on
+	Path string
+	// TLSConfig is used to listen on wss addresses, and to verify servers
+	// when dialing them
+	TLSConfig *tls.Config
+	// ServeMux, if set, is used instead of starting a new http server when
+	// listening, so the port can be shared with an existing http.Server.
+	// Only one address can be listened on at a time, and it should be the
+	// one the server is reachable on, as it is what we advertise.
+	ServeMux *http.ServeMux
+}
+
+// WebSocketTransport -
+type WebSocketTransport struct {
+	config     WebSocketConfig
+	upgrader   websocket.Upgrader
+	dialer     *websocket.Dialer
+	mutex      sync.Mutex
+	shared     *wsListener // listening on the ServeMux
+	registered bool        // our path has been registered on the ServeMux
+}
+
+// NewWebSocketTransport returns a transport for `ws:` and `wss:` addresses
+func NewWebSocketTransport(config WebSocketConfig) Transport {
+	if config.Path == "" {
+		config.Path = DefaultWebSocketPath
+	}
+	return &WebSocketTransport{
+		config: config,
+		upgrader: websocket.Upgrader{
+			// peers are not browsers, there is no origin to check
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		dialer: &websocket.Dialer{
+			HandshakeTimeout: time.Second * maxDialTimeoutSeconds,
+			TLSClientConfig:  config.TLSConfig,
+		},
+	}
+}
+
+// Dial -
+func (t *WebSocketTransport) Dial(addr string) (net.Conn, error) {
+	return t.DialContext(context.Background(), addr)
+}
+
+// DialContext -
+func (t *WebSocketTransport) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	if t.matches(addr) == false {
+		return nil, ErrTransportNotSupported
+	}
+
+	scheme, hostport, err := t.getCleanAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	url := scheme + "://" + hostport + t.config.Path
+	c, _, err := t.dialer.DialContext(ctx, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return newWSConn(c), nil
+}
+
+// Listen -
+func (t *WebSocketTransport) Listen(addr string) (net.Listener, error) {
+	if t.matches(addr) == false {
+		return nil, ErrTransportNotSupported
+	}
+
+	scheme, hostport, err := t.getCleanAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if scheme == "wss" && t.config.TLSConfig == nil {
+		return nil, ErrMissingTLSConfig
+	}
+
+	// share the port with an existing http server
+	if t.config.ServeMux != nil {
+		return t.listenShared(addr)
+	}
+
+	lst, err := net.Listen("tcp", hostport)
+	if err != nil {
+		return nil, err
+	}
+
+	if scheme == "wss" {
+		lst = tls.NewListener(lst, t.config.TLSConfig)
+	}
+
+	wl := newWSListener(lst.Addr())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(t.config.Path, func(w http.ResponseWriter, r *http.Request) {
+		t.upgrade(wl, w, r)
+	})
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(lst)
+
+	wl.close = srv.Close
+	return wl, nil
+}
+
+// listenShared listens on the config's ServeMux. Our path is registered on
+// it once, as registering it again would panic, and requests are upgraded
+// for as long as the listener is open.
+func (t *WebSocketTransport) listenShared(addr string) (net.Listener, error) {
+	a, err := ParseAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.Port == 0 {
+		return nil, ErrMissingWebSocketPort
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.shared != nil {
+		return nil, ErrAddressInUse
+	}
+
+	wl := newWSListener(wsAddr(addr))
+	wl.close = func() error {
+		t.mutex.Lock()
+		if t.shared == wl {
+			t.shared = nil
+		}
+		t.mutex.Unlock()
+		return nil
+	}
+	t.shared = wl
+
+	if !t.registered {
+		t.config.ServeMux.HandleFunc(t.config.Path, t.serveShared)
+		t.registered = true
+	}
+
+	return wl, nil
+}
+
+// serveShared upgrades the requests of the ServeMux
+func (t *WebSocketTransport) serveShared(w http.ResponseWriter, r *http.Request) {
+	t.mutex.Lock()
+	wl := t.shared
+	t.mutex.Unlock()
+
+	if wl == nil {
+		http.Error(w, "Not listening", http.StatusServiceUnavailable)
+		return
+	}
+
+	t.upgrade(wl, w, r)
+}
+
+// upgrade upgrades a request and hands the connection to the listener
+func (t *WebSocketTransport) upgrade(wl *wsListener, w http.ResponseWriter, r *http.Request) {
+	c, err := t.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logrus.WithError(err).Debugf("Could not upgrade websocket")
+		return
+	}
+	select {
+	case wl.conns <- newWSConn(c):
+	case <-wl.done:
+		c.Close()
+	}
+}
+
+// Schemes -
+func (t *WebSocketTransport) Schemes() []string {
+	return []string{"ws", "wss"}
+}
+
+// CanDial -
+func (t *WebSocketTransport) CanDial(addr string) bool {
+	if t.matches(addr) == false {
+		return false
+	}
+	_, _, err := t.getCleanAddr(addr)
+	return err == nil
+}
+
+func (t *WebSocketTransport) matches(addr string) bool {
+	pr := getScheme(addr)
+	return pr == "ws" || pr == "wss"
+}
+
+func (t *WebSocketTransport) getCleanAddr(addr string) (string, string, error) {
+	a, err := ParseAddress(addr)
+	if err != nil {
+		return "", "", err
+	}
+	return a.Scheme, a.HostPort(), nil
+}
+
+// wsAddr is the address of listeners sharing an existing http server
+type wsAddr string
+
+// Network -
+func (a wsAddr) Network() string {
+	return "ws"
+}
+
+// String -
+func (a wsAddr) String() string {
+	return string(a)
+}
+
+type wsListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	done      chan struct{}
+	close     func() error
+	closeOnce sync.Once
+}
+
+func newWSListener(addr net.Addr) *wsListener {
+	return &wsListener{
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// Accept -
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Close -
+func (l *wsListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		if l.close != nil {
+			err = l.close()
+		}
+	})
+	return err
+}
+
+// Addr -
+func (l *wsListener) Addr() net.Addr {
+	return l.addr
+}
+
+// wsConn wraps a websocket connection as a net.Conn, data are sent as
+// binary messages and message boundaries are ignored when reading
+type wsConn struct {
+	*websocket.Conn
+	reader     io.Reader
+	writeMutex sync.Mutex
+}
+
+func newWSConn(c *websocket.Conn) *wsConn {
+	return &wsConn{
+		Conn: c,
+	}
+}
+
+// Read -
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			mt, r, err := c.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			if mt != websocket.BinaryMessage {
+				continue
+			}
+			c.reader = r
+		}
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Write -
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if err := c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close sends a close message before closing the underlying connection
+func (c *wsConn) Close() error {
+	c.writeMutex.Lock()
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	c.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	c.writeMutex.Unlock()
+	return c.Conn.Close()
+}
+
+// SetDeadline -
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
@@ -0,0 +1,180 @@
+package net
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestTLSConfig returns a config with a certificate for 127.0.0.1 that
+// is generated on the fly and trusted by the config itself
+func newTestTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{der},
+			PrivateKey:  key,
+		}},
+		RootCAs: pool,
+	}
+}
+
+// echoListener echoes the first line of every connection
+func echoListener(lst net.Listener) {
+	for {
+		c, err := lst.Accept()
+		if err != nil {
+			return
+		}
+		go func(c net.Conn) {
+			defer c.Close()
+			line, err := bufio.NewReader(c).ReadString('\n')
+			if err != nil {
+				return
+			}
+			c.Write([]byte(line))
+		}(c)
+	}
+}
+
+func echoConn(t *testing.T, c net.Conn) {
+	defer c.Close()
+	if _, err := c.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if line != "hello\n" {
+		t.Fatalf("Expected echo, got %q", line)
+	}
+}
+
+func TestWebSocketTLS(t *testing.T) {
+	tr := NewWebSocketTransport(WebSocketConfig{
+		TLSConfig: newTestTLSConfig(t),
+	})
+
+	lst, err := tr.Listen("wss:127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lst.Close()
+	go echoListener(lst)
+
+	port := lst.Addr().(*net.TCPAddr).Port
+	c, err := tr.Dial("wss:127.0.0.1:" + strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoConn(t, c)
+
+	// servers we don't trust are refused
+	untrusted := NewWebSocketTransport(WebSocketConfig{
+		TLSConfig: &tls.Config{},
+	})
+	if _, err := untrusted.Dial("wss:127.0.0.1:" + strconv.Itoa(port)); err == nil {
+		t.Fatal("Expected dialing an untrusted server to fail")
+	}
+
+	// wss needs a certificate to listen with
+	if _, err := NewWebSocketTransport(WebSocketConfig{}).Listen("wss:127.0.0.1:0"); err != ErrMissingTLSConfig {
+		t.Fatalf("Expected ErrMissingTLSConfig, got %v", err)
+	}
+}
+
+func TestWebSocketServeMux(t *testing.T) {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	addr := "ws:" + strings.TrimPrefix(srv.URL, "http://")
+	tr := NewWebSocketTransport(WebSocketConfig{
+		ServeMux: mux,
+	})
+
+	if _, err := tr.Listen("ws:127.0.0.1:0"); err != ErrMissingWebSocketPort {
+		t.Fatalf("Expected ErrMissingWebSocketPort, got %v", err)
+	}
+
+	lst, err := tr.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go echoListener(lst)
+
+	if lst.Addr().String() != addr {
+		t.Fatalf("Expected listener address %s, got %s", addr, lst.Addr())
+	}
+
+	if _, err := tr.Listen(addr); err != ErrAddressInUse {
+		t.Fatalf("Expected ErrAddressInUse, got %v", err)
+	}
+
+	c, err := tr.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoConn(t, c)
+
+	lst.Close()
+	if _, err := tr.Dial(addr); err == nil {
+		t.Fatal("Expected dialing a closed listener to fail")
+	}
+
+	// listening again does not register the path on the mux again
+	lst, err = tr.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lst.Close()
+	go echoListener(lst)
+
+	c, err = tr.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoConn(t, c)
+}
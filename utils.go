@@ -1,12 +1,7 @@
 package net
 
 import (
-	"fmt"
 	"net"
-	"strings"
-
-	"github.com/prestonTao/upnp"
-	"github.com/sirupsen/logrus"
 )
 
 // GetAddresses -
@@ -37,40 +32,54 @@ func GetAddresses(port int) ([]string, error) {
 			if ip == nil {
 				continue
 			}
-			addr := ""
-			if strings.Contains(ip.String(), ":") {
-			} else {
-				ips = append(ips, fmt.Sprintf("tcp4:%s:%d", ip.String(), port))
+			addr := &Address{
+				Scheme: "tcp4",
+				Host:   ip.String(),
+				Port:   port,
 			}
-			if addr == "" {
-				continue
+			if ip.To4() == nil {
+				addr.Scheme = "tcp6"
+				// link-local addresses are only valid on their interface
+				if ip.IsLinkLocalUnicast() {
+					addr.Zone = i.Name
+				}
 			}
-			ips = append(ips, addr)
+			ips = append(ips, addr.String())
 		}
 	}
 
-	if eip, err := getPublicAddress(); err != nil {
-		logrus.
-			WithError(err).
-			Warnf("Could not get external IP")
-	} else {
-		ips = append(ips, fmt.Sprintf("tcp4:%s:%d", eip, port))
-	}
-
 	return ips, nil
 }
 
-func getPublicAddress() (string, error) {
-	// TODO Better logging
-	upnpMan := new(upnp.Upnp)
-	err := upnpMan.ExternalIPAddr()
+// getLinkLocalZones returns the names of the interfaces that are up and have
+// link-local IPv6 addresses
+func getLinkLocalZones() []string {
+	zones := []string{}
+	ifaces, err := net.Interfaces()
 	if err != nil {
-		return "", err
+		return zones
 	}
 
-	return upnpMan.GatewayOutsideIP, nil
-}
+	for _, i := range ifaces {
+		if i.Flags&net.FlagUp == 0 || i.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipn, ok := addr.(*net.IPNet)
+			if !ok || ipn.IP.To4() != nil || !ipn.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			zones = append(zones, i.Name)
+			break
+		}
+	}
 
+	return zones
+}
 
 // Ask the kernel for a free open port that is ready to use
 func GetPort() int {
@@ -87,18 +96,8 @@ func GetPort() int {
 	return l.Addr().(*net.TCPAddr).Port
 }
 
-func privateAddress(addr string) bool {
-	if addr == "" {
-		return true
-	}
-
-	if strings.Contains(addr, "0.0.0.0") {
-		return true
-	}
-
-	if strings.Contains(addr, "0.0.0.0") {
-		return true
-	}
-
-	return false
+// isPublicAddress checks if the IP in a transport address is routable on the
+// internet
+func isPublicAddress(addr string) bool {
+	return ClassifyAddress(addr) == AddressClassPublic
 }
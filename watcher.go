@@ -0,0 +1,117 @@
+package net
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// interfaceWatchInterval is how often network interfaces are checked for
+	// new or removed addresses
+	interfaceWatchInterval = 10 * time.Second
+)
+
+// interfaceWatcher keeps the addresses we discovered from our network
+// interfaces up to date, so that moving between networks does not leave us
+// advertising addresses we no longer have.
+// Listeners are started on new addresses and closed on the removed ones.
+type interfaceWatcher struct {
+	mutex sync.Mutex
+	net   *network
+	port  int
+	addrs []string
+	done  chan struct{}
+}
+
+func newInterfaceWatcher(n *network, port int, addrs []string) *interfaceWatcher {
+	return &interfaceWatcher{
+		net:   n,
+		port:  port,
+		addrs: addrs,
+		done:  make(chan struct{}),
+	}
+}
+
+// Start checks the interfaces periodically until the watcher is closed
+func (w *interfaceWatcher) Start() {
+	go func() {
+		ticker := time.NewTicker(interfaceWatchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.refresh()
+			case <-w.done:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops watching
+func (w *interfaceWatcher) Close() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	select {
+	case <-w.done:
+	default:
+		close(w.done)
+	}
+}
+
+func (w *interfaceWatcher) refresh() {
+	current, err := GetAddresses(w.port)
+	if err != nil {
+		logrus.WithError(err).Warnf("Could not get interface addresses")
+		return
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	existing := map[string]bool{}
+	for _, addr := range w.addrs {
+		existing[addr] = true
+	}
+	found := map[string]bool{}
+	for _, addr := range current {
+		found[addr] = true
+	}
+
+	removed := []string{}
+	addrs := []string{}
+	for _, addr := range w.addrs {
+		if found[addr] {
+			addrs = append(addrs, addr)
+			continue
+		}
+		removed = append(removed, addr)
+		w.net.removeListener(addr)
+	}
+
+	added := []string{}
+	for _, addr := range current {
+		if existing[addr] {
+			continue
+		}
+		if _, err := w.net.Listen(addr); err != nil {
+			continue
+		}
+		added = append(added, addr)
+		addrs = append(addrs, addr)
+	}
+
+	if len(removed) == 0 && len(added) == 0 {
+		return
+	}
+
+	logrus.
+		WithField("removed", removed).
+		WithField("added", added).
+		Infof("Interface addresses changed")
+
+	w.addrs = addrs
+	w.net.updateLocalAddresses(removed, added)
+}
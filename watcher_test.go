@@ -0,0 +1,146 @@
+package net
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestInterfaceWatcher(t *testing.T) {
+	n := newTestNetwork(t, &Peer{
+		ID:        "watcher-a",
+		Addresses: []string{"mem:watcher-a"},
+	})
+
+	port := GetPort()
+	current, err := GetAddresses(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(current) == 0 {
+		t.Skip("No interface addresses")
+	}
+
+	// an address of an interface that has since gone away
+	stale := (&Address{Scheme: "tcp4", Host: "10.255.255.1", Port: port}).String()
+	n.setLocalAddresses([]string{"mem:watcher-a", stale})
+
+	notified := make(chan []string, 1)
+	n.RegisterAddressHandler(func(addrs []string) error {
+		notified <- addrs
+		return nil
+	})
+
+	w := newInterfaceWatcher(n, port, []string{stale})
+	w.refresh()
+
+	expected := append([]string{"mem:watcher-a"}, current...)
+	sort.Strings(expected)
+
+	addrs := n.getLocalAddresses()
+	sort.Strings(addrs)
+	if !reflect.DeepEqual(addrs, expected) {
+		t.Fatalf("Expected %v, got %v", expected, addrs)
+	}
+
+	select {
+	case addrs := <-notified:
+		sort.Strings(addrs)
+		if !reflect.DeepEqual(addrs, expected) {
+			t.Fatalf("Expected handlers to get %v, got %v", expected, addrs)
+		}
+	default:
+		t.Fatal("Expected address handlers to be notified")
+	}
+
+	// we are listening on the addresses that were found
+	for _, addr := range current {
+		c, err := NewTCPTransport().Dial(addr)
+		if err != nil {
+			t.Fatalf("Could not dial %s: %v", addr, err)
+		}
+		c.Close()
+	}
+
+	// nothing changes until the interfaces do
+	w.refresh()
+	select {
+	case addrs := <-notified:
+		t.Fatalf("Expected no notification, got %v", addrs)
+	default:
+	}
+}
+
+func TestGetLocalPeerCopy(t *testing.T) {
+	n := newTestNetwork(t, &Peer{
+		ID:        "local-peer-a",
+		Addresses: []string{"mem:local-peer-a"},
+	})
+
+	lp := n.GetLocalPeer()
+	lp.Addresses[0] = "mem:changed"
+	lp.Protocols = append(lp.Protocols[:0], "/changed")
+
+	if addrs := n.GetLocalPeer().Addresses; addrs[0] != "mem:local-peer-a" {
+		t.Fatalf("Expected the local peer to be left as it was, got %v", addrs)
+	}
+	if !n.GetLocalPeer().SupportsProtocol(IdentifyProtocolID) {
+		t.Fatal("Expected the local peer's protocols to be left as they were")
+	}
+}
+
+func TestLocalAddressUpdates(t *testing.T) {
+	n := newTestNetwork(t, &Peer{
+		ID:        "local-addrs-a",
+		Addresses: []string{"mem:local-addrs-a"},
+	})
+
+	updates := make(chan []string, 10)
+	n.RegisterAddressHandler(func(addrs []string) error {
+		updates <- addrs
+		return nil
+	})
+
+	// the local peer can be read while addresses change
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if lp := n.GetLocalPeer(); len(lp.Addresses) == 0 {
+				t.Error("Expected the local peer to have addresses")
+			}
+		}
+	}()
+
+	added := n.updateLocalAddresses(nil, []string{"mem:local-addrs-b", "mem:local-addrs-a"})
+	if expected := []string{"mem:local-addrs-b"}; !reflect.DeepEqual(added, expected) {
+		t.Fatalf("Expected only %v to be added, got %v", expected, added)
+	}
+	n.updateLocalAddresses([]string{"mem:local-addrs-a"}, nil)
+	wg.Wait()
+
+	for _, expected := range [][]string{
+		{"mem:local-addrs-a", "mem:local-addrs-b"},
+		{"mem:local-addrs-b"},
+	} {
+		addrs := <-updates
+		sort.Strings(addrs)
+		if !reflect.DeepEqual(addrs, expected) {
+			t.Fatalf("Expected %v, got %v", expected, addrs)
+		}
+	}
+
+	if addrs := n.GetLocalPeer().Addresses; !reflect.DeepEqual(addrs, []string{"mem:local-addrs-b"}) {
+		t.Fatalf("Expected the local peer to have the new addresses, got %v", addrs)
+	}
+
+	// removing what isn't there changes nothing
+	n.updateLocalAddresses([]string{"mem:local-addrs-c"}, nil)
+	select {
+	case addrs := <-updates:
+		t.Fatalf("Expected no update, got %v", addrs)
+	default:
+	}
+}